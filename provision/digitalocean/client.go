@@ -3,7 +3,12 @@ package digitalocean
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/digitalocean/godo"
 	"golang.org/x/oauth2"
@@ -11,11 +16,20 @@ import (
 
 // Droplet
 type Droplet struct {
-	ID        int
-	Name      string
-	PrivateIP string
-	PublicIP  string
-	SSHUser   string
+	ID         int
+	Name       string
+	PrivateIP  string
+	PublicIP   string
+	PublicIPv6 string
+	SSHUser    string
+	Region     string
+	Size       string
+	Image      string
+	VPCUUID    string
+	VolumeIDs  []string
+	Status     string
+	Tags       []string
+	Created    time.Time
 }
 
 type NodeConfig struct {
@@ -27,6 +41,10 @@ type NodeConfig struct {
 	Keys              []string
 	Tags              []string
 	PrivateNetworking bool
+	IPv6              bool
+	Monitoring        bool
+	Backups           bool
+	VPCUUID           string
 }
 
 type KeyConfig struct {
@@ -36,9 +54,149 @@ type KeyConfig struct {
 	Fingerprint   string
 }
 
+type VolumeConfig struct {
+	ID     string
+	Name   string
+	Region string
+	SizeGB int64
+	Tags   []string
+}
+
+type FirewallConfig struct {
+	ID         string
+	Name       string
+	Tags       []string
+	SSHSources []string
+	// SSHPort is the port SSH is allowed on from the SSHSources
+	SSHPort int
+	// MetricsSources are allowed to scrape the node exporter, when it is installed
+	MetricsSources []string
+	// LoadBalancerSources are the load balancers allowed to reach the API server
+	LoadBalancerSources []string
+	// TagSources are the tags of the droplets allowed by the inbound rules
+	TagSources []string
+}
+
+type LoadBalancerConfig struct {
+	ID         string
+	Name       string
+	Region     string
+	VPCUUID    string
+	Port       int
+	DropletIDs []int
+	IP         string
+	Status     string
+}
+
+type FloatingIPConfig struct {
+	IP        string
+	Region    string
+	DropletID int
+}
+
+type DNSRecordConfig struct {
+	ID     int
+	Domain string
+	Name   string
+	Type   string
+	Data   string
+	TTL    int
+}
+
+type ImageConfig struct {
+	ID      int
+	Slug    string
+	Name    string
+	Type    string
+	Regions []string
+	// MinDiskSize is the smallest disk in GB the image can be deployed on
+	MinDiskSize int
+}
+
+type SizeConfig struct {
+	Slug         string
+	VCPUs        int
+	MemoryMB     int
+	DiskGB       int
+	PriceHourly  float64
+	PriceMonthly float64
+	Regions      []string
+	Available    bool
+}
+
+type RegionConfig struct {
+	Slug      string
+	Name      string
+	Available bool
+	Features  []string
+}
+
+// AccountLimits is the droplet limit of the account and the number of droplets it has
+type AccountLimits struct {
+	DropletLimit int
+	DropletCount int
+}
+
+// DOClient is the Digital Ocean API used by the provisioner. It is implemented by Client,
+// and by a fake in the tests.
+type DOClient interface {
+	GetDroplet(token string, dropletID int) (Droplet, error)
+	ListDropletsByTag(token string, tag string) ([]Droplet, error)
+	CreateNode(token string, config NodeConfig, keyconfig KeyConfig) (Droplet, error)
+	DeleteDroplet(token string, dropletID int) error
+	DeleteDropletsByTag(token string, tag string, keyname string) error
+	DeleteTag(token string, tag string) error
+	TagDroplets(token string, tag string, dropletIDs []int) error
+	GetVPCRegion(token string, vpcID string) (string, error)
+
+	CreateVolume(token string, config VolumeConfig) (VolumeConfig, error)
+	AttachVolume(token string, volumeID string, dropletID int) error
+	ListVolumesByTag(token string, tag string) ([]AttachedVolume, error)
+	GetVolume(token string, volumeID string) (AttachedVolume, error)
+	DetachVolume(token string, volumeID string, dropletID int) error
+	DeleteVolume(token string, volumeID string) error
+
+	CreateFirewall(token string, config FirewallConfig) (FirewallConfig, error)
+	ListFirewallsByTag(token string, tag string) ([]FirewallConfig, error)
+	DeleteFirewall(token string, firewallID string) error
+	FindFirewallByName(token string, name string) (FirewallConfig, error)
+	AddFirewallTags(token string, firewallID string, tags []string) error
+	RemoveFirewallTags(token string, firewallID string, tags []string) error
+	AllowLoadBalancer(token string, firewallID string, lbID string, port int) error
+
+	CreateLoadBalancer(token string, config LoadBalancerConfig) (LoadBalancerConfig, error)
+	GetLoadBalancer(token string, lbID string) (LoadBalancerConfig, error)
+	FindLoadBalancersByName(token string, name string) ([]LoadBalancerConfig, error)
+	AddLoadBalancerDroplets(token string, lbID string, dropletIDs []int) error
+	DeleteLoadBalancer(token string, lbID string) error
+
+	ReserveFloatingIP(token string, region string) (FloatingIPConfig, error)
+	AssignFloatingIP(token string, ip string, dropletID int) error
+	UnassignFloatingIP(token string, ip string) error
+	ReleaseFloatingIP(token string, ip string) error
+	ListFloatingIPsByTag(token string, tag string) ([]FloatingIPConfig, error)
+
+	DomainExists(token string, domain string) (bool, error)
+	ListDNSRecords(token string, domain string, name string) ([]DNSRecordConfig, error)
+	CreateDNSRecord(token string, config DNSRecordConfig) (DNSRecordConfig, error)
+	DeleteDNSRecord(token string, domain string, recordID int) error
+
+	FindImage(token string, image string) (ImageConfig, error)
+	ListImages(token string) ([]ImageConfig, error)
+	ListSizes(token string) ([]SizeConfig, error)
+	ListRegions(token string) ([]RegionConfig, error)
+	GetAccountLimits(token string) (AccountLimits, error)
+
+	CreateKey(token string, config KeyConfig) (KeyConfig, error)
+	FindKeyByFingerprint(token string, fingerprint string) (KeyConfig, error)
+	FindKeyByName(token string, keyName string) (KeyConfig, error)
+	DeleteKeyByName(token string, keyName string) (bool, error)
+}
+
 // Client for provisioning machines on AWS
 type Client struct {
 	doClient *godo.Client
+	regions  []RegionConfig
 }
 
 type TokenSource struct {
@@ -52,12 +210,127 @@ func (t *TokenSource) Token() (*oauth2.Token, error) {
 	return token, nil
 }
 
+const (
+	apiRequestTimeout    = 2 * time.Minute
+	apiRetryAttempts     = 5
+	apiRetryInitialDelay = 2 * time.Second
+	apiRetryMaxDelay     = 30 * time.Second
+)
+
+// retryWithBackoff calls the DO API function until it succeeds, fails with an error
+// that is not transient, or the maximum number of attempts is reached.
+// Rate limiting, server errors and failed requests are considered transient.
+func retryWithBackoff(fn func() (*godo.Response, error)) error {
+	delay := apiRetryInitialDelay
+	var err error
+	var status int
+	for attempt := 1; ; attempt++ {
+		var resp *godo.Response
+		resp, err = fn()
+		if err == nil {
+			return nil
+		}
+		status = 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		if !isTransient(status) {
+			return err
+		}
+		if attempt == apiRetryAttempts {
+			return fmt.Errorf("Giving up after %d attempts (last HTTP status %d): %v", attempt, status, err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+		if delay > apiRetryMaxDelay {
+			delay = apiRetryMaxDelay
+		}
+	}
+}
+
+// listAll calls the list function with each page of the results, until the last one. Each
+// page is retried with retryWithBackoff.
+func listAll(fn func(opt *godo.ListOptions) (*godo.Response, error)) error {
+	opt := &godo.ListOptions{Page: 1, PerPage: 200}
+	for {
+		var resp *godo.Response
+		err := retryWithBackoff(func() (*godo.Response, error) {
+			var err error
+			resp, err = fn(opt)
+			return resp, err
+		})
+		if err != nil {
+			return err
+		}
+		if resp == nil || resp.Links == nil || resp.Links.IsLastPage() {
+			return nil
+		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return err
+		}
+		opt.Page = page + 1
+	}
+}
+
+func isTransient(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// noProxyHosts are reached without the proxy, in addition to the hosts of $NO_PROXY
+var noProxyHosts []string
+
+// setNoProxy sets the hosts given with --no-proxy
+func setNoProxy(hosts []string) {
+	noProxyHosts = hosts
+}
+
+// proxyTransport returns the default transport, with the proxy of $HTTP_PROXY and $HTTPS_PROXY
+// except for the hosts given with --no-proxy
+func proxyTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxyHosts) {
+			return nil, nil
+		}
+		return http.ProxyFromEnvironment(req)
+	}
+	return transport
+}
+
+// bypassProxy reports whether the host is reached without the proxy: it is one of the hosts,
+// a subdomain of one of them, or an IP in one of them given as a CIDR
+func bypassProxy(host string, hosts []string) bool {
+	ip := net.ParseIP(host)
+	for _, h := range hosts {
+		h = strings.TrimSpace(h)
+		if h == "*" {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(h); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		h = strings.TrimPrefix(h, ".")
+		if h != "" && (host == h || strings.HasSuffix(host, "."+h)) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Client) getAPIClient(token string) (*godo.Client, error) {
 	if c.doClient == nil {
 		tokenSource := &TokenSource{
 			AccessToken: token,
 		}
-		oauthClient := oauth2.NewClient(oauth2.NoContext, tokenSource)
+		// The API is reached through the proxy of the environment
+		base := &http.Client{Transport: proxyTransport()}
+		oauthClient := oauth2.NewClient(context.WithValue(oauth2.NoContext, oauth2.HTTPClient, base), tokenSource)
+		// A wedged request must not hang the provisioning
+		oauthClient.Timeout = apiRequestTimeout
 		c.doClient = godo.NewClient(oauthClient)
 	}
 	return c.doClient, nil
@@ -67,40 +340,124 @@ func (c Client) GetDroplet(token string, dropletID int) (Droplet, error) {
 	drop := Droplet{}
 	client, err := c.getAPIClient(token)
 	if err != nil {
-		fmt.Println("Cannot get api object", err)
+		logger.Debugf("Cannot get api object %v\n", err)
 		return drop, err
 	}
 
 	ctx := context.TODO()
 
-	newDroplet, _, errhost := client.Droplets.Get(ctx, dropletID)
+	var newDroplet *godo.Droplet
+	errhost := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		newDroplet, resp, err = client.Droplets.Get(ctx, dropletID)
+		return resp, err
+	})
 
 	if errhost != nil {
-		fmt.Println("Cannot create host", errhost)
+		logger.Debugf("Cannot create host %v\n", errhost)
 		return drop, errhost
 	}
-	drop.ID = newDroplet.ID
-	drop.Name = newDroplet.Name
-	if newDroplet.Networks.V4 != nil {
-		for i := 0; i < len(newDroplet.Networks.V4); i++ {
-			if newDroplet.Networks.V4[i].Type == "public" {
-				drop.PublicIP = newDroplet.Networks.V4[i].IPAddress
+	return toDroplet(newDroplet), nil
+
+}
+
+func toDroplet(d *godo.Droplet) Droplet {
+	drop := Droplet{}
+	drop.ID = d.ID
+	drop.Name = d.Name
+	drop.Size = d.SizeSlug
+	drop.VPCUUID = d.VPCUUID
+	drop.VolumeIDs = d.VolumeIDs
+	drop.Status = d.Status
+	drop.Tags = d.Tags
+	if created, err := time.Parse(time.RFC3339, d.Created); err == nil {
+		drop.Created = created
+	} else {
+		logger.Debugf("Cannot parse the creation time %q of droplet %s: %v\n", d.Created, d.Name, err)
+	}
+	if d.Region != nil {
+		drop.Region = d.Region.Slug
+	}
+	if d.Image != nil {
+		drop.Image = d.Image.Slug
+		// Snapshots and custom images do not have a slug
+		if drop.Image == "" {
+			drop.Image = strconv.Itoa(d.Image.ID)
+		}
+	}
+	if d.Networks != nil {
+		for i := 0; i < len(d.Networks.V4); i++ {
+			if d.Networks.V4[i].Type == "public" {
+				drop.PublicIP = d.Networks.V4[i].IPAddress
+			}
+			if d.Networks.V4[i].Type == "private" {
+				drop.PrivateIP = d.Networks.V4[i].IPAddress
 			}
-			if newDroplet.Networks.V4[i].Type == "private" {
-				drop.PrivateIP = newDroplet.Networks.V4[i].IPAddress
+		}
+		for i := 0; i < len(d.Networks.V6); i++ {
+			if d.Networks.V6[i].Type == "public" {
+				drop.PublicIPv6 = d.Networks.V6[i].IPAddress
 			}
 		}
 	}
+	return drop
+}
 
-	return drop, nil
+func (c Client) ListDropletsByTag(token string, tag string) ([]Droplet, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
+	}
+
+	ctx := context.TODO()
 
+	var list []godo.Droplet
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Droplets.ListByTag(ctx, tag, opt)
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+
+	droplets := []Droplet{}
+	for i := range list {
+		droplets = append(droplets, toDroplet(&list[i]))
+	}
+	return droplets, nil
+}
+
+// GetVPCRegion returns the slug of the region the VPC belongs to
+func (c Client) GetVPCRegion(token string, vpcID string) (string, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return "", err
+	}
+
+	ctx := context.TODO()
+
+	var vpc *godo.VPC
+	errvpc := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		vpc, resp, err = client.VPCs.Get(ctx, vpcID)
+		return resp, err
+	})
+	if errvpc != nil {
+		return "", errvpc
+	}
+	return vpc.RegionSlug, nil
 }
 
 func (c Client) CreateNode(token string, config NodeConfig, keyconfig KeyConfig) (Droplet, error) {
 	drop := Droplet{}
 	client, err := c.getAPIClient(token)
 	if err != nil {
-		fmt.Println("Cannot get api object", err)
+		logger.Debugf("Cannot get api object %v\n", err)
 		return drop, err
 	}
 
@@ -110,25 +467,49 @@ func (c Client) CreateNode(token string, config NodeConfig, keyconfig KeyConfig)
 	}
 	var keys []godo.DropletCreateSSHKey
 	keys = append(keys, sshKey)
+	// Additional keys already in the account are referenced by their fingerprint
+	for _, fingerprint := range config.Keys {
+		if fingerprint != keyconfig.Fingerprint {
+			keys = append(keys, godo.DropletCreateSSHKey{Fingerprint: fingerprint})
+		}
+	}
 	createRequest := &godo.DropletCreateRequest{
-		Name:   config.Name,
-		Region: config.Region,
-		Size:   config.Size,
-		Image: godo.DropletCreateImage{
-			Slug: config.Image,
-		},
+		Name:              config.Name,
+		Region:            config.Region,
+		Size:              config.Size,
+		Image:             createImage(config.Image),
 		UserData:          config.UserData,
 		Tags:              config.Tags,
 		SSHKeys:           keys,
 		PrivateNetworking: config.PrivateNetworking,
+		IPv6:              config.IPv6,
+		Monitoring:        config.Monitoring,
+		Backups:           config.Backups,
+		VPCUUID:           config.VPCUUID,
 	}
 
 	ctx := context.TODO()
 
-	newDroplet, _, errhost := client.Droplets.Create(ctx, createRequest)
+	var newDroplet *godo.Droplet
+	attempted := false
+	errhost := retryWithBackoff(func() (*godo.Response, error) {
+		// A failed request may have created the droplet anyway, which must not be created twice
+		if attempted {
+			found, resp, err := findCreatedDroplet(ctx, client, config)
+			if err != nil || found != nil {
+				newDroplet = found
+				return resp, err
+			}
+		}
+		attempted = true
+		var resp *godo.Response
+		var err error
+		newDroplet, resp, err = client.Droplets.Create(ctx, createRequest)
+		return resp, err
+	})
 
 	if errhost != nil {
-		fmt.Println("Cannot create host", errhost)
+		logger.Debugf("Cannot create host %v\n", errhost)
 		return drop, errhost
 	}
 
@@ -138,110 +519,1125 @@ func (c Client) CreateNode(token string, config NodeConfig, keyconfig KeyConfig)
 	return drop, nil
 }
 
-func (c Client) CreateKey(token string, config KeyConfig) (KeyConfig, error) {
+// findCreatedDroplet returns the droplet with the name and all the tags of the config, or nil
+func findCreatedDroplet(ctx context.Context, client *godo.Client, config NodeConfig) (*godo.Droplet, *godo.Response, error) {
+	droplets, resp, err := client.Droplets.ListByName(ctx, config.Name, &godo.ListOptions{PerPage: 200})
+	if err != nil {
+		return nil, resp, err
+	}
+	for i, d := range droplets {
+		tags := map[string]bool{}
+		for _, t := range d.Tags {
+			tags[t] = true
+		}
+		found := true
+		for _, t := range config.Tags {
+			found = found && tags[t]
+		}
+		if found {
+			return &droplets[i], resp, nil
+		}
+	}
+	return nil, resp, nil
+}
+
+func (c Client) CreateVolume(token string, config VolumeConfig) (VolumeConfig, error) {
 	client, err := c.getAPIClient(token)
 	if err != nil {
-		fmt.Println("Cannot get api object", err)
+		logger.Debugf("Cannot get api object %v\n", err)
 		return config, err
 	}
 
-	key, keyerr := ioutil.ReadFile(config.PublicKeyFile)
-	if keyerr != nil {
-		fmt.Println("Cannot read public key file", keyerr)
-		return config, keyerr
+	ctx := context.TODO()
+
+	volumeRequest := &godo.VolumeCreateRequest{
+		Region:        config.Region,
+		Name:          config.Name,
+		SizeGigaBytes: config.SizeGB,
+		Tags:          config.Tags,
+	}
+
+	var volume *godo.Volume
+	errvol := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		volume, resp, err = client.Storage.CreateVolume(ctx, volumeRequest)
+		return resp, err
+	})
+	if errvol != nil {
+		logger.Debugf("Cannot create volume %v\n", errvol)
+		return config, errvol
+	}
+
+	config.ID = volume.ID
+	return config, nil
+}
+
+func (c Client) AttachVolume(token string, volumeID string, dropletID int) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
 	}
 
 	ctx := context.TODO()
 
-	keyRequest := &godo.KeyCreateRequest{
-		Name:      config.Name,
-		PublicKey: string(key),
+	return retryWithBackoff(func() (*godo.Response, error) {
+		_, resp, err := client.StorageActions.Attach(ctx, volumeID, dropletID)
+		return resp, err
+	})
+}
+
+type AttachedVolume struct {
+	VolumeConfig
+	DropletIDs []int
+}
+
+func (c Client) ListVolumesByTag(token string, tag string) ([]AttachedVolume, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
 	}
 
-	keyObj, _, errreq := client.Keys.Create(ctx, keyRequest)
+	ctx := context.TODO()
 
-	if errreq != nil {
-		fmt.Println("Cannot create public key", errreq)
-		return config, errreq
+	var list []godo.Volume
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Storage.ListVolumes(ctx, &godo.ListVolumeParams{ListOptions: opt})
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
 	}
 
-	config.ID = keyObj.ID
-	config.Fingerprint = keyObj.Fingerprint
-	return config, nil
+	volumes := []AttachedVolume{}
+	for _, v := range list {
+		for _, t := range v.Tags {
+			if t == tag {
+				vol := AttachedVolume{DropletIDs: v.DropletIDs}
+				vol.ID = v.ID
+				vol.Name = v.Name
+				vol.SizeGB = v.SizeGigaBytes
+				vol.Tags = v.Tags
+				if v.Region != nil {
+					vol.Region = v.Region.Slug
+				}
+				volumes = append(volumes, vol)
+				break
+			}
+		}
+	}
+	return volumes, nil
 }
 
-func (c Client) FindKeyByName(token string, keyName string) (KeyConfig, error) {
-	config := KeyConfig{}
+func (c Client) GetVolume(token string, volumeID string) (AttachedVolume, error) {
+	vol := AttachedVolume{}
 	client, err := c.getAPIClient(token)
 	if err != nil {
-		fmt.Println("Cannot get api object", err)
-		return config, err
+		logger.Debugf("Cannot get api object %v\n", err)
+		return vol, err
+	}
+
+	ctx := context.TODO()
+
+	var v *godo.Volume
+	errvol := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		v, resp, err = client.Storage.GetVolume(ctx, volumeID)
+		return resp, err
+	})
+	if errvol != nil {
+		return vol, errvol
+	}
+
+	vol.ID = v.ID
+	vol.Name = v.Name
+	vol.SizeGB = v.SizeGigaBytes
+	vol.Tags = v.Tags
+	vol.DropletIDs = v.DropletIDs
+	if v.Region != nil {
+		vol.Region = v.Region.Slug
+	}
+	return vol, nil
+}
+
+func (c Client) DetachVolume(token string, volumeID string, dropletID int) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	return retryWithBackoff(func() (*godo.Response, error) {
+		_, resp, err := client.StorageActions.DetachByDropletID(ctx, volumeID, dropletID)
+		return resp, err
+	})
+}
+
+func (c Client) DeleteVolume(token string, volumeID string) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
 	}
+
 	ctx := context.TODO()
-	opts := &godo.ListOptions{}
-	keys, _, err := client.Keys.List(ctx, opts)
+
+	_, errdel := client.Storage.DeleteVolume(ctx, volumeID)
+	return errdel
+}
+
+// CreateFirewall creates a firewall applied to the droplets with the configured tags. It allows SSH
+// from the given sources, any traffic between the tagged droplets and all outbound traffic.
+func (c Client) CreateFirewall(token string, config FirewallConfig) (FirewallConfig, error) {
+	client, err := c.getAPIClient(token)
 	if err != nil {
-		fmt.Println("Cannot load keys", err)
+		logger.Debugf("Cannot get api object %v\n", err)
 		return config, err
 	}
-	for i := 0; i < len(keys); i++ {
 
-		if keys[i].Name == keyName {
-			config.ID = keys[i].ID
-			config.Fingerprint = keys[i].Fingerprint
-			break
-		}
+	ctx := context.TODO()
+
+	everywhere := &godo.Destinations{Addresses: []string{"0.0.0.0/0", "::/0"}}
+	cluster := &godo.Sources{Tags: config.Tags}
+	firewallRequest := &godo.FirewallRequest{
+		Name: config.Name,
+		Tags: config.Tags,
+		InboundRules: []godo.InboundRule{
+			{Protocol: "tcp", PortRange: strconv.Itoa(config.SSHPort), Sources: &godo.Sources{Addresses: config.SSHSources}},
+			{Protocol: "tcp", PortRange: "all", Sources: cluster},
+			{Protocol: "udp", PortRange: "all", Sources: cluster},
+			{Protocol: "icmp", Sources: cluster},
+		},
+		OutboundRules: []godo.OutboundRule{
+			{Protocol: "tcp", PortRange: "all", Destinations: everywhere},
+			{Protocol: "udp", PortRange: "all", Destinations: everywhere},
+			{Protocol: "icmp", Destinations: everywhere},
+		},
+	}
+
+	if len(config.MetricsSources) > 0 {
+		firewallRequest.InboundRules = append(firewallRequest.InboundRules, godo.InboundRule{
+			Protocol:  "tcp",
+			PortRange: strconv.Itoa(NODE_EXPORTER_PORT),
+			Sources:   &godo.Sources{Addresses: config.MetricsSources},
+		})
+	}
+
+	var firewall *godo.Firewall
+	errfw := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		firewall, resp, err = client.Firewalls.Create(ctx, firewallRequest)
+		return resp, err
+	})
+	if errfw != nil {
+		logger.Debugf("Cannot create firewall %v\n", errfw)
+		return config, errfw
 	}
 
+	config.ID = firewall.ID
 	return config, nil
 }
 
-func (c Client) DeleteKeyByName(token string, keyName string) error {
-	config := KeyConfig{}
+func (c Client) ListFirewallsByTag(token string, tag string) ([]FirewallConfig, error) {
 	client, err := c.getAPIClient(token)
 	if err != nil {
-		fmt.Println("Cannot get api object", err)
-		return err
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
 	}
+
 	ctx := context.TODO()
-	opts := &godo.ListOptions{}
-	keys, _, err := client.Keys.List(ctx, opts)
+
+	var list []godo.Firewall
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Firewalls.List(ctx, opt)
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+
+	firewalls := []FirewallConfig{}
+	for _, fw := range list {
+		for _, t := range fw.Tags {
+			if t == tag {
+				firewalls = append(firewalls, firewallConfig(fw))
+				break
+			}
+		}
+	}
+	return firewalls, nil
+}
+
+// FindFirewallByName returns the firewall with the given name. The ID is empty if there is none.
+func (c Client) FindFirewallByName(token string, name string) (FirewallConfig, error) {
+	client, err := c.getAPIClient(token)
 	if err != nil {
-		fmt.Println("Cannot load keys", err)
-		return err
+		logger.Debugf("Cannot get api object %v\n", err)
+		return FirewallConfig{}, err
 	}
-	for i := 0; i < len(keys); i++ {
 
-		if keys[i].Name == keyName {
-			fmt.Println("Key found")
-			config.ID = keys[i].ID
-			config.Fingerprint = keys[i].Fingerprint
-			break
+	ctx := context.TODO()
+
+	var list []godo.Firewall
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Firewalls.List(ctx, opt)
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return FirewallConfig{}, errlist
+	}
+	for _, fw := range list {
+		if fw.Name == name {
+			return firewallConfig(fw), nil
 		}
 	}
+	return FirewallConfig{}, nil
+}
 
-	fmt.Println("Deleting ssh key ", keyName)
-	if config.Fingerprint != "" {
-		_, delerr := client.Keys.DeleteByFingerprint(ctx, config.Fingerprint)
-		if delerr != nil {
-			return delerr
+// firewallConfig describes the firewall, with the load balancers its inbound rules allow
+func firewallConfig(fw godo.Firewall) FirewallConfig {
+	config := FirewallConfig{ID: fw.ID, Name: fw.Name, Tags: fw.Tags}
+	for _, rule := range fw.InboundRules {
+		if rule.Sources != nil {
+			config.LoadBalancerSources = append(config.LoadBalancerSources, rule.Sources.LoadBalancerUIDs...)
+			config.TagSources = append(config.TagSources, rule.Sources.Tags...)
 		}
 	}
+	return config
+}
+
+// AllowLoadBalancer adds an inbound rule allowing the load balancer to reach the port
+func (c Client) AllowLoadBalancer(token string, firewallID string, lbID string, port int) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	rules := &godo.FirewallRulesRequest{
+		InboundRules: []godo.InboundRule{
+			{Protocol: "tcp", PortRange: strconv.Itoa(port), Sources: &godo.Sources{LoadBalancerUIDs: []string{lbID}}},
+		},
+	}
+	return retryWithBackoff(func() (*godo.Response, error) {
+		return client.Firewalls.AddRules(ctx, firewallID, rules)
+	})
+}
+
+// AddFirewallTags applies the firewall to the droplets with the tags
+func (c Client) AddFirewallTags(token string, firewallID string, tags []string) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	return retryWithBackoff(func() (*godo.Response, error) {
+		return client.Firewalls.AddTags(ctx, firewallID, tags...)
+	})
+}
+
+// RemoveFirewallTags stops applying the firewall to the droplets with the tags
+func (c Client) RemoveFirewallTags(token string, firewallID string, tags []string) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	return retryWithBackoff(func() (*godo.Response, error) {
+		return client.Firewalls.RemoveTags(ctx, firewallID, tags...)
+	})
+}
+
+func (c Client) DeleteFirewall(token string, firewallID string) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	return retryWithBackoff(func() (*godo.Response, error) {
+		return client.Firewalls.Delete(ctx, firewallID)
+	})
+}
+
+// DeleteTag removes the tag from the account. A tag that does not exist is not an error.
+func (c Client) DeleteTag(token string, tag string) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	var resp *godo.Response
+	err = retryWithBackoff(func() (*godo.Response, error) {
+		resp, err = client.Tags.Delete(ctx, tag)
+		return resp, err
+	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// TagDroplets adds the tag to the droplets. The tag is created if it does not exist.
+func (c Client) TagDroplets(token string, tag string, dropletIDs []int) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	err = retryWithBackoff(func() (*godo.Response, error) {
+		_, resp, err := client.Tags.Create(ctx, &godo.TagCreateRequest{Name: tag})
+		return resp, err
+	})
+	if err != nil {
+		return err
+	}
+	resources := []godo.Resource{}
+	for _, id := range dropletIDs {
+		resources = append(resources, godo.Resource{ID: strconv.Itoa(id), Type: godo.DropletResourceType})
+	}
+	return retryWithBackoff(func() (*godo.Response, error) {
+		return client.Tags.TagResources(ctx, tag, &godo.TagResourcesRequest{Resources: resources})
+	})
+}
+
+// CreateLoadBalancer creates a TCP load balancer that forwards the configured port to the droplets
+func (c Client) CreateLoadBalancer(token string, config LoadBalancerConfig) (LoadBalancerConfig, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return config, err
+	}
+
+	ctx := context.TODO()
+
+	lbRequest := &godo.LoadBalancerRequest{
+		Name:   config.Name,
+		Region: config.Region,
+		ForwardingRules: []godo.ForwardingRule{
+			{
+				EntryProtocol:  "tcp",
+				EntryPort:      config.Port,
+				TargetProtocol: "tcp",
+				TargetPort:     config.Port,
+			},
+		},
+		HealthCheck: &godo.HealthCheck{
+			Protocol: "tcp",
+			Port:     config.Port,
+		},
+		DropletIDs: config.DropletIDs,
+		VPCUUID:    config.VPCUUID,
+	}
+
+	var lb *godo.LoadBalancer
+	errlb := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		lb, resp, err = client.LoadBalancers.Create(ctx, lbRequest)
+		return resp, err
+	})
+	if errlb != nil {
+		logger.Debugf("Cannot create load balancer %v\n", errlb)
+		return config, errlb
+	}
+
+	config.ID = lb.ID
+	config.IP = lb.IP
+	config.Status = lb.Status
+	return config, nil
+}
+
+func (c Client) GetLoadBalancer(token string, lbID string) (LoadBalancerConfig, error) {
+	config := LoadBalancerConfig{}
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return config, err
+	}
+
+	ctx := context.TODO()
+
+	var lb *godo.LoadBalancer
+	errlb := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		lb, resp, err = client.LoadBalancers.Get(ctx, lbID)
+		return resp, err
+	})
+	if errlb != nil {
+		return config, errlb
+	}
+
+	return toLoadBalancerConfig(lb), nil
+}
+
+func (c Client) FindLoadBalancersByName(token string, name string) ([]LoadBalancerConfig, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
+	}
+
+	ctx := context.TODO()
+
+	var list []godo.LoadBalancer
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.LoadBalancers.List(ctx, opt)
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+
+	lbs := []LoadBalancerConfig{}
+	for i := range list {
+		if list[i].Name == name {
+			lbs = append(lbs, toLoadBalancerConfig(&list[i]))
+		}
+	}
+	return lbs, nil
+}
+
+// AddLoadBalancerDroplets adds the droplets to the targets of the load balancer
+func (c Client) AddLoadBalancerDroplets(token string, lbID string, dropletIDs []int) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	return retryWithBackoff(func() (*godo.Response, error) {
+		return client.LoadBalancers.AddDroplets(ctx, lbID, dropletIDs...)
+	})
+}
+
+func toLoadBalancerConfig(lb *godo.LoadBalancer) LoadBalancerConfig {
+	config := LoadBalancerConfig{
+		ID:         lb.ID,
+		Name:       lb.Name,
+		DropletIDs: lb.DropletIDs,
+		IP:         lb.IP,
+		Status:     lb.Status,
+		VPCUUID:    lb.VPCUUID,
+	}
+	if lb.Region != nil {
+		config.Region = lb.Region.Slug
+	}
+	return config
+}
+
+func (c Client) DeleteLoadBalancer(token string, lbID string) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	return retryWithBackoff(func() (*godo.Response, error) {
+		return client.LoadBalancers.Delete(ctx, lbID)
+	})
+}
+
+// ReserveFloatingIP reserves a new floating IP in the region
+func (c Client) ReserveFloatingIP(token string, region string) (FloatingIPConfig, error) {
+	config := FloatingIPConfig{Region: region}
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return config, err
+	}
+
+	ctx := context.TODO()
+
+	var fip *godo.ReservedIP
+	errfip := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		fip, resp, err = client.ReservedIPs.Create(ctx, &godo.ReservedIPCreateRequest{Region: region})
+		return resp, err
+	})
+	if errfip != nil {
+		logger.Debugf("Cannot reserve floating IP %v\n", errfip)
+		return config, errfip
+	}
+
+	config.IP = fip.IP
+	return config, nil
+}
+
+func (c Client) AssignFloatingIP(token string, ip string, dropletID int) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	return retryWithBackoff(func() (*godo.Response, error) {
+		_, resp, err := client.ReservedIPActions.Assign(ctx, ip, dropletID)
+		return resp, err
+	})
+}
+
+func (c Client) UnassignFloatingIP(token string, ip string) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	return retryWithBackoff(func() (*godo.Response, error) {
+		_, resp, err := client.ReservedIPActions.Unassign(ctx, ip)
+		return resp, err
+	})
+}
+
+func (c Client) ReleaseFloatingIP(token string, ip string) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	_, errdel := client.ReservedIPs.Delete(ctx, ip)
+	return errdel
+}
+
+// ListFloatingIPsByTag lists the floating IPs assigned to droplets carrying the tag
+func (c Client) ListFloatingIPsByTag(token string, tag string) ([]FloatingIPConfig, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
+	}
+
+	ctx := context.TODO()
+
+	var list []godo.ReservedIP
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.ReservedIPs.List(ctx, opt)
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+
+	fips := []FloatingIPConfig{}
+	for _, fip := range list {
+		if fip.Droplet == nil {
+			continue
+		}
+		for _, t := range fip.Droplet.Tags {
+			if t == tag {
+				config := FloatingIPConfig{IP: fip.IP, DropletID: fip.Droplet.ID}
+				if fip.Region != nil {
+					config.Region = fip.Region.Slug
+				}
+				fips = append(fips, config)
+				break
+			}
+		}
+	}
+	return fips, nil
+}
+
+// DomainExists reports whether the domain is managed in the Digital Ocean account
+func (c Client) DomainExists(token string, domain string) (bool, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return false, err
+	}
+
+	ctx := context.TODO()
+
+	var resp *godo.Response
+	err = retryWithBackoff(func() (*godo.Response, error) {
+		_, resp, err = client.Domains.Get(ctx, domain)
+		return resp, err
+	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ListDNSRecords lists the A records of the domain with the given name, relative to the domain
+func (c Client) ListDNSRecords(token string, domain string, name string) ([]DNSRecordConfig, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
+	}
+
+	ctx := context.TODO()
+
+	// The API filters on the fully qualified name
+	var list []godo.DomainRecord
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Domains.RecordsByTypeAndName(ctx, domain, "A", name+"."+domain, opt)
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+
+	records := []DNSRecordConfig{}
+	for _, r := range list {
+		records = append(records, DNSRecordConfig{ID: r.ID, Domain: domain, Name: r.Name, Type: r.Type, Data: r.Data, TTL: r.TTL})
+	}
+	return records, nil
+}
+
+// CreateDNSRecord creates a record in the domain of the config
+func (c Client) CreateDNSRecord(token string, config DNSRecordConfig) (DNSRecordConfig, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return config, err
+	}
+
+	ctx := context.TODO()
+
+	req := &godo.DomainRecordEditRequest{
+		Type: config.Type,
+		Name: config.Name,
+		Data: config.Data,
+		TTL:  config.TTL,
+	}
+	var record *godo.DomainRecord
+	errrec := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		record, resp, err = client.Domains.CreateRecord(ctx, config.Domain, req)
+		return resp, err
+	})
+	if errrec != nil {
+		logger.Debugf("Cannot create DNS record %v\n", errrec)
+		return config, errrec
+	}
+
+	config.ID = record.ID
+	return config, nil
+}
+
+func (c Client) DeleteDNSRecord(token string, domain string, recordID int) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+
+	ctx := context.TODO()
+
+	var resp *godo.Response
+	err = retryWithBackoff(func() (*godo.Response, error) {
+		resp, err = client.Domains.DeleteRecord(ctx, domain, recordID)
+		return resp, err
+	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// createImage references the image by ID if the image is numeric, and by slug otherwise
+func createImage(image string) godo.DropletCreateImage {
+	if id, err := strconv.Atoi(image); err == nil {
+		return godo.DropletCreateImage{ID: id}
+	}
+	return godo.DropletCreateImage{Slug: image}
+}
+
+// FindImage looks up an image by numeric ID or by slug. An image that does not exist
+// is returned empty.
+func (c Client) FindImage(token string, image string) (ImageConfig, error) {
+	config := ImageConfig{}
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return config, err
+	}
+
+	ctx := context.TODO()
+
+	var img *godo.Image
+	var resp *godo.Response
+	if id, converr := strconv.Atoi(image); converr == nil {
+		img, resp, err = client.Images.GetByID(ctx, id)
+	} else {
+		img, resp, err = client.Images.GetBySlug(ctx, image)
+	}
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	return toImageConfig(img), nil
+}
+
+// ListImages returns the distribution images and the snapshots and custom images of the account
+func (c Client) ListImages(token string) ([]ImageConfig, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
+	}
+
+	ctx := context.TODO()
+
+	var distributions, user []godo.Image
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Images.ListDistribution(ctx, opt)
+		distributions = append(distributions, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+	errlist = listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Images.ListUser(ctx, opt)
+		user = append(user, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+
+	images := []ImageConfig{}
+	for i := range distributions {
+		images = append(images, toImageConfig(&distributions[i]))
+	}
+	for i := range user {
+		images = append(images, toImageConfig(&user[i]))
+	}
+	return images, nil
+}
+
+func toImageConfig(img *godo.Image) ImageConfig {
+	return ImageConfig{
+		ID:          img.ID,
+		Slug:        img.Slug,
+		Name:        img.Name,
+		Type:        img.Type,
+		Regions:     img.Regions,
+		MinDiskSize: img.MinDiskSize,
+	}
+}
+
+func (c Client) ListSizes(token string) ([]SizeConfig, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
+	}
+
+	ctx := context.TODO()
+
+	var list []godo.Size
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Sizes.List(ctx, opt)
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+
+	sizes := []SizeConfig{}
+	for _, sz := range list {
+		sizes = append(sizes, SizeConfig{
+			Slug:         sz.Slug,
+			VCPUs:        sz.Vcpus,
+			MemoryMB:     sz.Memory,
+			DiskGB:       sz.Disk,
+			PriceHourly:  sz.PriceHourly,
+			PriceMonthly: sz.PriceMonthly,
+			Regions:      sz.Regions,
+			Available:    sz.Available,
+		})
+	}
+	return sizes, nil
+}
+
+// GetAccountLimits returns the droplet limit of the account and its current droplet count
+func (c Client) GetAccountLimits(token string) (AccountLimits, error) {
+	limits := AccountLimits{}
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return limits, err
+	}
+
+	ctx := context.TODO()
+
+	var account *godo.Account
+	erracc := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		account, resp, err = client.Account.Get(ctx)
+		return resp, err
+	})
+	if erracc != nil {
+		return limits, erracc
+	}
+	limits.DropletLimit = account.DropletLimit
+
+	// Only the total of the listing is needed, so a single droplet is requested
+	errlist := retryWithBackoff(func() (*godo.Response, error) {
+		list, resp, err := client.Droplets.List(ctx, &godo.ListOptions{PerPage: 1})
+		if err == nil {
+			limits.DropletCount = len(list)
+			if resp.Meta != nil {
+				limits.DropletCount = resp.Meta.Total
+			}
+		}
+		return resp, err
+	})
+	if errlist != nil {
+		return limits, errlist
+	}
+	return limits, nil
+}
+
+// ListRegions returns the Digital Ocean regions. The list is loaded once and cached for
+// the lifetime of the client.
+func (c *Client) ListRegions(token string) ([]RegionConfig, error) {
+	if c.regions != nil {
+		return c.regions, nil
+	}
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return nil, err
+	}
+
+	ctx := context.TODO()
+
+	var list []godo.Region
+	errlist := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Regions.List(ctx, opt)
+		list = append(list, page...)
+		return resp, err
+	})
+	if errlist != nil {
+		return nil, errlist
+	}
+
+	regions := []RegionConfig{}
+	for _, r := range list {
+		regions = append(regions, RegionConfig{
+			Slug:      r.Slug,
+			Name:      r.Name,
+			Available: r.Available,
+			Features:  r.Features,
+		})
+	}
+	c.regions = regions
+	return regions, nil
+}
+
+func (c Client) CreateKey(token string, config KeyConfig) (KeyConfig, error) {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return config, err
+	}
+
+	key, keyerr := authorizedKey(config.PublicKeyFile)
+	if keyerr != nil {
+		logger.Debugf("Cannot read public key file %v\n", keyerr)
+		return config, keyerr
+	}
+
+	ctx := context.TODO()
+
+	keyRequest := &godo.KeyCreateRequest{
+		Name:      config.Name,
+		PublicKey: key,
+	}
+
+	var keyObj *godo.Key
+	errreq := retryWithBackoff(func() (*godo.Response, error) {
+		var resp *godo.Response
+		var err error
+		keyObj, resp, err = client.Keys.Create(ctx, keyRequest)
+		return resp, err
+	})
+
+	if errreq != nil {
+		logger.Debugf("Cannot create public key %v\n", errreq)
+		return config, errreq
+	}
+
+	config.ID = keyObj.ID
+	config.Fingerprint = keyObj.Fingerprint
+	return config, nil
+}
+
+func (c Client) FindKeyByFingerprint(token string, fingerprint string) (KeyConfig, error) {
+	config := KeyConfig{}
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return config, err
+	}
+	ctx := context.TODO()
+	key, resp, err := client.Keys.GetByFingerprint(ctx, fingerprint)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return config, nil
+	}
+	if err != nil {
+		logger.Debugf("Cannot load key %v\n", err)
+		return config, err
+	}
+	config.ID = key.ID
+	config.Name = key.Name
+	config.Fingerprint = key.Fingerprint
+	return config, nil
+}
+
+// listKeys returns all the SSH keys of the account
+func listKeys(ctx context.Context, client *godo.Client) ([]godo.Key, error) {
+	var keys []godo.Key
+	err := listAll(func(opt *godo.ListOptions) (*godo.Response, error) {
+		page, resp, err := client.Keys.List(ctx, opt)
+		keys = append(keys, page...)
+		return resp, err
+	})
+	return keys, err
+}
+
+func (c Client) FindKeyByName(token string, keyName string) (KeyConfig, error) {
+	config := KeyConfig{}
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return config, err
+	}
+	ctx := context.TODO()
+	keys, err := listKeys(ctx, client)
+	if err != nil {
+		logger.Debugf("Cannot load keys %v\n", err)
+		return config, err
+	}
+	for i := 0; i < len(keys); i++ {
+
+		if keys[i].Name == keyName {
+			config.ID = keys[i].ID
+			config.Name = keys[i].Name
+			config.Fingerprint = keys[i].Fingerprint
+			break
+		}
+	}
+
+	return config, nil
+}
+
+// DeleteKeyByName deletes the key with the given name and reports whether a key was found
+func (c Client) DeleteKeyByName(token string, keyName string) (bool, error) {
+	config := KeyConfig{}
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return false, err
+	}
+	ctx := context.TODO()
+	keys, err := listKeys(ctx, client)
+	if err != nil {
+		logger.Debugf("Cannot load keys %v\n", err)
+		return false, err
+	}
+	for i := 0; i < len(keys); i++ {
+
+		if keys[i].Name == keyName {
+			logger.Debugf("Key found\n")
+			config.ID = keys[i].ID
+			config.Fingerprint = keys[i].Fingerprint
+			break
+		}
+	}
+
+	logger.Infof("Deleting ssh key %v\n", keyName)
+	if config.Fingerprint != "" {
+		_, delerr := client.Keys.DeleteByFingerprint(ctx, config.Fingerprint)
+		if delerr != nil {
+			return false, delerr
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (c Client) DeleteDroplet(token string, dropletID int) error {
+	client, err := c.getAPIClient(token)
+	if err != nil {
+		logger.Debugf("Cannot get api object %v\n", err)
+		return err
+	}
+	ctx := context.TODO()
 
-	return nil
+	return retryWithBackoff(func() (*godo.Response, error) {
+		return client.Droplets.Delete(ctx, dropletID)
+	})
 }
 
 func (c Client) DeleteDropletsByTag(token string, tag string, keyname string) error {
 
 	client, err := c.getAPIClient(token)
 	if err != nil {
-		fmt.Println("Cannot get api object", err)
+		logger.Debugf("Cannot get api object %v\n", err)
 		return err
 	}
 	ctx := context.TODO()
 
-	fmt.Println("Deleting droplets with tag ", tag)
-	_, errdel := client.Droplets.DeleteByTag(ctx, tag)
+	logger.Infof("Deleting droplets with tag %v\n", tag)
+	errdel := retryWithBackoff(func() (*godo.Response, error) {
+		return client.Droplets.DeleteByTag(ctx, tag)
+	})
 
 	if keyname != "" {
 		c.DeleteKeyByName(token, keyname)
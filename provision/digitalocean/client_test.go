@@ -0,0 +1,93 @@
+package digitalocean
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+// testAPIClient returns a Client whose requests are served by the handler
+func testAPIClient(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	doClient, err := godo.New(server.Client(), godo.SetBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &Client{doClient: doClient}
+}
+
+func TestCreateNodeRetryFindsCreatedDroplet(t *testing.T) {
+	creates := 0
+	client := testAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost:
+			// The droplet is created, but the response is lost
+			creates++
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"id": "bad_gateway", "message": "bad gateway"}`))
+		case r.URL.Query().Get("name") == "test-worker-1":
+			w.Write([]byte(`{"droplets": [{"id": 7, "name": "test-worker-1", "tags": ["other"]}, {"id": 42, "name": "test-worker-1", "tags": ["test", "test-worker"]}]}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	})
+	drop, err := client.CreateNode("token", NodeConfig{Name: "test-worker-1", Tags: []string{"test", "test-worker"}}, KeyConfig{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if creates != 1 {
+		t.Errorf("expected the droplet to be created once, got %d requests", creates)
+	}
+	if drop.ID != 42 {
+		t.Errorf("expected the droplet created by the failed request, got %d", drop.ID)
+	}
+}
+
+func TestListDropletsByTagAllPages(t *testing.T) {
+	client := testAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		next := "http://" + r.Host + r.URL.Path + "?page=2&per_page=200&tag_name=test"
+		switch r.URL.Query().Get("page") {
+		case "1":
+			w.Write([]byte(`{"droplets": [{"id": 1, "name": "test-etcd-1"}], "links": {"pages": {"next": "` + next + `", "last": "` + next + `"}}}`))
+		case "2":
+			w.Write([]byte(`{"droplets": [{"id": 2, "name": "test-master-1"}], "links": {"pages": {"prev": "http://` + r.Host + r.URL.Path + `?page=1"}}}`))
+		default:
+			t.Errorf("unexpected page %q", r.URL.Query().Get("page"))
+		}
+	})
+	droplets, err := client.ListDropletsByTag("token", "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(droplets) != 2 || droplets[0].ID != 1 || droplets[1].ID != 2 {
+		t.Errorf("expected the droplets of both pages, got %+v", droplets)
+	}
+}
+
+func TestCreateFirewallSSHPort(t *testing.T) {
+	var request godo.FirewallRequest
+	client := testAPIClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"firewall": {"id": "fw-1"}}`))
+	})
+	fw, err := client.CreateFirewall("token", FirewallConfig{Name: "test-firewall", Tags: []string{"test"}, SSHSources: []string{"203.0.113.1"}, SSHPort: 2222})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fw.ID != "fw-1" {
+		t.Errorf("expected the ID of the created firewall, got %q", fw.ID)
+	}
+	rule := request.InboundRules[0]
+	if rule.PortRange != "2222" || rule.Sources == nil || len(rule.Sources.Addresses) != 1 || rule.Sources.Addresses[0] != "203.0.113.1" {
+		t.Errorf("expected SSH on port 2222 from 203.0.113.1, got %+v", rule)
+	}
+}
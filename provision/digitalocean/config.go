@@ -0,0 +1,139 @@
+package digitalocean
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const CONFIG_FILE = ".kismatic-provision/do.yaml"
+
+// ENV_PREFIX is the prefix of the environment variables bound to the flags
+const ENV_PREFIX = "KP_"
+
+// DOConfig holds the defaults that can be stored in the provisioner config file
+type DOConfig struct {
+	Token         string `yaml:"token"`
+	Region        string `yaml:"region"`
+	Image         string `yaml:"image"`
+	InstanceType  string `yaml:"instance_type"`
+	WorkerType    string `yaml:"worker_type"`
+	EtcdType      string `yaml:"etcd_type"`
+	MasterType    string `yaml:"master_type"`
+	BootstrapType string `yaml:"bootstrap_type"`
+	ClusterTag    string `yaml:"tag"`
+}
+
+// loadConfig reads the config file at the given path. If no path is given,
+// the default location in the user's home directory is used, and a missing
+// file is not an error.
+func loadConfig(path string) (*DOConfig, error) {
+	explicit := path != ""
+	if !explicit {
+		home, err := homedir.Dir()
+		if err != nil {
+			return nil, fmt.Errorf("Cannot determine home directory: %v", err)
+		}
+		path = filepath.Join(home, CONFIG_FILE)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read config file %q: %v", path, err)
+	}
+
+	config := &DOConfig{}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Cannot parse config file %q: %v", path, err)
+	}
+	return config, nil
+}
+
+// mergeConfig populates the options from the config file. Values of flags that
+// were explicitly set on the command line are left untouched.
+func mergeConfig(opts *DOOpts, config *DOConfig, flags *pflag.FlagSet) {
+	if config == nil {
+		return
+	}
+	opts.Token = config.Token
+	setFromConfig(&opts.Region, config.Region, "region", flags)
+	setFromConfig(&opts.Image, config.Image, "image", flags)
+	setFromConfig(&opts.InstanceType, config.InstanceType, "instance-type", flags)
+	setFromConfig(&opts.WorkerType, config.WorkerType, "worker-type", flags)
+	setFromConfig(&opts.EtcdType, config.EtcdType, "etcd-type", flags)
+	setFromConfig(&opts.MasterType, config.MasterType, "master-type", flags)
+	setFromConfig(&opts.BootstrapType, config.BootstrapType, "bootstrap-type", flags)
+	setFromConfig(&opts.ClusterTag, config.ClusterTag, "tag", flags)
+}
+
+func setFromConfig(field *string, value string, flag string, flags *pflag.FlagSet) {
+	if value == "" || flagChanged(flags, flag) {
+		return
+	}
+	*field = value
+}
+
+// flagChanged returns whether the flag was explicitly set
+func flagChanged(flags *pflag.FlagSet, name string) bool {
+	f := flags.Lookup(name)
+	return f != nil && f.Changed
+}
+
+// flagEnvNames names the environment variables of the node count flags, whose names predate
+// the naming convention of the other flags
+var flagEnvNames = map[string]string{
+	"etcdNodeCount":    "KP_ETCD_COUNT",
+	"masterdNodeCount": "KP_MASTER_COUNT",
+	"workerNodeCount":  "KP_WORKER_COUNT",
+}
+
+// flagEnvName returns the environment variable of the flag, e.g. KP_INSTANCE_TYPE for --instance-type
+func flagEnvName(flag string) string {
+	if name, ok := flagEnvNames[flag]; ok {
+		return name
+	}
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// applyEnvironment sets the flags that were not given on the command line from their
+// environment variable. The flags set this way count as explicitly set, so that the
+// config file does not override them.
+func applyEnvironment(flags *pflag.FlagSet) error {
+	msg := ""
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed || f.Name == "help" {
+			return
+		}
+		name := flagEnvName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, value); err != nil {
+			msg = msg + fmt.Sprintf(" - %s=%q: %v\n", name, value, err)
+		}
+	})
+	if msg != "" {
+		return fmt.Errorf("Invalid environment variables:\n%s", msg)
+	}
+	return nil
+}
+
+// applyConfigFile loads the config file referenced by the options and merges it
+func applyConfigFile(opts *DOOpts, flags *pflag.FlagSet) error {
+	config, err := loadConfig(opts.ConfigFile)
+	if err != nil {
+		return err
+	}
+	mergeConfig(opts, config, flags)
+	return nil
+}
@@ -0,0 +1,64 @@
+package digitalocean
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func DODeleteNodeCmd() *cobra.Command {
+	opts := DOOpts{}
+	var id int
+	var name string
+	var withVolume, force bool
+	cmd := &cobra.Command{
+		Use:   "delete-node",
+		Short: "Deletes a single node from the Digital Ocean account",
+		Long: `Deletes a single droplet, selected by ID or by name among the droplets with the given tag.
+Etcd and master nodes are only deleted with --force, since removing them can break the quorum of the cluster.`,
+		Example: `# Delete the node named worker3 of the cluster tagged apprenda, together with its volume
+provision do delete-node --name worker3 --tag apprenda --with-volume`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			return deleteNode(opts, id, name, withVolume, force)
+		},
+	}
+
+	cmd.Flags().IntVarP(&id, "id", "", 0, "ID of the droplet to delete")
+	cmd.Flags().StringVarP(&name, "name", "", "", "Name of the droplet to delete, e.g. worker3")
+	cmd.Flags().StringVarP(&opts.ClusterTag, "tag", "", "apprenda", "TAG of the cluster the node is looked up in when using --name")
+	cmd.Flags().BoolVarP(&withVolume, "with-volume", "", false, "If present, also deletes the volumes attached to the droplet")
+	cmd.Flags().BoolVarP(&force, "force", "", false, "If present, allows deleting etcd and master nodes")
+	cmd.Flags().StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+
+	return cmd
+}
+
+func deleteNode(opts DOOpts, id int, name string, withVolume, force bool) error {
+	if (id == 0) == (name == "") {
+		return fmt.Errorf("Exactly one of --id or --name must be provided")
+	}
+	if err := resolveToken(&opts); err != nil {
+		return err
+	}
+
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	drop, err := provisioner.FindDroplet(opts, id, name)
+	if err != nil {
+		return err
+	}
+	role := dropletRole(drop, opts.ClusterTag)
+	if (role == "etcd" || role == "master") && !force {
+		return fmt.Errorf("Droplet %d (%s) is a %s node. Deleting it can break the cluster, use --force to delete it anyway", drop.ID, drop.Name, role)
+	}
+	if err = provisioner.TerminateNode(opts, drop, withVolume); err != nil {
+		return err
+	}
+	logger.Infof("Removed droplet %d (%s)\n", drop.ID, drop.Name)
+	return nil
+}
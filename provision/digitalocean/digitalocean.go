@@ -2,51 +2,185 @@ package digitalocean
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
-	"math/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"time"
 
 	"strings"
+	"text/tabwriter"
 
 	"github.com/apprenda/kismatic-provision/provision/plan"
-	garbler "github.com/michaelbironneau/garbler/lib"
+	"github.com/apprenda/kismatic-provision/provision/utils"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type DOOpts struct {
-	Token           string
-	ClusterTag      string
-	EtcdNodeCount   uint16
-	MasterNodeCount uint16
-	WorkerNodeCount uint16
-	NoPlan          bool
-	InstanceType    string
-	WorkerType      string
-	Image           string
-	Region          string
-	Storage         bool
-	SSHUser         string
-	SSHKeyName      string
-	SSHPrivateKey   string
-	SSHPublicKey    string
-	BootstrapNode   bool
-	RemoveKey       bool
-	BootstrapFile   string
+	Token               string
+	ClusterTag          string
+	EtcdNodeCount       uint16
+	MasterNodeCount     uint16
+	WorkerNodeCount     uint16
+	IngressNodeCount    uint16
+	Preset              string
+	NoPlan              bool
+	Strict              bool
+	InstanceType        string
+	WorkerType          string
+	EtcdType            string
+	MasterType          string
+	BootstrapType       string
+	DropletClass        string
+	VCPUs               int
+	MemoryGB            int
+	Image               string
+	Region              string
+	Storage             bool
+	NetworkMode         string
+	PodCIDR             string
+	ServiceCIDR         string
+	PlanTemplate        string
+	WorkerLabels        []string
+	IngressLabels       []string
+	WorkerTaints        []string
+	IngressTaints       []string
+	SSHUser             string
+	SSHKeyName          string
+	SSHPrivateKey       string
+	SSHPublicKey        string
+	BootstrapNode       bool
+	ExistingBootstrap   string
+	JumpHost            string
+	RemoveKey           bool
+	BootstrapFile       string
+	DryRun              bool
+	ConfigFile          string
+	OutputFormat        string
+	PrintResourceIDs    bool
+	GenerateKey         bool
+	VPCUUID             string
+	NoPrivateNetworking bool
+	VolumeSizeGB        int
+	EtcdSeparateDisk    bool
+	EtcdVolumeSizeGB    int
+	EtcdDataDir         string
+	LockSSH             bool
+	FirewallName        string
+	NodeExporter        bool
+	NodeExporterSources []string
+	CreateLB            bool
+	FloatingIP          bool
+	DNSDomain           string
+	DNSRecord           string
+	MaxParallel         int
+	SSHTimeout          time.Duration
+	// OnProgress is called as each node is created and becomes accessible via SSH. The
+	// progress is logged when it is nil.
+	OnProgress       ProgressFunc
+	WaitForBootstrap bool
+	BootstrapTimeout time.Duration
+	VerifyNetwork    bool
+	StateFile        string
+	UserDataFile     string
+	KETVersion       string
+	KubectlVersion   string
+	// InstallKismatic and InstallKubectl select what the bootstrap commands download
+	InstallKismatic bool
+	InstallKubectl  bool
+	// HTTPProxy, HTTPSProxy and NoProxy are the proxy settings of the bootstrap node
+	HTTPProxy          string
+	HTTPSProxy         string
+	NoProxy            []string
+	FailOnCopyError    bool
+	VerifyCopy         bool
+	SSHPort            int
+	AdminPassword      string
+	AdminUsername      string
+	PasswordFile       string
+	PasswordLength     int
+	PasswordMinDigits  int
+	PasswordUppercase  int
+	AssumeYes          bool
+	Role               string
+	OlderThan          time.Duration
+	NamePrefix         string
+	ExtraSSHKeys       []string
+	ExtraTags          []string
+	WaitForActive      bool
+	ActiveTimeout      time.Duration
+	EtcdRegion         string
+	MasterRegion       string
+	SpreadControlPlane bool
+	WorkerRegion       string
+	DOSshKeyName       string
+	PlanFile           string
+	IPv6               bool
+	Monitoring         bool
+	Backups            bool
+	BackupRoles        []string
+	MaxMonthlyCost     float64
+	Timeout            time.Duration
+	InstallDir         string
+	Recreate           bool
+	ReuseTag           bool
+	ImportTag          string
+	// The start indexes are the highest index of the nodes of each role that already
+	// exist in the cluster. New nodes are numbered after them.
+	EtcdStartIndex      uint16
+	MasterStartIndex    uint16
+	BootstrapStartIndex uint16
+	WorkerStartIndex    uint16
+	IngressStartIndex   uint16
 }
 
 func Cmd() *cobra.Command {
+	var logLevel string
+	var quiet bool
 	cmd := &cobra.Command{
 		Use:   "do",
 		Short: "Provision infrastructure on Digital Ocean.",
-		Long:  `Provision infrastructure on Digital Ocean.`,
+		Long: `Provision infrastructure on Digital Ocean.
+
+Every flag of create and apply, and --log-level and --quiet, can also be set with an environment
+variable named after it: KP_ followed by the flag name in upper case, with dashes replaced by underscores. For example --instance-type is
+read from KP_INSTANCE_TYPE. The node counts are read from KP_ETCD_COUNT, KP_MASTER_COUNT and
+KP_WORKER_COUNT. Lists are comma separated.
+A flag given on the command line takes precedence over its environment variable, which takes
+precedence over the config file and the default. The API token is read from DO_API_TOKEN.`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// The other commands do not read the environment, so that it does not confirm
+			// a deletion for example
+			if err := applyEnvironment(cmd.InheritedFlags()); err != nil {
+				return err
+			}
+			return configureLogger(logLevel, quiet)
+		},
 	}
+	cmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "info", "Level of the messages to print: debug, info, warn or error.")
+	cmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "If present, only prints warnings and errors.")
 
 	cmd.AddCommand(DOCreateCmd())
+	cmd.AddCommand(DOApplyCmd())
+	cmd.AddCommand(DOPlanCmd())
 	cmd.AddCommand(DODeleteCmd())
+	cmd.AddCommand(DOSizesCmd())
+	cmd.AddCommand(DORegionsCmd())
+	cmd.AddCommand(DOScaleCmd())
+	cmd.AddCommand(DODeleteNodeCmd())
+	cmd.AddCommand(DOListCmd())
+	cmd.AddCommand(DOSSHCmd())
 
 	return cmd
 }
@@ -57,9 +191,10 @@ func DOCreateCmd() *cobra.Command {
 		Use:   "create",
 		Short: "Creates infrastructure for a new cluster.",
 		Long: `Creates infrastructure for a new cluster. Optionally creates a bootstrap node to run the orchestration of Kubernetes
-cluster from. If the bootstrap node is requested, the provisioner will download kismatic executables and kubectl during the process
-of VM initialization. By default, it will place the downloaded packages in the /ket/ folder. The default location can be overwritten
-by setting an environmental variable 'DO_KET_INSTALL_DIR'. If the bootstrap node is not requested, the Kismatic and Kubectl packages
+cluster from. If the bootstrap node is requested with --bootstrap-commands-file, the provisioner will download kismatic executables
+and kubectl during the process of VM initialization. Use --install-kismatic=false or --install-kubectl=false to skip either download. By default, it will place
+the downloaded packages in the /ket/ folder. The default location can be overwritten with --install-dir
+or by setting an environmental variable 'DO_KET_INSTALL_DIR'. If the bootstrap node is not requested, the Kismatic and Kubectl packages
 will have to be downloaded manually. See digitalocean/scripts/bootinit.sh for details.
 
 In addition to the commands below, the provisioner relies on some environment variables and conventions:
@@ -67,220 +202,1347 @@ Required:
   DO_API_TOKEN: [Required] Your Digital Ocean access token, required for all operations
   DO_SECRET_ACCESS_KEY: [Required] Your Digital Ocean ssh key, required for all operations. If the env varaible does
 not exist, an attempt will be made to use ssh key file in the following relative location: ssh/cluster.pem file. If the file is
-not found, the program will fail.`,
+not found, the program will fail.
+
+Defaults for the API token, region, image, instance types and tag can be stored in a YAML config file. The file is read
+from ~/.kismatic-provision/do.yaml unless a different location is given with --config. Values are resolved with the
+following precedence: explicit flag > environment variable > config file > built-in default.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyEnvironment(cmd.LocalFlags()); err != nil {
+				return err
+			}
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			if err := applyPreset(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			if err := validateBootstrapFlags(opts, cmd.Flags()); err != nil {
+				return err
+			}
 			return makeInfra(opts)
 		},
 	}
 
-	cmd.Flags().Uint16VarP(&opts.EtcdNodeCount, "etcdNodeCount", "e", 1, "Count of etcd nodes to produce.")
-	cmd.Flags().Uint16VarP(&opts.MasterNodeCount, "masterdNodeCount", "m", 1, "Count of master nodes to produce.")
-	cmd.Flags().Uint16VarP(&opts.WorkerNodeCount, "workerNodeCount", "w", 1, "Count of worker nodes to produce.")
-	cmd.Flags().BoolVarP(&opts.NoPlan, "noplan", "n", false, "If present, foregoes generating a plan file in this directory referencing the newly created nodes")
-	cmd.Flags().StringVarP(&opts.InstanceType, "instance-type", "i", "1gb", "Size of the instance. Current options: 1gb, 2gb, 4gb")
-	cmd.Flags().StringVarP(&opts.WorkerType, "worker-type", "", "4gb", "Size of the worker node instance. Current options: 1gb, 2gb, 4gb")
-	cmd.Flags().StringVarP(&opts.Image, "image", "", "ubuntu-16-04-x64", "Name of the image to use")
-	cmd.Flags().StringVarP(&opts.Region, "region", "", "tor1", "Region to deploy to")
-	cmd.Flags().StringVarP(&opts.ClusterTag, "tag", "", "apprenda", "TAG for all nodes in the cluster")
-	cmd.Flags().StringVarP(&opts.SSHUser, "sshuser", "", "root", "SSH User name")
-	cmd.Flags().BoolVarP(&opts.BootstrapNode, "bootstrap", "", true, "Create a bootstrap node from which users can work with the cluster.")
-	cmd.Flags().BoolVarP(&opts.Storage, "storage-cluster", "s", false, "Create a storage cluster from all Worker nodes.")
-	cmd.Flags().StringVarP(&opts.BootstrapFile, "bootstrap-commands-file", "", "", "Relative path to the script file that will be run on the bootstrap node upon initialization. e.g.: digitalocean/scripts/bootinit.sh.")
+	addCreateFlags(cmd.Flags(), &opts)
 
 	return cmd
 }
 
+// addCreateFlags binds the flags of the create command to the options
+func addCreateFlags(flags *pflag.FlagSet, opts *DOOpts) {
+	flags.Uint16VarP(&opts.EtcdNodeCount, "etcdNodeCount", "e", 1, "Count of etcd nodes to produce.")
+	flags.Uint16VarP(&opts.MasterNodeCount, "masterdNodeCount", "m", 1, "Count of master nodes to produce.")
+	flags.Uint16VarP(&opts.WorkerNodeCount, "workerNodeCount", "w", 1, "Count of worker nodes to produce.")
+	flags.Uint16VarP(&opts.IngressNodeCount, "ingress-count", "", 0, "Count of dedicated ingress nodes to produce. When 0, the first worker node is used as the ingress node.")
+	flags.StringVarP(&opts.Preset, "preset", "", "", "Sets the node counts and instance types of a quick test cluster: small (1/1/1 etcd/master/worker on 1gb), medium (3/1/3 on 2gb) or large (3/3/5 on 4gb). Explicit count and type flags take precedence")
+	flags.BoolVarP(&opts.Strict, "strict", "", false, "If present, an even number of etcd or master nodes is an error instead of a warning")
+	flags.BoolVarP(&opts.NoPlan, "noplan", "n", false, "If present, foregoes generating a plan file in this directory referencing the newly created nodes")
+	flags.StringVarP(&opts.InstanceType, "instance-type", "i", "1gb", "Size of the instance. Any Digital Ocean size slug available in the region, e.g. s-2vcpu-4gb. 1gb, 2gb and 4gb are accepted as aliases")
+	flags.StringVarP(&opts.WorkerType, "worker-type", "", "4gb", "Size of the worker node instance. Any Digital Ocean size slug available in the region, e.g. s-2vcpu-4gb. 1gb, 2gb and 4gb are accepted as aliases")
+	flags.StringVarP(&opts.EtcdType, "etcd-type", "", "", "Size of the etcd node instance. Defaults to --instance-type. 1gb, 2gb and 4gb are accepted as aliases")
+	flags.StringVarP(&opts.MasterType, "master-type", "", "", "Size of the master node instance. Defaults to --instance-type. 1gb, 2gb and 4gb are accepted as aliases")
+	flags.StringVarP(&opts.BootstrapType, "bootstrap-type", "", "", "Size of the bootstrap node instance. Defaults to --instance-type. 1gb, 2gb and 4gb are accepted as aliases")
+	flags.StringVarP(&opts.DropletClass, "droplet-class", "", "", "Picks the cheapest size of the class instead of --instance-type: basic, cpu (dedicated CPU) or memory (memory optimized)")
+	flags.IntVarP(&opts.VCPUs, "vcpus", "", 0, "Minimum number of vCPUs of the size picked for --droplet-class")
+	flags.IntVarP(&opts.MemoryGB, "memory-gb", "", 0, "Minimum memory in GB of the size picked for --droplet-class")
+	flags.StringVarP(&opts.Image, "image", "", "ubuntu-16-04-x64", "Slug or numeric ID of the image to use. Snapshots and custom images are referenced by ID")
+	flags.StringVarP(&opts.Region, "region", "", "tor1", "Region to deploy to. A comma separated list spreads the nodes round-robin across the regions, e.g. tor1,nyc3,sfo2")
+	flags.StringVarP(&opts.EtcdRegion, "etcd-region", "", "", "Region, or comma separated list of regions, for the etcd nodes. Defaults to --region")
+	flags.StringVarP(&opts.MasterRegion, "master-region", "", "", "Region, or comma separated list of regions, for the master nodes. Defaults to --region")
+	flags.StringVarP(&opts.WorkerRegion, "worker-region", "", "", "Region, or comma separated list of regions, for the worker nodes. Defaults to --region")
+	flags.BoolVarP(&opts.SpreadControlPlane, "spread-control-plane", "", false, "If present, asks for the etcd and master nodes not to share a hypervisor. This is best effort: Digital Ocean has no anti-affinity for droplets, so the nodes are only spread across the regions given with --etcd-region and --master-region, and a warning is printed for the nodes that may share a hypervisor.")
+	flags.StringVarP(&opts.ClusterTag, "tag", "", "apprenda", "TAG for all nodes in the cluster")
+	flags.StringVarP(&opts.NamePrefix, "name-prefix", "", "", "Prefix of the droplet names, e.g. apprenda-worker-1. Defaults to the cluster tag")
+	flags.StringVarP(&opts.SSHUser, "sshuser", "", "root", "SSH User name. A user other than root is created on the nodes with passwordless sudo and the provisioning key")
+	flags.BoolVarP(&opts.BootstrapNode, "bootstrap", "", true, "Create a bootstrap node from which users can work with the cluster.")
+	flags.StringVarP(&opts.ExistingBootstrap, "bootstrap-ip", "", "", "IP of an existing host to use as the bootstrap node instead of creating one. The plan and the SSH key are copied to it, in the install directory. It must accept the SSH key as --sshuser.")
+	flags.StringVarP(&opts.JumpHost, "jump-host", "", "", "Bastion as [user@]host[:port] the SSH checks reach the nodes through, on their private IPs. The SSH key and --sshuser are used for it by default. Defaults to the bootstrap node when some nodes have no public IP.")
+	flags.BoolVarP(&opts.Storage, "storage-cluster", "s", false, "Create a storage cluster from all Worker nodes.")
+	flags.StringVarP(&opts.NetworkMode, "network-mode", "", "overlay", "Calico networking mode of the plan: overlay or routed. Routed avoids the encapsulation overhead, but requires the nodes to route the pod traffic to each other.")
+	flags.StringVarP(&opts.PlanTemplate, "plan-template", "", "", "Path to a Go template of the plan file, rendered instead of the built-in template. --network-mode does not apply to it.")
+	flags.StringVarP(&opts.PodCIDR, "pod-cidr", "", plan.DefaultPodCIDR, "Network the pods are assigned IPs from. Use distinct networks for clusters that are peered.")
+	flags.StringVarP(&opts.ServiceCIDR, "service-cidr", "", plan.DefaultServiceCIDR, "Network the services are assigned IPs from. It cannot overlap the pod network.")
+	flags.StringSliceVarP(&opts.WorkerLabels, "worker-labels", "", []string{}, "Comma separated key=value Kubernetes labels of the worker nodes in the plan, e.g. node-role.kubernetes.io/worker")
+	flags.StringSliceVarP(&opts.IngressLabels, "ingress-labels", "", []string{}, "Comma separated key=value Kubernetes labels of the ingress nodes in the plan")
+	flags.StringSliceVarP(&opts.WorkerTaints, "worker-taints", "", []string{}, "Comma separated key=value:Effect Kubernetes taints of the worker nodes in the plan. Effects: NoSchedule, PreferNoSchedule, NoExecute")
+	flags.StringSliceVarP(&opts.IngressTaints, "ingress-taints", "", []string{}, "Comma separated key=value:Effect Kubernetes taints of the dedicated ingress nodes in the plan, e.g. dedicated=ingress:NoSchedule. Ignored without --ingress-count.")
+	flags.StringVarP(&opts.BootstrapFile, "bootstrap-commands-file", "", "", "Relative path to the script file that will be run on the bootstrap node upon initialization. e.g.: digitalocean/scripts/bootinit.sh.")
+	flags.BoolVarP(&opts.DryRun, "dry-run", "", false, "If present, prints what would be provisioned without creating anything. The cost is estimated when an API token is set.")
+	flags.StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+	flags.StringVarP(&opts.SSHPrivateKey, "ssh-key", "", "", "Path to the SSH private key used to access the nodes. RSA, ECDSA and ed25519 keys are supported. Defaults to $DO_SECRET_ACCESS_KEY or ssh/cluster.pem next to the executable.")
+	flags.StringVarP(&opts.SSHPublicKey, "ssh-pubkey", "", "", "Path to the SSH public key uploaded to Digital Ocean. Defaults to the private key path with a .pub suffix.")
+	flags.StringVarP(&opts.DOSshKeyName, "do-ssh-key-name", "", "", "Name of an SSH key already in the Digital Ocean account to create the nodes with, instead of uploading a local key. Requires --ssh-key for the matching private key.")
+	flags.StringSliceVarP(&opts.ExtraTags, "extra-tag", "", []string{}, "Additional key=value tag applied to all the droplets and volumes, e.g. team=platform. Can be repeated.")
+	flags.StringSliceVarP(&opts.ExtraSSHKeys, "extra-ssh-keys", "", []string{}, "Comma separated names or fingerprints of SSH keys in the Digital Ocean account that are also authorized on the nodes.")
+	flags.BoolVarP(&opts.GenerateKey, "generate-key", "", false, "If present and no SSH key is found, generates a new key pair in the ssh/ folder and uploads it to Digital Ocean.")
+	flags.StringVarP(&opts.VPCUUID, "vpc", "", "", "UUID of an existing VPC in the chosen region to create the nodes in. By default the region's default network is used.")
+	flags.BoolVarP(&opts.NoPrivateNetworking, "no-private-networking", "", false, "If present, the nodes are created without private networking and the plan uses their public IPs as internal IPs.")
+	flags.IntVarP(&opts.VolumeSizeGB, "volume-size", "", 0, "If greater than 0, creates and attaches a block storage volume of this size in GB to each worker node.")
+	flags.BoolVarP(&opts.EtcdSeparateDisk, "etcd-separate-disk", "", false, "If present, attaches a dedicated block storage volume to each etcd node and mounts it on --etcd-data-dir.")
+	flags.IntVarP(&opts.EtcdVolumeSizeGB, "etcd-volume-size", "", MIN_ETCD_VOLUME_SIZE_GB, "Size in GB of the etcd volumes created with --etcd-separate-disk.")
+	flags.StringVarP(&opts.EtcdDataDir, "etcd-data-dir", "", ETCD_DATA_DIR, "Directory the etcd volumes are mounted on. Kismatic keeps the etcd data in "+ETCD_DATA_DIR+", which the plan cannot change, so only that directory puts the data on the volume.")
+	flags.BoolVarP(&opts.LockSSH, "lock-ssh", "", false, "If present, creates a firewall that only allows SSH from the public IP of this machine and traffic between the cluster nodes.")
+	flags.StringVarP(&opts.FirewallName, "firewall-name", "", "", "Name of an existing firewall to apply to the nodes instead of creating one. The cluster tag is added to its targets, and removed from them when the cluster is deleted. Its rules must allow the traffic between the nodes.")
+	flags.BoolVarP(&opts.NodeExporter, "node-exporter", "", false, "If present, installs the Prometheus node exporter on all the nodes, listening on port 9100.")
+	flags.StringSliceVarP(&opts.NodeExporterSources, "node-exporter-cidr", "", []string{}, "IP or CIDR allowed to scrape the node exporter through the --lock-ssh firewall. Can be repeated. Defaults to the public IP of this machine.")
+	flags.BoolVarP(&opts.CreateLB, "lb", "", false, "If present, creates a load balancer for the Kubernetes API in front of the master nodes and uses it as the master FQDN in the plan.")
+	flags.BoolVarP(&opts.FloatingIP, "floating-ip", "", false, "If present, reserves a floating IP for the first master node and uses it as the master address in the plan.")
+	flags.StringVarP(&opts.DNSDomain, "dns-domain", "", "", "Domain managed in Digital Ocean in which an A record for the master is created. Requires --dns-record.")
+	flags.StringVarP(&opts.DNSRecord, "dns-record", "", "", "Name of the A record created in --dns-domain, e.g. k8s. It points at the load balancer, the floating IP or the first master, and is used as the master address in the plan.")
+	flags.IntVarP(&opts.MaxParallel, "max-parallel", "", 10, "Maximum number of droplets being created at the same time.")
+	flags.IntVarP(&opts.SSHPort, "ssh-port", "", 22, "Port on which sshd listens on the nodes. Recorded in the generated plan.")
+	flags.BoolVarP(&opts.WaitForActive, "wait-for-active", "", false, "If present, waits until each droplet is active and has both its public and private IP before continuing.")
+	flags.DurationVarP(&opts.ActiveTimeout, "active-timeout", "", 10*time.Minute, "How long to wait for the IPs of each droplet to be assigned.")
+	flags.DurationVarP(&opts.SSHTimeout, "ssh-timeout", "", 5*time.Minute, "How long to wait for all the nodes to become accessible via SSH.")
+	flags.BoolVarP(&opts.WaitForBootstrap, "wait-for-bootstrap", "", false, "If present, waits until the bootstrap commands have installed Kismatic on the bootstrap node.")
+	flags.DurationVarP(&opts.BootstrapTimeout, "bootstrap-timeout", "", 15*time.Minute, "How long to wait for Kismatic to be installed on the bootstrap node with --wait-for-bootstrap.")
+	flags.BoolVarP(&opts.VerifyNetwork, "verify-network", "", false, "If present, pings every node from the first master over the internal network once SSH is available, and fails on unreachable nodes.")
+	flags.StringVarP(&opts.UserDataFile, "user-data-file", "", "", "Path to a cloud-init user data file passed to all the nodes. On the bootstrap node it runs in addition to the bootstrap commands.")
+	flags.StringVarP(&opts.KETVersion, "ket-version", "", "", "Version of Kismatic downloaded to the bootstrap node, e.g. v1.2.1. Defaults to the version in the bootstrap commands file.")
+	flags.StringVarP(&opts.InstallDir, "install-dir", "", "", "Directory the bootstrap node installs kismatic, kubectl and the plan into. Defaults to $DO_KET_INSTALL_DIR or /ket")
+	flags.BoolVarP(&opts.InstallKismatic, "install-kismatic", "", true, "If true, the bootstrap commands download Kismatic to the bootstrap node.")
+	flags.BoolVarP(&opts.InstallKubectl, "install-kubectl", "", true, "If true, the bootstrap commands download kubectl to the bootstrap node.")
+	flags.StringVarP(&opts.KubectlVersion, "kubectl-version", "", "", "Version of kubectl downloaded to the bootstrap node, e.g. v1.6.0. Defaults to the latest stable release.")
+	flags.StringVarP(&opts.HTTPProxy, "http-proxy", "", "", "Proxy of the bootstrap node over HTTP, for the bootstrap commands and its login shells. Defaults to $HTTP_PROXY.")
+	flags.StringVarP(&opts.HTTPSProxy, "https-proxy", "", "", "Proxy of the bootstrap node over HTTPS, for the bootstrap commands and its login shells. Defaults to $HTTPS_PROXY.")
+	flags.StringSliceVarP(&opts.NoProxy, "no-proxy", "", []string{}, "Comma separated hosts, domains and CIDRs reached without the proxy, by provision and by the bootstrap node. Defaults to $NO_PROXY.")
+	flags.BoolVarP(&opts.FailOnCopyError, "fail-on-copy-error", "", false, "Exit with an error if the plan file cannot be copied to the bootstrap node.")
+	flags.BoolVarP(&opts.VerifyCopy, "verify-copy", "", false, "Check over SSH that the plan file copied to the bootstrap node exists and is not empty.")
+	flags.StringVarP(&opts.AdminPassword, "admin-password", "", "", "Admin password of the cluster. If not set, a random password is generated.")
+	flags.StringVarP(&opts.AdminUsername, "admin-username", "", "", "Name of the admin user of the cluster in the plan. If not set, the Kismatic default admin user is used.")
+	flags.StringVarP(&opts.PasswordFile, "password-file", "", "", "If set, the admin password of the cluster is also written to this file, readable only by the current user.")
+	flags.IntVarP(&opts.PasswordLength, "password-length", "", 16, "Length of the generated admin password, at least 12.")
+	flags.IntVarP(&opts.PasswordMinDigits, "password-min-digits", "", -1, "Minimum number of digits in the generated admin password. A negative value picks a random number between 0 and 5.")
+	flags.IntVarP(&opts.PasswordUppercase, "password-uppercase", "", -1, "Minimum number of uppercase letters in the generated admin password. A negative value picks a random number between 0 and 5.")
+	flags.DurationVarP(&opts.Timeout, "timeout", "", 20*time.Minute, "Maximum duration of the whole operation. When it is exceeded, the infrastructure created so far is removed. 0 disables the timeout.")
+	flags.StringVarP(&opts.StateFile, "resume", "", "", "Path to the state file of a failed create. The droplets recorded in the file are reused, the missing nodes are created, and the run continues with the SSH wait and the plan. The state file is updated in place.")
+	flags.BoolVarP(&opts.Recreate, "recreate", "", false, "If present with --reuse-tag, creates all the requested nodes next to the droplets that already carry the tag, which are left alone. By default only the missing nodes of each role are created.")
+	flags.BoolVarP(&opts.ReuseTag, "reuse-tag", "", false, "If present, allows creating nodes with a tag that droplets already carry, and converges to the nodes of the tag. By default create fails when the tag is in use, so that two clusters do not share a tag.")
+	flags.StringVarP(&opts.ImportTag, "reuse-droplets-from-tag", "", "", "TAG of existing droplets to build the cluster from, e.g. those of a partial run. They are tagged with --tag and reused by role, only the missing nodes are created, and the plan covers all of them. Droplets without a role tag or a role in their name are skipped.")
+	flags.BoolVarP(&opts.IPv6, "ipv6", "", false, "If present, enables IPv6 on the droplets. The public IPv6 address of each node is printed with the nodes, Kismatic does not use it.")
+	flags.BoolVarP(&opts.Monitoring, "monitoring", "", false, "If present, installs the Digital Ocean monitoring agent on the droplets.")
+	flags.BoolVarP(&opts.Backups, "backups", "", false, "If present, enables the weekly Digital Ocean backups of the droplets of the --backups-roles. Backups cost 20% of the droplet price.")
+	flags.StringSliceVarP(&opts.BackupRoles, "backups-roles", "", []string{"etcd", "master"}, "Roles whose droplets are backed up with --backups. Current options: etcd, master, worker, ingress, bootstrap")
+	flags.Float64VarP(&opts.MaxMonthlyCost, "max-monthly-cost", "", 0, "If greater than 0, aborts provisioning when the estimated monthly cost in USD exceeds this amount.")
+	flags.StringVarP(&opts.PlanFile, "plan-file", "", "", "Path the plan file is written to, or - to write it to stdout. Defaults to a new kismatic-cluster.yaml file in the current directory")
+	flags.StringVarP(&opts.OutputFormat, "output", "o", "table", "Format of the node listing printed after provisioning. Current options: table, json")
+	flags.BoolVarP(&opts.PrintResourceIDs, "print-resource-ids", "", false, "If present, prints the IDs of all the resources created as a single line of JSON at the end of the output.")
+
+}
+
+// clusterPreset is a canned set of node counts and instance types for test clusters
+type clusterPreset struct {
+	Etcd         uint16
+	Master       uint16
+	Worker       uint16
+	InstanceType string
+}
+
+var clusterPresets = map[string]clusterPreset{
+	"small":  {Etcd: 1, Master: 1, Worker: 1, InstanceType: "1gb"},
+	"medium": {Etcd: 3, Master: 1, Worker: 3, InstanceType: "2gb"},
+	"large":  {Etcd: 3, Master: 3, Worker: 5, InstanceType: "4gb"},
+}
+
+// applyPreset expands the --preset into the node counts and instance types. Values of flags
+// that were explicitly set are left untouched.
+func applyPreset(opts *DOOpts, flags *pflag.FlagSet) error {
+	if opts.Preset == "" {
+		return nil
+	}
+	preset, ok := clusterPresets[opts.Preset]
+	if !ok {
+		return fmt.Errorf("%v is not a valid preset. Current options: small, medium, large", opts.Preset)
+	}
+	if !flagChanged(flags, "etcdNodeCount") {
+		opts.EtcdNodeCount = preset.Etcd
+	}
+	if !flagChanged(flags, "masterdNodeCount") {
+		opts.MasterNodeCount = preset.Master
+	}
+	if !flagChanged(flags, "workerNodeCount") {
+		opts.WorkerNodeCount = preset.Worker
+	}
+	if !flagChanged(flags, "instance-type") {
+		opts.InstanceType = preset.InstanceType
+	}
+	if !flagChanged(flags, "worker-type") {
+		opts.WorkerType = preset.InstanceType
+	}
+	return nil
+}
+
 func DODeleteCmd() *cobra.Command {
 	opts := DOOpts{}
 	cmd := &cobra.Command{
 		Use:   "delete-all",
 		Short: "Deletes all the nodes from the Digital Ocean account",
-		Long:  `Deletes all the nodes based on the tag provided and also, if requested, removes the ssh key created during the provisioning`,
+		Long: `Deletes all the nodes based on the tag provided and also, if requested, removes the ssh key created during the provisioning.
+If a state file written by create is provided with --from-state, only the resources recorded in that file are removed.
+The tag is only removed from the firewalls joined with --firewall-name when their state file is provided with --from-state.
+With --role, only the nodes with that role are removed, e.g. --role worker keeps the etcd and master nodes.
+The DNS record created for the master is only removed when it is named with --dns-domain and --dns-record.
+With --older-than, only the nodes created longer ago than the duration are removed, e.g. --older-than 24h reaps the forgotten test clusters.
+The droplets are listed and the deletion must be confirmed, unless --yes is provided.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
 			return deleteInfra(opts)
 		},
 	}
 
 	cmd.Flags().StringVarP(&opts.ClusterTag, "tag", "", "apprenda", "All nodes with the provided tag will be removed")
-	cmd.Flags().BoolVarP(&opts.RemoveKey, "remove-key", "", false, "Inidicator whether the ssh key used for the provisioning should be deleted")
+	cmd.Flags().BoolVarP(&opts.RemoveKey, "remove-key", "", false, "Inidicator whether the ssh key uploaded for the cluster, named TAG-cluster-key, should be deleted. The keys of other clusters are kept. Without TAG-cluster-key, the apprenda-key of earlier versions is deleted.")
+	cmd.Flags().StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+	cmd.Flags().StringVarP(&opts.Role, "role", "", "", "If present, only the nodes with this role are removed, together with their volumes and floating IPs. Current options: etcd, master, worker, ingress, bootstrap")
+	cmd.Flags().StringSliceVarP(&opts.ExtraTags, "extra-tag", "", []string{}, "If present, only the nodes with all the given key=value tags are removed, together with their volumes and floating IPs. Can be repeated.")
+	cmd.Flags().BoolVarP(&opts.AssumeYes, "yes", "y", false, "If present, deletes without asking for confirmation")
+	cmd.Flags().StringVarP(&opts.StateFile, "from-state", "", "", "Path to a state file written by create. If present, only the resources recorded in the file are removed instead of all the resources with the tag")
+	cmd.Flags().DurationVarP(&opts.OlderThan, "older-than", "", 0, "If greater than 0, only the nodes with the tag that were created longer ago than this duration are removed, e.g. 24h. The resources shared by the cluster are only removed when all its nodes are old enough.")
+	cmd.Flags().StringVarP(&opts.DNSDomain, "dns-domain", "", "", "Domain of the master DNS record created with --dns-domain on create. DNS records are not tagged, so the record is only removed when it is named. Requires --dns-record.")
+	cmd.Flags().StringVarP(&opts.DNSRecord, "dns-record", "", "", "Name of the master DNS record to remove from --dns-domain")
 
 	return cmd
 }
 
 func deleteInfra(opts DOOpts) error {
-	opts.Token = os.Getenv("DO_API_TOKEN")
-	reader := bufio.NewReader(os.Stdin)
-	if opts.Token == "" {
-		fmt.Print("Enter Digital Ocean API Token: ")
-		url, _ := reader.ReadString('\n')
-		opts.Token = strings.Trim(url, "\n")
-		opts.Token = strings.Replace(opts.Token, "\r", "", -1) //for Windows
+	if err := validateDeleteOptions(opts); err != nil {
+		return err
 	}
+	if !opts.AssumeYes && !isTerminal(os.Stdin) {
+		return fmt.Errorf("Cannot ask for confirmation because stdin is not a terminal. Use --yes to delete without confirmation")
+	}
+	if err := resolveToken(&opts); err != nil {
+		return err
+	}
+	opts.ExtraTags, _ = parseExtraTags(opts.ExtraTags)
 
-	provisioner, _ := GetProvisioner()
-
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
 	return provisioner.TerminateNodes(opts)
 }
 
-func validateKeyFile(opts DOOpts) (string, string, error) {
-	var filePath string
+// Delete removes the cluster infrastructure, or the part of it selected by the role and the extra
+// tags, without asking for confirmation. The options are used as given: the token is not read
+// from the environment.
+func Delete(ctx context.Context, opts DOOpts) error {
+	if err := validateDeleteOptions(opts); err != nil {
+		return err
+	}
+	if opts.Token == "" {
+		return fmt.Errorf("The DigitalOcean API Token is required")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	opts.ExtraTags, _ = parseExtraTags(opts.ExtraTags)
+	opts.AssumeYes = true
 
-	sshKeyPath := os.Getenv("DO_SECRET_ACCESS_KEY")
-	if sshKeyPath == "" {
-		//try ssh dir relative to the executable
-		dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-		if err != nil {
-			fmt.Println("Cannot get path to exec", err)
-		}
-		sshKeyPath = filepath.Join(dir, "ssh/")
-		fmt.Println("Trying to locate key in ssh/ folder", sshKeyPath)
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	return provisioner.TerminateNodes(opts)
+}
 
-		filePath = filepath.Join(sshKeyPath, "cluster.pem")
-		_, staterr := os.Stat(filePath)
-		if os.IsNotExist(staterr) {
-			return "", "", fmt.Errorf("Private SSH file was not found in expected location. Create your own key pair and reference in options to the provision command. Change file permissions to allow w/r for the user (chmod 600) %v", err)
+// validateDeleteOptions checks the options of delete-all
+func validateDeleteOptions(opts DOOpts) error {
+	if opts.Role != "" {
+		if !isRole(opts.Role) {
+			return fmt.Errorf("%v is not a valid role. Current options: %s", opts.Role, strings.Join(ROLES, ", "))
 		}
-	} else {
-		filePath = sshKeyPath
+		if opts.StateFile != "" {
+			return fmt.Errorf("--role cannot be used together with --from-state")
+		}
+	}
+	if _, err := parseExtraTags(opts.ExtraTags); err != nil {
+		return err
+	}
+	if len(opts.ExtraTags) > 0 && opts.StateFile != "" {
+		return fmt.Errorf("--extra-tag cannot be used together with --from-state")
+	}
+	if err := validateDNSOptions(opts); err != nil {
+		return err
+	}
+	if opts.OlderThan < 0 {
+		return fmt.Errorf("--older-than must be a positive duration, got %v", opts.OlderThan)
+	}
+	if opts.OlderThan > 0 && opts.StateFile != "" {
+		return fmt.Errorf("--older-than cannot be used together with --from-state")
+	}
+	if opts.DNSDomain != "" && (opts.Role != "" || len(opts.ExtraTags) > 0 || opts.StateFile != "") {
+		return fmt.Errorf("--dns-domain removes the record of the whole cluster and cannot be used together with --role, --extra-tag or --from-state")
 	}
+	return nil
+}
 
-	return filePath, filePath + ".pub", nil
+// resolveToken sets the API token from DO_API_TOKEN, or prompts for it. When stdin is
+// not a terminal there is nobody to answer, so an error is returned instead.
+func resolveToken(opts *DOOpts) error {
+	return readToken(opts, os.Stdin, isTerminal(os.Stdin))
 }
 
-func makeInfra(opts DOOpts) error {
-	opts.Token = os.Getenv("DO_API_TOKEN")
-	reader := bufio.NewReader(os.Stdin)
-	if opts.Token == "" {
-		fmt.Print("Enter Digital Ocean API Token: \n")
-		url, _ := reader.ReadString('\n')
-		opts.Token = strings.Trim(url, "\n")
-		opts.Token = strings.Replace(opts.Token, "\r", "", -1) //for Windows
+func readToken(opts *DOOpts, in io.Reader, terminal bool) error {
+	if token := os.Getenv("DO_API_TOKEN"); token != "" {
+		opts.Token = token
+	}
+	if opts.Token != "" {
+		return nil
+	}
+	if !terminal {
+		return fmt.Errorf("The DigitalOcean API Token is required. Set DO_API_TOKEN when stdin is not a terminal")
 	}
+	fmt.Print("Enter Digital Ocean API Token: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("Unable to read the DigitalOcean API Token: %v", err)
+	}
+	opts.Token = strings.Trim(line, "\n")
+	opts.Token = strings.Replace(opts.Token, "\r", "", -1) //for Windows
 	if opts.Token == "" {
 		return fmt.Errorf("The DigitalOcean API Token is required")
 	}
-	sshPrivate, sshPublic, errkey := validateKeyFile(opts)
+	return nil
+}
+
+// privateKeyPath returns the private key given in the options, then $DO_SECRET_ACCESS_KEY,
+// then ssh/cluster.pem next to the executable
+func privateKeyPath(opts DOOpts) string {
+	if opts.SSHPrivateKey != "" {
+		return opts.SSHPrivateKey
+	}
+	if env := os.Getenv("DO_SECRET_ACCESS_KEY"); env != "" {
+		return env
+	}
+	//try ssh dir relative to the executable
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		logger.Warnf("Cannot get path to exec %v\n", err)
+	}
+	sshKeyPath := filepath.Join(dir, "ssh/")
+	logger.Infof("Trying to locate key in ssh/ folder %v\n", sshKeyPath)
+	return filepath.Join(sshKeyPath, "cluster.pem")
+}
+
+func validateKeyFile(opts DOOpts) (string, string, error) {
+	filePath := privateKeyPath(opts)
+	if opts.SSHPrivateKey == "" && os.Getenv("DO_SECRET_ACCESS_KEY") == "" {
+		if _, staterr := os.Stat(filePath); os.IsNotExist(staterr) && !opts.GenerateKey {
+			return "", "", fmt.Errorf("Private SSH file was not found in expected location. Create your own key pair and reference in options to the provision command. Change file permissions to allow w/r for the user (chmod 600)")
+		}
+	}
+
+	publicPath := opts.SSHPublicKey
+	if publicPath == "" {
+		publicPath = filePath + ".pub"
+	}
+
+	if _, staterr := os.Stat(filePath); os.IsNotExist(staterr) && opts.GenerateKey {
+		// A dry run creates nothing, not even the key pair
+		if opts.DryRun {
+			logger.Infof("A new SSH key pair would be generated at %v\n", filePath)
+			return filePath, publicPath, nil
+		}
+		logger.Infof("Generating new SSH key pair %v\n", filePath)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+			return "", "", fmt.Errorf("Cannot create directory for the SSH key: %v", err)
+		}
+		if err := utils.GenerateSSHKeyPair(filePath, publicPath, 2048); err != nil {
+			return "", "", fmt.Errorf("Cannot generate SSH key pair: %v", err)
+		}
+	}
+
+	keyType, err := checkKeyPair(filePath, publicPath)
+	if err != nil {
+		return "", "", err
+	}
+	logger.Infof("Using %s SSH key %s\n", keyType, filePath)
+
+	return filePath, publicPath, nil
+}
+
+// validateEtcdDisk checks the options of the dedicated etcd volumes. A zero size or data
+// directory is replaced by its default.
+func validateEtcdDisk(opts DOOpts) error {
+	if opts.EtcdNodeCount == 0 {
+		return fmt.Errorf("--etcd-separate-disk requires at least one etcd node")
+	}
+	if opts.EtcdVolumeSizeGB != 0 && (opts.EtcdVolumeSizeGB < MIN_ETCD_VOLUME_SIZE_GB || opts.EtcdVolumeSizeGB > MAX_VOLUME_SIZE_GB) {
+		return fmt.Errorf("The etcd volume size must be between %dGB and %dGB, got %dGB", MIN_ETCD_VOLUME_SIZE_GB, MAX_VOLUME_SIZE_GB, opts.EtcdVolumeSizeGB)
+	}
+	if opts.EtcdDataDir != "" && (!filepath.IsAbs(opts.EtcdDataDir) || filepath.Clean(opts.EtcdDataDir) == "/" || strings.ContainsAny(opts.EtcdDataDir, " \t\r\n'\"$;&|`\\")) {
+		return fmt.Errorf("%q is not a valid etcd data directory, an absolute path other than / without spaces or shell characters is required", opts.EtcdDataDir)
+	}
+	if opts.EtcdDataDir != "" && filepath.Clean(opts.EtcdDataDir) != ETCD_DATA_DIR {
+		logger.Warnf("Kismatic keeps the etcd data in %s, the volumes mounted on %s will not hold it\n", ETCD_DATA_DIR, opts.EtcdDataDir)
+	}
+	return nil
+}
+
+// validateNodeCounts rejects node count combinations that cannot be provisioned
+// or that would result in an invalid plan file
+func validateNodeCounts(opts DOOpts) error {
+	if opts.EtcdNodeCount+opts.MasterNodeCount+opts.WorkerNodeCount == 0 {
+		return fmt.Errorf("At least one etcd, master or worker node must be requested")
+	}
+	for _, check := range []struct {
+		role  string
+		count uint16
+	}{{"etcd", opts.EtcdNodeCount}, {"master", opts.MasterNodeCount}} {
+		if check.count < 2 || check.count%2 == 1 {
+			continue
+		}
+		msg := fmt.Sprintf("%d %s nodes do not tolerate more failures than %d, use %d or %d %s nodes for quorum", check.count, check.role, check.count-1, check.count-1, check.count+1, check.role)
+		if opts.Strict {
+			return fmt.Errorf("An odd number of %s nodes is required: %s", check.role, msg)
+		}
+		logger.Warnf("%s\n", msg)
+	}
+	if opts.CreateLB && opts.MasterNodeCount == 0 {
+		return fmt.Errorf("A load balancer requires at least one master node")
+	}
+	if opts.FloatingIP && opts.MasterNodeCount == 0 {
+		return fmt.Errorf("A floating IP requires at least one master node")
+	}
+	if opts.FloatingIP && opts.CreateLB {
+		return fmt.Errorf("The --lb and --floating-ip options cannot be used together")
+	}
+	if opts.DNSDomain != "" && opts.MasterNodeCount == 0 {
+		return fmt.Errorf("A DNS record requires at least one master node")
+	}
+	if opts.NoPlan {
+		return nil
+	}
+	if opts.EtcdNodeCount == 0 {
+		return fmt.Errorf("A plan file requires at least one etcd node. Use --noplan to provision without a plan")
+	}
+	if opts.MasterNodeCount == 0 {
+		return fmt.Errorf("A plan file requires at least one master node. Use --noplan to provision without a plan")
+	}
+	return nil
+}
+
+// resolveKeyFiles locates the SSH key pair and sets it in the options
+func resolveKeyFiles(opts *DOOpts) error {
+	// The public key is already in the account, only the private key is needed to reach the nodes
+	if opts.DOSshKeyName != "" {
+		if opts.SSHPrivateKey == "" {
+			return fmt.Errorf("--ssh-key is required with --do-ssh-key-name, to access the nodes")
+		}
+		s, err := os.Stat(opts.SSHPrivateKey)
+		if err != nil {
+			return fmt.Errorf("Did not find SSH private key at %q: %v", opts.SSHPrivateKey, err)
+		}
+		opts.SSHKeyName = s.Name()
+		opts.SSHPublicKey = ""
+		return nil
+	}
+	sshPrivate, sshPublic, errkey := validateKeyFile(*opts)
 	if errkey != nil {
 		return errkey
 	}
-	s, err := os.Stat(sshPrivate)
-	if os.IsNotExist(err) {
+	if _, err := os.Stat(sshPrivate); os.IsNotExist(err) && !(opts.DryRun && opts.GenerateKey) {
 		return fmt.Errorf("Did not find SSH private key at %q", sshPrivate)
 	}
-	opts.SSHKeyName = s.Name()
-	fmt.Println("SSH file name", opts.SSHKeyName)
+	opts.SSHKeyName = filepath.Base(sshPrivate)
+	logger.Debugf("SSH file name %v\n", opts.SSHKeyName)
 	opts.SSHPrivateKey = sshPrivate
 	opts.SSHPublicKey = sshPublic
-	if errkey != nil {
-		return errkey
+	return nil
+}
+
+// resolveInstallDir sets the install directory of the bootstrap node from the environment,
+// unless it is given with the flag
+func resolveInstallDir(opts *DOOpts) {
+	if opts.InstallDir == "" {
+		opts.InstallDir = os.Getenv("DO_KET_INSTALL_DIR")
 	}
+}
 
-	fmt.Print("Provisioning\n")
-	var bootCount uint16 = 0
-	if opts.BootstrapNode {
-		bootCount = 1
+// resolveProxy sets the proxy of the bootstrap node from the environment, unless it is given
+// with the flags
+func resolveProxy(opts *DOOpts) {
+	env := func(name string) string {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		return os.Getenv(strings.ToLower(name))
+	}
+	if opts.HTTPProxy == "" {
+		opts.HTTPProxy = env("HTTP_PROXY")
 	}
-	provisioner, _ := GetProvisioner()
-	nodes, err := provisioner.ProvisionNodes(opts, NodeCount{
-		Etcd:     opts.EtcdNodeCount,
-		Worker:   opts.WorkerNodeCount,
-		Master:   opts.MasterNodeCount,
-		Boostrap: bootCount,
-	})
+	if opts.HTTPSProxy == "" {
+		opts.HTTPSProxy = env("HTTPS_PROXY")
+	}
+	if len(opts.NoProxy) == 0 && env("NO_PROXY") != "" {
+		opts.NoProxy = strings.Split(env("NO_PROXY"), ",")
+	}
+}
 
+func makeInfra(opts DOOpts) error {
+	if err := validateCreateOptions(opts); err != nil {
+		return err
+	}
+	// Keep stdout for the plan
+	if opts.PlanFile == "-" {
+		logger.Out = os.Stderr
+	}
+	// A dry run only needs the token for the cost estimate, so it never prompts for it
+	if err := readToken(&opts, os.Stdin, isTerminal(os.Stdin) && !opts.DryRun); err != nil && !opts.DryRun {
+		return err
+	}
+	logger.Debugf("Using API token %s\n", redact(opts.Token))
+	if err := resolveKeyFiles(&opts); err != nil {
+		return err
+	}
+	resolveInstallDir(&opts)
+	resolveProxy(&opts)
+	setNoProxy(opts.NoProxy)
+
+	if opts.DryRun {
+		// The sizes and the prices come from the API, so the droplet class and the estimate need a token
+		provisioner, err := GetProvisioner()
+		if err != nil {
+			return err
+		}
+		if opts.Token != "" {
+			if err := provisioner.ResolveDropletClass(&opts); err != nil {
+				return err
+			}
+		}
+		printDryRun(opts, requestedNodeCount(opts))
+		if opts.Token == "" {
+			fmt.Println("Estimated cost: unavailable without an API token")
+			return nil
+		}
+		return checkCost(provisioner, opts, requestedNodeCount(opts))
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	nodes, err := provision(ctx, opts, provisioner)
 	if err != nil {
 		return err
 	}
 
-	fmt.Print("Waiting for SSH\n")
-	if err = WaitForSSH(nodes, opts.SSHPrivateKey); err != nil {
+	if opts.OutputFormat == "json" {
+		if err = printNodesJSON(os.Stdout, &nodes); err != nil {
+			return err
+		}
+	} else if opts.NoPlan {
+		logger.Infof("Your instances are ready.\n")
+		printNodesTable(os.Stdout, &nodes, provisioner.sizesForTable(opts))
+	}
+	// The receipt is the last line of the output
+	if opts.PrintResourceIDs {
+		return printResourceReceipt(os.Stdout, provisioner.state, nodes)
+	}
+	return nil
+}
+
+// adminUsernamePattern matches the admin usernames that render as plain YAML scalars
+var adminUsernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]*$`)
+
+// versionPattern matches the release versions of --ket-version and --kubectl-version
+var versionPattern = regexp.MustCompile(`^v?[0-9]+(\.[0-9]+){1,2}([-+][0-9A-Za-z.]+)?$`)
+
+// validateBootstrapFlags fails when the options of the bootstrap commands are given without
+// --bootstrap-commands-file, since nothing is downloaded to the bootstrap node without them
+func validateBootstrapFlags(opts DOOpts, flags *pflag.FlagSet) error {
+	if opts.BootstrapFile != "" {
+		return nil
+	}
+	// The versions may come from the config file too
+	given := []struct {
+		flag  string
+		given bool
+	}{
+		{"ket-version", opts.KETVersion != ""},
+		{"kubectl-version", opts.KubectlVersion != ""},
+		{"install-kismatic", flagChanged(flags, "install-kismatic")},
+		{"install-kubectl", flagChanged(flags, "install-kubectl")},
+	}
+	for _, g := range given {
+		if g.given {
+			return fmt.Errorf("--%s requires --bootstrap-commands-file, which downloads Kismatic and kubectl to the bootstrap node", g.flag)
+		}
+	}
+	return nil
+}
+
+// validateCreateOptions checks the options of create before anything is created
+func validateCreateOptions(opts DOOpts) error {
+	if err := validateNodeCounts(opts); err != nil {
 		return err
 	}
+	if err := validateRegions(&opts); err != nil {
+		return err
+	}
+	if err := validateDNSOptions(opts); err != nil {
+		return err
+	}
+	for _, role := range opts.BackupRoles {
+		if !isRole(role) {
+			return fmt.Errorf("%v is not a valid backups role. Current options: %s", role, strings.Join(ROLES, ", "))
+		}
+	}
+	if opts.EtcdSeparateDisk {
+		if err := validateEtcdDisk(opts); err != nil {
+			return err
+		}
+	}
+	if opts.NoPrivateNetworking {
+		if opts.VPCUUID != "" {
+			return fmt.Errorf("The --vpc and --no-private-networking options cannot be used together")
+		}
+		logger.Warnf("Private networking is disabled, the traffic between the nodes will traverse the public network\n")
+	}
+	if len(opts.NodeExporterSources) > 0 && !(opts.NodeExporter && opts.LockSSH) {
+		return fmt.Errorf("--node-exporter-cidr requires --node-exporter and --lock-ssh")
+	}
+	for _, source := range opts.NodeExporterSources {
+		if _, _, err := net.ParseCIDR(source); err != nil && net.ParseIP(source) == nil {
+			return fmt.Errorf("%q is not a valid IP or CIDR for --node-exporter-cidr", source)
+		}
+	}
+	if opts.FirewallName != "" && opts.LockSSH {
+		return fmt.Errorf("--firewall-name cannot be used together with --lock-ssh, the nodes join the existing firewall instead")
+	}
+	if opts.NodeExporter && !opts.LockSSH {
+		logger.Warnf("The node exporter port %d is open to everyone without --lock-ssh\n", NODE_EXPORTER_PORT)
+	}
+	if err := validatePlanOptions(opts); err != nil {
+		return err
+	}
+	if err := validatePasswordLength(opts); err != nil {
+		return err
+	}
+	for _, v := range []struct{ flag, version string }{{"ket-version", opts.KETVersion}, {"kubectl-version", opts.KubectlVersion}} {
+		if v.version != "" && !versionPattern.MatchString(v.version) {
+			return fmt.Errorf("%q is not a valid --%s, a release version such as v1.2.1 is required", v.version, v.flag)
+		}
+	}
+	// The bootstrap node is useless without its commands, so the file must load before anything is created
+	if opts.BootstrapFile != "" && opts.BootstrapNode && opts.ExistingBootstrap == "" {
+		if _, err := loadBootCmds(opts.BootstrapFile, opts); err != nil {
+			return fmt.Errorf("Cannot load the bootstrap commands file %q: %v", opts.BootstrapFile, err)
+		}
+	}
+	if opts.WaitForBootstrap && (!opts.BootstrapNode || !opts.InstallKismatic || opts.ExistingBootstrap != "" || opts.BootstrapFile == "") {
+		return fmt.Errorf("--wait-for-bootstrap requires a bootstrap node on which Kismatic is installed by --bootstrap-commands-file")
+	}
+	if opts.JumpHost != "" {
+		if _, err := parseJumpHost(opts.JumpHost, opts.SSHUser, opts.SSHPort, opts.SSHPrivateKey); err != nil {
+			return err
+		}
+	}
+	if opts.ExistingBootstrap != "" {
+		if !opts.BootstrapNode {
+			return fmt.Errorf("The --bootstrap-ip option cannot be used with --bootstrap=false")
+		}
+		if net.ParseIP(opts.ExistingBootstrap) == nil {
+			return fmt.Errorf("%q is not a valid IP for --bootstrap-ip", opts.ExistingBootstrap)
+		}
+	}
+	if err := validateOutputFormat(opts.OutputFormat); err != nil {
+		return err
+	}
+	for _, labels := range [][]string{opts.WorkerLabels, opts.IngressLabels} {
+		if _, err := parseLabels(labels); err != nil {
+			return err
+		}
+	}
+	for _, taints := range [][]string{opts.WorkerTaints, opts.IngressTaints} {
+		if _, err := parseTaints(taints); err != nil {
+			return err
+		}
+	}
+	if opts.PrintResourceIDs && opts.PlanFile == "-" {
+		return fmt.Errorf("The plan and the resource IDs cannot both be written to stdout")
+	}
+	for _, proxy := range []string{opts.HTTPProxy, opts.HTTPSProxy} {
+		if u, err := url.Parse(proxy); proxy != "" && (err != nil || u.Host == "") {
+			return fmt.Errorf("%q is not a valid proxy URL", proxy)
+		}
+	}
+	if opts.StateFile != "" && opts.Recreate {
+		return fmt.Errorf("--resume cannot be used together with --recreate")
+	}
+	if opts.Recreate && !opts.ReuseTag {
+		return fmt.Errorf("--recreate requires --reuse-tag, the droplets of the tag are kept next to the new nodes")
+	}
+	if opts.ImportTag != "" && (opts.StateFile != "" || opts.Recreate) {
+		return fmt.Errorf("--reuse-droplets-from-tag cannot be used together with --resume or --recreate")
+	}
+	if opts.PlanFile == "-" && opts.OutputFormat == "json" {
+		return fmt.Errorf("The plan and the JSON node listing cannot both be written to stdout")
+	}
+	if opts.NamePrefix != "" && dnsSafe(opts.NamePrefix) == "" {
+		return fmt.Errorf("%q is not a valid name prefix", opts.NamePrefix)
+	}
+	if _, err := parseExtraTags(opts.ExtraTags); err != nil {
+		return err
+	}
+	if !sshUserPattern.MatchString(opts.SSHUser) {
+		return fmt.Errorf("%q is not a valid SSH user name", opts.SSHUser)
+	}
+	if opts.DropletClass != "" {
+		if _, ok := dropletClassPrefixes[opts.DropletClass]; !ok {
+			return fmt.Errorf("%v is not a valid droplet class. Current options: basic, cpu, memory", opts.DropletClass)
+		}
+	} else if opts.VCPUs != 0 || opts.MemoryGB != 0 {
+		return fmt.Errorf("--vcpus and --memory-gb require --droplet-class")
+	}
+	if opts.VCPUs < 0 || opts.MemoryGB < 0 {
+		return fmt.Errorf("--vcpus and --memory-gb cannot be negative")
+	}
+	if opts.SSHPort < 1 || opts.SSHPort > 65535 {
+		return fmt.Errorf("%d is not a valid SSH port", opts.SSHPort)
+	}
+	// the install directory is used in the bootstrap script
+	if opts.InstallDir != "" && (!filepath.IsAbs(opts.InstallDir) || strings.ContainsAny(opts.InstallDir, " \t\r\n'\"$;&|`\\")) {
+		return fmt.Errorf("%q is not a valid install directory, an absolute path without spaces or shell characters is required", opts.InstallDir)
+	}
+	if opts.UserDataFile != "" {
+		if err := validateUserDataFile(opts.UserDataFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setDefaults fills in the options left empty by library callers with the defaults of the
+// create command
+func setDefaults(opts *DOOpts) {
+	if opts.OutputFormat == "" {
+		opts.OutputFormat = "table"
+	}
+	if opts.NetworkMode == "" {
+		opts.NetworkMode = "overlay"
+	}
+	if opts.SSHPort == 0 {
+		opts.SSHPort = 22
+	}
+	if opts.SSHUser == "" {
+		opts.SSHUser = "root"
+	}
+	if opts.MaxParallel == 0 {
+		opts.MaxParallel = 10
+	}
+	if opts.ActiveTimeout == 0 {
+		opts.ActiveTimeout = 10 * time.Minute
+	}
+	if opts.SSHTimeout == 0 {
+		opts.SSHTimeout = 5 * time.Minute
+	}
+	if opts.Backups && len(opts.BackupRoles) == 0 {
+		opts.BackupRoles = []string{"etcd", "master"}
+	}
+	if opts.EtcdSeparateDisk && opts.EtcdVolumeSizeGB == 0 {
+		opts.EtcdVolumeSizeGB = MIN_ETCD_VOLUME_SIZE_GB
+	}
+	if opts.EtcdSeparateDisk && opts.EtcdDataDir == "" {
+		opts.EtcdDataDir = ETCD_DATA_DIR
+	}
+	if opts.BootstrapTimeout == 0 {
+		opts.BootstrapTimeout = 15 * time.Minute
+	}
+	if opts.PasswordLength == 0 {
+		opts.PasswordLength = 16
+	}
+}
+
+func requestedNodeCount(opts DOOpts) NodeCount {
+	var bootCount uint16 = 0
+	if opts.BootstrapNode && opts.ExistingBootstrap == "" {
+		bootCount = 1
+	}
+	return NodeCount{
+		Etcd:      opts.EtcdNodeCount,
+		Worker:    opts.WorkerNodeCount,
+		Ingress:   opts.IngressNodeCount,
+		Master:    opts.MasterNodeCount,
+		Bootstrap: bootCount,
+	}
+}
+
+// Provision creates the cluster infrastructure described by the options, waits until the nodes
+// are accessible via SSH and writes the plan file, unless NoPlan is set. The options are used as
+// given: the token and the SSH keys are not read from the environment and nothing is prompted.
+// If the context is cancelled or opts.Timeout elapses, the infrastructure created so far is removed.
+func Provision(ctx context.Context, opts DOOpts) (ProvisionedNodes, error) {
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return ProvisionedNodes{}, err
+	}
+	return provision(ctx, opts, provisioner)
+}
+
+// existingNodes returns the nodes the run builds on. With --reuse-tag, the nodes left by a previous
+// run with the same tag are reused, so that re-running create converges to the requested node
+// counts. A resumed run only reuses the droplets of its state file. Without --reuse-tag the tag
+// must be unused, so that the nodes of another cluster are not taken over.
+func existingNodes(provisioner *doProvisioner, opts *DOOpts) (ProvisionedNodes, error) {
+	existing := ProvisionedNodes{}
+	var err error
+	if opts.StateFile != "" {
+		// The droplets of a resumed run carry the tag already
+		opts.ReuseTag = true
+		existing, err = provisioner.ResumeFromState(*opts)
+	} else if opts.ImportTag != "" {
+		// The cluster tag must be free until the imported droplets get it
+		if !opts.ReuseTag && opts.ImportTag != opts.ClusterTag {
+			if err = provisioner.checkTagUnused(*opts); err != nil {
+				return existing, err
+			}
+		}
+		opts.ReuseTag = true
+		existing, err = provisioner.ImportNodes(*opts)
+	} else if opts.ReuseTag && !opts.Recreate {
+		existing, err = provisioner.ExistingNodes(*opts)
+	}
+	return existing, err
+}
+
+// provision is Provision with the provisioner given, whose state records what was created
+func provision(ctx context.Context, opts DOOpts, provisioner *doProvisioner) (ProvisionedNodes, error) {
+	setDefaults(&opts)
+	if err := validateCreateOptions(opts); err != nil {
+		return ProvisionedNodes{}, err
+	}
+	if opts.Token == "" {
+		return ProvisionedNodes{}, fmt.Errorf("The DigitalOcean API Token is required")
+	}
+	if opts.SSHPrivateKey == "" {
+		return ProvisionedNodes{}, fmt.Errorf("The SSH private key is required")
+	}
+	if opts.DOSshKeyName == "" {
+		if opts.SSHPublicKey == "" {
+			opts.SSHPublicKey = opts.SSHPrivateKey + ".pub"
+		}
+		if _, err := checkKeyPair(opts.SSHPrivateKey, opts.SSHPublicKey); err != nil {
+			return ProvisionedNodes{}, err
+		}
+	}
+	// The existing bootstrap node is checked before anything is created
+	if opts.ExistingBootstrap != "" {
+		logger.Infof("Checking SSH access to the bootstrap node %s\n", opts.ExistingBootstrap)
+		if err := checkSSH(opts.ExistingBootstrap, opts.SSHUser, opts.SSHPrivateKey, opts.SSHPort); err != nil {
+			return ProvisionedNodes{}, fmt.Errorf("Unable to reach the bootstrap node %s over SSH as %s: %v", opts.ExistingBootstrap, opts.SSHUser, err)
+		}
+	}
+	opts.ExtraTags, _ = parseExtraTags(opts.ExtraTags)
+	if opts.SSHKeyName == "" {
+		opts.SSHKeyName = filepath.Base(opts.SSHPrivateKey)
+	}
+	// Generate the admin password before creating anything, so that a failure
+	// does not leave orphaned droplets behind
+	if !opts.NoPlan && opts.AdminPassword == "" {
+		password, err := generateAlphaNumericPassword(opts.PasswordLength, opts.PasswordMinDigits, opts.PasswordUppercase)
+		if err != nil {
+			return ProvisionedNodes{}, fmt.Errorf("Unable to generate the admin password: %v", err)
+		}
+		opts.AdminPassword = password
+	}
+	nodeCount := requestedNodeCount(opts)
+
+	logger.Infof("Provisioning\n")
+	// Record what was created even if provisioning fails part of the way
+	defer saveState(provisioner.state)
+	existing, err := existingNodes(provisioner, &opts)
+	if err != nil {
+		return ProvisionedNodes{}, err
+	}
+	if len(existing.allNodes()) > 0 {
+		nodeCount = remainingNodeCount(nodeCount, existing)
+		opts.EtcdStartIndex = lastIndex(existing.Etcd)
+		opts.MasterStartIndex = lastIndex(existing.Master)
+		opts.WorkerStartIndex = lastIndex(existing.Worker)
+		opts.IngressStartIndex = lastIndex(existing.Ingress)
+		opts.BootstrapStartIndex = lastIndex(existing.Bootstrap)
+		logger.Infof("Found %d existing node(s) with the tag %s. Creating %d etcd, %d master, %d worker, %d ingress and %d bootstrap node(s). Use --recreate to create all the nodes\n",
+			len(existing.allNodes()), opts.ClusterTag, nodeCount.Etcd, nodeCount.Master, nodeCount.Worker, nodeCount.Ingress, nodeCount.Bootstrap)
+	}
+
+	if err := provisioner.ResolveDropletClass(&opts); err != nil {
+		return ProvisionedNodes{}, err
+	}
+	if err := checkCost(provisioner, opts, nodeCount); err != nil {
+		return ProvisionedNodes{}, err
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	// When interrupted or timed out, whatever was created by this run is removed
+	interrupted := func(err error) error {
+		if err == nil || ctx.Err() == nil {
+			return err
+		}
+		provisioner.Rollback(opts)
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("Provisioning failed: operation timed out after %v", opts.Timeout)
+		}
+		return fmt.Errorf("Provisioning was interrupted")
+	}
+	// A resumed run may have all its droplets already
+	created := ProvisionedNodes{}
+	if nodeCount.Total() > 0 || nodeCount.Bootstrap > 0 {
+		created, err = provisioner.ProvisionNodes(ctx, opts, nodeCount)
+		if err != nil {
+			return ProvisionedNodes{}, interrupted(err)
+		}
+	}
+	// The imported droplets join the cluster once everything else succeeded
+	if opts.ImportTag != "" {
+		if err = provisioner.TagImportedNodes(opts, existing); err != nil {
+			return ProvisionedNodes{}, err
+		}
+	}
+	nodes := existing.merge(created)
+
+	masterFQDN := ""
+	masterShortName := ""
+	if opts.CreateLB {
+		masterFQDN, err = provisioner.CreateMasterLoadBalancer(ctx, opts, nodes)
+		if err != nil {
+			return ProvisionedNodes{}, interrupted(err)
+		}
+	}
+	if opts.FloatingIP {
+		masterFQDN, err = provisioner.AssignMasterFloatingIP(opts, nodes.Master[0])
+		if err != nil {
+			return ProvisionedNodes{}, interrupted(err)
+		}
+		masterShortName = masterFQDN
+	}
+	if opts.DNSDomain != "" {
+		target := masterFQDN
+		if target == "" {
+			target = nodes.Master[0].PublicIPv4
+		}
+		masterFQDN, err = provisioner.CreateMasterDNSRecord(opts, target)
+		if err != nil {
+			return ProvisionedNodes{}, interrupted(err)
+		}
+	}
+
+	jump, err := sshJumpHost(opts, nodes)
+	if err != nil {
+		return ProvisionedNodes{}, err
+	}
+	if jump != nil {
+		logger.Infof("Reaching the nodes through the jump host %s\n", jump.Host)
+		ctx = withSSHJump(ctx, jump)
+	}
+	logger.Infof("Waiting for SSH\n")
+	if err = waitForSSH(ctx, nodes, opts.SSHPrivateKey, opts.SSHPort, opts.SSHTimeout, opts.OnProgress); err != nil {
+		return ProvisionedNodes{}, interrupted(err)
+	}
+	if opts.VerifyNetwork {
+		checked := nodes
+		if usesPublicInternalIPs(&opts) {
+			checked = nodes.withPublicInternalIPs()
+		}
+		if err = VerifyNetwork(ctx, checked, opts.SSHPrivateKey, opts.SSHPort); err != nil {
+			return ProvisionedNodes{}, interrupted(err)
+		}
+	}
+	if opts.EtcdSeparateDisk {
+		if err = MountDataVolumes(ctx, nodes.Etcd, opts.SSHPrivateKey, opts.SSHPort); err != nil {
+			return ProvisionedNodes{}, interrupted(err)
+		}
+	}
+	if opts.WaitForBootstrap && len(nodes.Bootstrap) > 0 {
+		if err = WaitForBootstrap(ctx, opts, nodes.Bootstrap[0], opts.BootstrapTimeout); err != nil {
+			return ProvisionedNodes{}, interrupted(err)
+		}
+	}
 
 	if opts.NoPlan {
-		fmt.Println("Your instances are ready.\n")
-		printNodes(&nodes)
-		return nil
+		return nodes, nil
+	}
+
+	pln, err := newPlan(opts, nodes, masterFQDN, masterShortName)
+	if err != nil {
+		return ProvisionedNodes{}, err
+	}
+	if opts.PasswordFile != "" {
+		if err = writePasswordFile(opts.PasswordFile, pln.AdminPassword); err != nil {
+			return ProvisionedNodes{}, err
+		}
+		logger.Infof("Admin password written to %v\n", opts.PasswordFile)
 	}
 
+	err = makePlan(ctx, pln, opts, nodes)
+	if err != nil {
+		return ProvisionedNodes{}, interrupted(err)
+	}
+	return nodes, nil
+}
+
+// newPlan describes the provisioned nodes in a plan. The masters default to the first master
+// node. Without dedicated ingress nodes, the first worker is the ingress node, and without
+// any worker the plan has no ingress node.
+func newPlan(opts DOOpts, nodes ProvisionedNodes, masterFQDN, masterShortName string) (*plan.Plan, error) {
+	if len(nodes.Etcd) == 0 {
+		return nil, fmt.Errorf("A plan file requires at least one etcd node. Use --noplan to provision without a plan")
+	}
+	if len(nodes.Master) == 0 {
+		return nil, fmt.Errorf("A plan file requires at least one master node. Use --noplan to provision without a plan")
+	}
+	planNodes := nodes
+	if usesPublicInternalIPs(&opts) {
+		planNodes = nodes.withPublicInternalIPs()
+	}
+	ingressNodes := planNodes.Ingress
+	if len(ingressNodes) == 0 && len(planNodes.Worker) > 0 {
+		ingressNodes = []plan.Node{planNodes.Worker[0]}
+	}
+	// The labels and taints were validated with the options
+	workerLabels, _ := parseLabels(opts.WorkerLabels)
+	workerTaints, _ := parseTaints(opts.WorkerTaints)
+	ingressLabels, _ := parseLabels(opts.IngressLabels)
+	ingressTaints, _ := parseTaints(opts.IngressTaints)
+	// The ingress taints would also keep the workloads off a worker used as the ingress node
+	if len(planNodes.Ingress) == 0 && len(ingressTaints) > 0 {
+		logger.Warnf("The ingress taints are only applied to dedicated ingress nodes, use --ingress-count to create them\n")
+		ingressTaints = nil
+	}
+	planNodes.Worker = withLabels(planNodes.Worker, workerLabels, workerTaints)
+	ingressNodes = withLabels(ingressNodes, ingressLabels, ingressTaints)
+	if len(ingressNodes) == 0 {
+		logger.Warnf("The plan has no ingress node, since no worker or ingress node was provisioned\n")
+	}
 	storageNodes := []plan.Node{}
 	if opts.Storage {
-		storageNodes = nodes.Worker
+		storageNodes = planNodes.Worker
+	}
+
+	if masterFQDN == "" {
+		masterFQDN = nodes.Master[0].PublicIPv4
+	}
+	if masterShortName == "" {
+		masterShortName = nodes.Master[0].PublicIPv4
+	}
+	return &plan.Plan{
+		AdminPassword:       opts.AdminPassword,
+		AdminUsername:       opts.AdminUsername,
+		PodCIDR:             opts.PodCIDR,
+		ServiceCIDR:         opts.ServiceCIDR,
+		NetworkMode:         opts.NetworkMode,
+		Etcd:                planNodes.Etcd,
+		Master:              planNodes.Master,
+		Worker:              planNodes.Worker,
+		Ingress:             ingressNodes,
+		Storage:             storageNodes,
+		MasterNodeFQDN:      masterFQDN,
+		MasterNodeShortName: masterShortName,
+		SSHKeyFile:          planSSHKeyFile(opts),
+		SSHUser:             nodes.Master[0].SSHUser,
+		SSHPort:             opts.SSHPort,
+	}, nil
+}
+
+// sshJumpHost returns the host given with --jump-host. Otherwise, when some nodes have no
+// public IP, they are reached through the bootstrap node.
+func sshJumpHost(opts DOOpts, nodes ProvisionedNodes) (*sshJump, error) {
+	if opts.JumpHost != "" {
+		return parseJumpHost(opts.JumpHost, opts.SSHUser, opts.SSHPort, opts.SSHPrivateKey)
+	}
+	boot, ok := bootstrapTarget(opts, nodes)
+	if !opts.BootstrapNode || !ok || boot.PublicIPv4 == "" {
+		return nil, nil
+	}
+	for _, n := range nodes.allNodes() {
+		if n.PublicIPv4 == "" {
+			return &sshJump{Host: boot.PublicIPv4, User: boot.SSHUser, Port: opts.SSHPort, Key: opts.SSHPrivateKey}, nil
+		}
+	}
+	return nil, nil
+}
+
+// bootstrapTarget returns the node the plan and the SSH key are copied to: the existing host
+// given with --bootstrap-ip, or else the bootstrap node that was created, if any
+func bootstrapTarget(opts DOOpts, nodes ProvisionedNodes) (plan.Node, bool) {
+	if opts.ExistingBootstrap != "" {
+		return plan.Node{Host: opts.ExistingBootstrap, PublicIPv4: opts.ExistingBootstrap, SSHUser: opts.SSHUser}, true
 	}
-	root := os.Getenv("DO_KET_INSTALL_DIR")
-	if root == "" {
-		root = KET_INSTALL_DIR
+	if len(nodes.Bootstrap) == 0 {
+		return plan.Node{}, false
 	}
+	return nodes.Bootstrap[0], true
+}
 
-	sshKeyFile := opts.SSHPrivateKey
-	// If the user asks for a bootstrap node, the generated plan file will contain
-	// the path to the SSH key on the bootstrap node, and not on the node that is running
-	// provision.
+// planSSHKeyFile returns the key file referenced by the plan. If the user asks for a bootstrap
+// node, it is the copy of the key on the bootstrap node, and not the key on the node that is
+// running provision.
+func planSSHKeyFile(opts DOOpts) string {
 	if opts.BootstrapNode {
-		sshKeyFile = fmt.Sprintf("%s/ssh/%s", root, opts.SSHKeyName)
+		return bootstrapKeyPath(opts)
 	}
+	return opts.SSHPrivateKey
+}
 
-	return makePlan(&plan.Plan{
-		AdminPassword:       generateAlphaNumericPassword(),
-		Etcd:                nodes.Etcd,
-		Master:              nodes.Master,
-		Worker:              nodes.Worker,
-		Ingress:             []plan.Node{nodes.Worker[0]},
-		Storage:             storageNodes,
-		MasterNodeFQDN:      nodes.Master[0].PublicIPv4,
-		MasterNodeShortName: nodes.Master[0].PublicIPv4,
-		SSHKeyFile:          sshKeyFile,
-		SSHUser:             nodes.Master[0].SSHUser,
-	}, opts, nodes)
+// ketInstallDir returns the directory the bootstrap node installs kismatic into: opts.InstallDir,
+// then KET_INSTALL_DIR. The commands resolve $DO_KET_INSTALL_DIR into opts.InstallDir with
+// resolveInstallDir, the options of Provision are used as given.
+func ketInstallDir(opts DOOpts) string {
+	if opts.InstallDir != "" {
+		return opts.InstallDir
+	}
+	return KET_INSTALL_DIR
+}
+
+// interruptContext returns a context that is cancelled on the first Ctrl-C. Further
+// interrupts are not caught, so that a stuck cleanup can still be killed.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		select {
+		case <-sigs:
+			logger.Warnf("\nInterrupted, cleaning up the infrastructure created so far. Press Ctrl-C again to abort\n")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
+func saveState(state *State) {
+	if state.isEmpty() {
+		return
+	}
+	name, err := writeState(state)
+	if err != nil {
+		logger.Errorf("Cannot write state file %v\n", err)
+		return
+	}
+	logger.Infof("Provisioned infrastructure recorded in %v\n", name)
+}
 
+// parsePlanTemplate parses the template file given with --plan-template, or the built-in
+// template
+func parsePlanTemplate(opts DOOpts) (*template.Template, error) {
+	if opts.PlanTemplate == "" {
+		return template.New("planAWSOverlay").Parse(plan.OverlayNetworkPlan)
+	}
+	data, err := ioutil.ReadFile(opts.PlanTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read plan template %q: %v", opts.PlanTemplate, err)
+	}
+	tmpl, err := template.New(filepath.Base(opts.PlanTemplate)).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse plan template %q: %v", opts.PlanTemplate, err)
+	}
+	return tmpl, nil
 }
 
-func makePlan(pln *plan.Plan, opts DOOpts, nodes ProvisionedNodes) error {
-	template, err := template.New("planAWSOverlay").Parse(plan.OverlayNetworkPlan)
+// validatePlanTemplate parses the plan template and renders it with a sample plan, so that
+// typos are found before anything is created
+func validatePlanTemplate(opts DOOpts) error {
+	tmpl, err := parsePlanTemplate(opts)
 	if err != nil {
 		return err
 	}
+	node := plan.Node{Host: "sample", PublicIPv4: "192.0.2.1", PrivateIPv4: "10.0.0.1", SSHUser: opts.SSHUser}
+	sample := &plan.Plan{
+		Etcd:                []plan.Node{node},
+		Master:              []plan.Node{node},
+		Worker:              []plan.Node{node},
+		Ingress:             []plan.Node{node},
+		MasterNodeFQDN:      node.PublicIPv4,
+		MasterNodeShortName: node.PublicIPv4,
+		SSHUser:             opts.SSHUser,
+		SSHPort:             opts.SSHPort,
+	}
+	if err = tmpl.Execute(ioutil.Discard, sample); err != nil {
+		return fmt.Errorf("Cannot render plan template %q: %v", opts.PlanTemplate, err)
+	}
+	return nil
+}
 
-	f, err := makeUniqueFile(0)
+// validatePlanOptions checks the options the plan is rendered with. They are shared by create
+// and plan.
+func validatePlanOptions(opts DOOpts) error {
+	if opts.NetworkMode != "" && opts.NetworkMode != "overlay" && opts.NetworkMode != "routed" {
+		return fmt.Errorf("%v is not a valid network mode. Current options: overlay, routed", opts.NetworkMode)
+	}
+	// the plan is rendered with html/template, which would escape these characters
+	if strings.ContainsAny(opts.AdminPassword, " \t\r\n<>&'\"") {
+		return fmt.Errorf("The admin password cannot contain whitespace or any of the characters <>&'\"")
+	}
+	if opts.AdminUsername != "" && !adminUsernamePattern.MatchString(opts.AdminUsername) {
+		return fmt.Errorf("%q is not a valid admin username, only letters, digits and the characters ._@- are allowed", opts.AdminUsername)
+	}
+	if err := validateClusterCIDRs(opts.PodCIDR, opts.ServiceCIDR); err != nil {
+		return err
+	}
+	if opts.PlanTemplate != "" && !opts.NoPlan {
+		if err := validatePlanTemplate(opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// validateClusterCIDRs checks that the pod and service networks are valid and do not overlap.
+// An empty network is the default of the plan.
+func validateClusterCIDRs(podCIDR, serviceCIDR string) error {
+	if podCIDR == "" {
+		podCIDR = plan.DefaultPodCIDR
+	}
+	if serviceCIDR == "" {
+		serviceCIDR = plan.DefaultServiceCIDR
+	}
+	_, pods, err := net.ParseCIDR(podCIDR)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid CIDR for --pod-cidr", podCIDR)
+	}
+	_, services, err := net.ParseCIDR(serviceCIDR)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid CIDR for --service-cidr", serviceCIDR)
+	}
+	if pods.Contains(services.IP) || services.Contains(pods.IP) {
+		return fmt.Errorf("The pod network %s and the service network %s overlap", podCIDR, serviceCIDR)
+	}
+	return nil
+}
+
+func makePlan(ctx context.Context, pln *plan.Plan, opts DOOpts, nodes ProvisionedNodes) error {
+	template, err := parsePlanTemplate(opts)
 	if err != nil {
 		return err
 	}
 
-	defer f.Close()
-	w := bufio.NewWriter(f)
+	var rendered bytes.Buffer
+	if err = template.Execute(&rendered, &pln); err != nil {
+		return err
+	}
+	// Catch templating problems now rather than when running the installer
+	if err = plan.Validate(rendered.Bytes()); err != nil {
+		return err
+	}
+
+	// When the plan goes to stdout, the instructions go to stderr so that the plan can be piped.
+	// A temporary copy is still needed to push the plan to the bootstrap node.
+	info := os.Stdout
+	if opts.PlanFile == "-" {
+		info = os.Stderr
+		if _, err = os.Stdout.Write(rendered.Bytes()); err != nil {
+			return err
+		}
+		if !opts.BootstrapNode {
+			return nil
+		}
+	}
 
-	if err = template.Execute(w, &pln); err != nil {
+	f, err := openPlanFile(opts.PlanFile)
+
+	if err != nil {
 		return err
 	}
 
-	w.Flush()
+	defer f.Close()
+	if opts.PlanFile == "-" {
+		defer os.Remove(f.Name())
+	}
+	if _, err = f.Write(rendered.Bytes()); err != nil {
+		return err
+	}
 
 	//scp plan file to bootstrap if requested
-	if opts.BootstrapNode {
-		boot := nodes.Boostrap[0]
+	bootPlanPath := ""
+	boot, hasBoot := bootstrapTarget(opts, nodes)
+	// Kismatic is only installed on a created node by the bootstrap commands
+	installed := opts.ExistingBootstrap != "" || (opts.BootstrapFile != "" && opts.InstallKismatic)
+	if opts.BootstrapNode && hasBoot {
 		planPath, _ := filepath.Abs(f.Name())
-		fmt.Println("Copying kismatic plan file to bootstrap node:", planPath)
-		root := os.Getenv("DO_KET_INSTALL_DIR")
-		if root == "" {
-			root = KET_INSTALL_DIR
+		logger.Infof("Copying kismatic plan file to bootstrap node: %v\n", planPath)
+		root := ketInstallDir(opts)
+		// Without the bootstrap commands, the plan goes to the home directory of the SSH user
+		if opts.BootstrapFile == "" && opts.ExistingBootstrap == "" {
+			root = "."
 		}
-		if opts.BootstrapFile == "" {
-			root = ""
+		// The install directory of a created node is made by the bootstrap commands
+		if opts.ExistingBootstrap != "" {
+			if out, err := runOnNode(ctx, mkdirCommand(root, boot.SSHUser), boot.SSHUser, boot.PublicIPv4, opts.SSHPrivateKey, opts.SSHPort); err != nil {
+				return fmt.Errorf("Cannot create %s on the bootstrap node %s: %v: %s", root, boot.PublicIPv4, err, strings.TrimSpace(out))
+			}
 		}
 		destPath := root + "/kismatic-cluster.yaml"
-		out, scperr := scpFile(planPath, destPath, opts.SSHUser, boot.PublicIPv4, opts.SSHPrivateKey)
+		out, scperr := scpFile(ctx, planPath, destPath, opts.SSHUser, boot.PublicIPv4, opts.SSHPrivateKey, opts.SSHPort)
+		if scperr == nil && opts.VerifyCopy {
+			if verr := verifyRemoteFile(ctx, destPath, opts.SSHUser, boot.PublicIPv4, opts.SSHPrivateKey, opts.SSHPort); verr != nil {
+				return fmt.Errorf("The kismatic plan was copied to bootstrap node %s, but the copy could not be verified: %v", boot.PublicIPv4, verr)
+			}
+		}
 		if scperr != nil {
-			return fmt.Errorf("Unable to push kismatic plan to boostrap node: %v", scperr)
+			if opts.FailOnCopyError || ctx.Err() != nil {
+				return fmt.Errorf("Unable to push kismatic plan to bootstrap node: %v", scperr)
+			}
+			logger.Warnf("FAILED to copy plan to bootstrap node %s: %v\n", boot.PublicIPv4, scperr)
+			logger.Warnf("The plan is only available locally. Use --fail-on-copy-error to treat this as an error.\n")
+		} else {
+			logger.Debugf("Output: %v\n", out)
+			bootPlanPath = destPath
+		}
+		keyPath, keyerr := pushSSHKey(ctx, opts, boot)
+		if keyerr != nil {
+			if opts.FailOnCopyError || ctx.Err() != nil {
+				return fmt.Errorf("Unable to push the SSH key to bootstrap node: %v", keyerr)
+			}
+			logger.Warnf("FAILED to copy the SSH key to bootstrap node %s: %v\n", boot.PublicIPv4, keyerr)
+			logger.Warnf("Copy %s to %s on the bootstrap node before running kismatic.\n", opts.SSHPrivateKey, bootstrapKeyPath(opts))
+		} else {
+			logger.Infof("SSH key copied to the bootstrap node: %v\n", keyPath)
 		}
-		fmt.Println("Output:", out)
 	}
-	fmt.Println("To install your cluster, run:")
-	fmt.Println("./kismatic install apply -f " + f.Name())
+	if bootPlanPath != "" && installed {
+		fmt.Fprintln(info, "To install your cluster, run:")
+		fmt.Fprintf(info, "ssh -i %s -p %d %s@%s\n", opts.SSHPrivateKey, opts.SSHPort, opts.SSHUser, boot.PublicIPv4)
+		fmt.Fprintf(info, "cd %s && ./kismatic install apply -f %s\n", ketInstallDir(opts), bootPlanPath)
+		return nil
+	}
+	if bootPlanPath != "" {
+		fmt.Fprintf(info, "The plan was copied to %s on the bootstrap node %s, which has no Kismatic. See digitalocean/scripts/bootinit.sh to install it.\n", bootPlanPath, boot.PublicIPv4)
+	}
+	if opts.PlanFile != "-" {
+		fmt.Fprintln(info, "To install your cluster, run:")
+		fmt.Fprintln(info, "./kismatic install apply -f "+f.Name())
+	}
 
 	return nil
 }
 
+// openPlanFile creates the file the plan is written to. By default a new file is created
+// in the current directory, "-" creates a temporary file.
+func openPlanFile(path string) (*os.File, error) {
+	switch path {
+	case "":
+		return makeUniqueFile(0)
+	case "-":
+		return ioutil.TempFile("", "kismatic-cluster")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create directory for the plan file: %v", err)
+	}
+	return os.Create(path)
+}
+
 func makeUniqueFile(count int) (*os.File, error) {
 	filename := "kismatic-cluster"
 	if count > 0 {
@@ -294,41 +1556,123 @@ func makeUniqueFile(count int) (*os.File, error) {
 	return makeUniqueFile(count + 1)
 }
 
-func printNodes(nodes *ProvisionedNodes) {
-	printRole("Etcd", &nodes.Etcd)
-	printRole("Master", &nodes.Master)
-	printRole("Worker", &nodes.Worker)
-	printRole("Bootstrap", &nodes.Boostrap)
-}
-
-func printRole(title string, nodes *[]plan.Node) {
-	fmt.Printf("%v:\n", title)
-	for _, node := range *nodes {
-		fmt.Printf("  %v (%v, %v)\n", node.ID, node.PublicIPv4, node.PrivateIPv4)
+// validateOutputFormat checks the format of the node listing. text is the former name of
+// the table format.
+func validateOutputFormat(format string) error {
+	if format != "table" && format != "text" && format != "json" {
+		return fmt.Errorf("%v is not a valid output format. Current options: table, json", format)
 	}
+	return nil
 }
 
-func generateAlphaNumericPassword() string {
-	attempts := 0
-	for {
-		reqs := &garbler.PasswordStrengthRequirements{
-			MinimumTotalLength: 16,
-			Uppercase:          rand.Intn(6),
-			Digits:             rand.Intn(6),
-			Punctuation:        -1, // disable punctuation
-		}
-		pass, err := garbler.NewPassword(reqs)
-		if err != nil {
-			return "weakpassword"
-		}
-		// validate that the library actually returned an alphanumeric password
-		re := regexp.MustCompile("^[a-zA-Z1-9]+$")
-		if re.MatchString(pass) {
-			return pass
+// printNodesTable prints the nodes as an aligned table, followed by the node count and their
+// estimated monthly cost. The cost is omitted when the price of a size is not known.
+func printNodesTable(out io.Writer, nodes *ProvisionedNodes, sizes []SizeConfig) {
+	prices := map[string]float64{}
+	for _, sz := range sizes {
+		prices[sz.Slug] = sz.PriceMonthly
+	}
+	groups := map[string][]plan.Node{
+		"etcd":      nodes.Etcd,
+		"master":    nodes.Master,
+		"worker":    nodes.Worker,
+		"ingress":   nodes.Ingress,
+		"bootstrap": nodes.Bootstrap,
+	}
+	ipv6 := false
+	for _, n := range nodes.allNodes() {
+		ipv6 = ipv6 || n.PublicIPv6 != ""
+	}
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
 		}
-		if attempts == 50 {
-			return "weakpassword"
+		return value
+	}
+
+	tw := tabwriter.NewWriter(out, 10, 4, 3, ' ', 0)
+	header := "ROLE\tNAME\tID\tPUBLIC IP\tPRIVATE IP\tREGION\tSIZE"
+	if ipv6 {
+		header = header + "\tPUBLIC IPV6"
+	}
+	fmt.Fprintln(tw, header)
+	count := 0
+	monthly := 0.0
+	priced := true
+	for _, role := range ROLES {
+		for _, n := range groups[role] {
+			row := fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%s\t%s", role, n.Host, n.ID, orDash(n.PublicIPv4), orDash(n.PrivateIPv4), orDash(n.Region), orDash(n.Size))
+			if ipv6 {
+				row = row + "\t" + orDash(n.PublicIPv6)
+			}
+			fmt.Fprintln(tw, row)
+			count++
+			price, ok := prices[n.Size]
+			priced = priced && ok
+			monthly += price
 		}
-		attempts++
 	}
+	tw.Flush()
+	if priced && count > 0 {
+		fmt.Fprintf(out, "Total: %d nodes, estimated $%.2f/month\n", count, monthly)
+	} else {
+		fmt.Fprintf(out, "Total: %d nodes\n", count)
+	}
+}
+
+// checkCost prints the estimated cost of the nodes to be created and fails if it exceeds
+// the monthly budget
+func checkCost(provisioner *doProvisioner, opts DOOpts, nodeCount NodeCount) error {
+	estimate, err := provisioner.EstimateCost(opts, nodeCount)
+	if err != nil {
+		return err
+	}
+	printCostEstimate(logger.Out, estimate)
+	if opts.MaxMonthlyCost > 0 && estimate.Monthly > opts.MaxMonthlyCost {
+		return fmt.Errorf("The estimated monthly cost of $%.2f exceeds the maximum of $%.2f", estimate.Monthly, opts.MaxMonthlyCost)
+	}
+	return nil
+}
+
+// printDryRun describes the infrastructure that would be created with the given options
+func printDryRun(opts DOOpts, nodeCount NodeCount) {
+	fmt.Println("Dry run: no infrastructure will be created.")
+	fmt.Printf("Region: %v\n", opts.Region)
+	fmt.Printf("Image: %v\n", opts.Image)
+	fmt.Printf("Tag: %v\n", opts.ClusterTag)
+	if opts.DropletClass != "" {
+		fmt.Printf("Droplet class: %v (the size is picked with an API token)\n", opts.DropletClass)
+	}
+	fmt.Printf("Etcd nodes: %d (%v)\n", nodeCount.Etcd, sizeForRole(&opts, "etcd"))
+	fmt.Printf("Master nodes: %d (%v)\n", nodeCount.Master, sizeForRole(&opts, "master"))
+	fmt.Printf("Worker nodes: %d (%v)\n", nodeCount.Worker, sizeForRole(&opts, "worker"))
+	fmt.Printf("Ingress nodes: %d (%v)\n", nodeCount.Ingress, sizeForRole(&opts, "ingress"))
+	fmt.Printf("Bootstrap nodes: %d (%v)\n", nodeCount.Bootstrap, sizeForRole(&opts, "bootstrap"))
+	fmt.Printf("SSH private key: %v\n", opts.SSHPrivateKey)
+	fmt.Printf("SSH public key: %v\n", opts.SSHPublicKey)
+	if opts.NoPlan {
+		fmt.Println("Plan file: will not be generated")
+	} else {
+		fmt.Println("Plan file: will be generated")
+	}
+}
+
+// sizesForTable returns the sizes priced in the node table. The table is printed without the
+// cost when they cannot be listed.
+func (p doProvisioner) sizesForTable(opts DOOpts) []SizeConfig {
+	sizes, err := p.client.ListSizes(opts.Token)
+	if err != nil {
+		logger.Debugf("Cannot list the sizes for the cost of the nodes: %v\n", err)
+		return nil
+	}
+	return sizes
+}
+
+func printNodesJSON(out io.Writer, nodes *ProvisionedNodes) error {
+	b, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Cannot marshal nodes to JSON: %v", err)
+	}
+	fmt.Fprintln(out, string(b))
+	return nil
 }
@@ -0,0 +1,51 @@
+package digitalocean
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DNS_RECORD_TTL is the TTL in seconds of the DNS record created for the master
+const DNS_RECORD_TTL = 300
+
+// dnsLabelPattern matches a single label of a DNS name
+var dnsLabelPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// validateDNSName checks that every label of the name is a valid lowercase DNS label
+func validateDNSName(name string, what string) error {
+	if len(name) > 253 {
+		return fmt.Errorf("The %s %q is longer than 253 characters", what, name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !dnsLabelPattern.MatchString(label) {
+			return fmt.Errorf("The %s %q is not valid: each label must be 1 to 63 lowercase letters, digits or hyphens, and cannot start or end with a hyphen", what, name)
+		}
+	}
+	return nil
+}
+
+// validateDNSOptions checks that the domain and the record are given together and are valid
+func validateDNSOptions(opts DOOpts) error {
+	if opts.DNSDomain == "" && opts.DNSRecord == "" {
+		return nil
+	}
+	if opts.DNSDomain == "" || opts.DNSRecord == "" {
+		return fmt.Errorf("The --dns-domain and --dns-record options must be used together")
+	}
+	if err := validateDNSName(opts.DNSDomain, "DNS domain"); err != nil {
+		return err
+	}
+	if !strings.Contains(opts.DNSDomain, ".") {
+		return fmt.Errorf("The DNS domain %q must have at least two labels, e.g. example.com", opts.DNSDomain)
+	}
+	if err := validateDNSName(opts.DNSRecord, "DNS record"); err != nil {
+		return err
+	}
+	return validateDNSName(dnsRecordFQDN(opts), "DNS name")
+}
+
+// dnsRecordFQDN returns the fully qualified name of the DNS record of the master
+func dnsRecordFQDN(opts DOOpts) string {
+	return opts.DNSRecord + "." + opts.DNSDomain
+}
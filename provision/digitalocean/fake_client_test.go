@@ -0,0 +1,413 @@
+package digitalocean
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// fakeClient is an in-memory DOClient. Setting createFailures makes the creation of the
+// droplets with those names fail.
+type fakeClient struct {
+	mu             sync.Mutex
+	nextID         int
+	droplets       map[int]Droplet
+	volumes        map[string]AttachedVolume
+	keys           []KeyConfig
+	deletedTags    []string
+	firewalls      []FirewallConfig
+	loadBalancers  []LoadBalancerConfig
+	createFailures map[string]bool
+	dropletLimit   int
+}
+
+var _ DOClient = &fakeClient{}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		nextID:         1,
+		droplets:       map[int]Droplet{},
+		volumes:        map[string]AttachedVolume{},
+		createFailures: map[string]bool{},
+		dropletLimit:   25,
+	}
+}
+
+func (f *fakeClient) GetDroplet(token string, dropletID int) (Droplet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.droplets[dropletID]
+	if !ok {
+		return Droplet{}, fmt.Errorf("droplet %d not found", dropletID)
+	}
+	return d, nil
+}
+
+func (f *fakeClient) ListDropletsByTag(token string, tag string) ([]Droplet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	droplets := []Droplet{}
+	for id := 1; id < f.nextID; id++ {
+		if d, ok := f.droplets[id]; ok && hasAllTags(d, []string{tag}) {
+			droplets = append(droplets, d)
+		}
+	}
+	return droplets, nil
+}
+
+func (f *fakeClient) CreateNode(token string, config NodeConfig, keyconfig KeyConfig) (Droplet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.createFailures[config.Name] {
+		return Droplet{}, fmt.Errorf("cannot create droplet %s", config.Name)
+	}
+	id := f.nextID
+	f.nextID++
+	d := Droplet{
+		ID:        id,
+		Name:      config.Name,
+		PublicIP:  fmt.Sprintf("203.0.113.%d", id),
+		PrivateIP: fmt.Sprintf("10.0.0.%d", id),
+		Region:    config.Region,
+		Size:      config.Size,
+		Image:     config.Image,
+		Status:    "active",
+		Tags:      config.Tags,
+		Created:   time.Now(),
+	}
+	f.droplets[id] = d
+	return Droplet{ID: d.ID, Name: d.Name}, nil
+}
+
+func (f *fakeClient) DeleteDroplet(token string, dropletID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.droplets, dropletID)
+	return nil
+}
+
+func (f *fakeClient) DeleteDropletsByTag(token string, tag string, keyname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, d := range f.droplets {
+		if hasAllTags(d, []string{tag}) {
+			delete(f.droplets, id)
+		}
+	}
+	return nil
+}
+
+func (f *fakeClient) DeleteTag(token string, tag string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deletedTags = append(f.deletedTags, tag)
+	return nil
+}
+
+func (f *fakeClient) TagDroplets(token string, tag string, dropletIDs []int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, id := range dropletIDs {
+		d, ok := f.droplets[id]
+		if !ok {
+			return fmt.Errorf("droplet %d not found", id)
+		}
+		if !hasAllTags(d, []string{tag}) {
+			d.Tags = append(d.Tags, tag)
+			f.droplets[id] = d
+		}
+	}
+	return nil
+}
+
+func (f *fakeClient) GetVPCRegion(token string, vpcID string) (string, error) {
+	return "", fmt.Errorf("VPC %s not found", vpcID)
+}
+
+func (f *fakeClient) CreateVolume(token string, config VolumeConfig) (VolumeConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	config.ID = fmt.Sprintf("vol-%d", len(f.volumes)+1)
+	f.volumes[config.ID] = AttachedVolume{VolumeConfig: config}
+	return config, nil
+}
+
+func (f *fakeClient) AttachVolume(token string, volumeID string, dropletID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vol := f.volumes[volumeID]
+	vol.DropletIDs = append(vol.DropletIDs, dropletID)
+	f.volumes[volumeID] = vol
+	return nil
+}
+
+func (f *fakeClient) ListVolumesByTag(token string, tag string) ([]AttachedVolume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	volumes := []AttachedVolume{}
+	for _, vol := range f.volumes {
+		for _, t := range vol.Tags {
+			if t == tag {
+				volumes = append(volumes, vol)
+				break
+			}
+		}
+	}
+	return volumes, nil
+}
+
+func (f *fakeClient) GetVolume(token string, volumeID string) (AttachedVolume, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vol, ok := f.volumes[volumeID]
+	if !ok {
+		return vol, fmt.Errorf("volume %s not found", volumeID)
+	}
+	return vol, nil
+}
+
+func (f *fakeClient) DetachVolume(token string, volumeID string, dropletID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vol := f.volumes[volumeID]
+	vol.DropletIDs = nil
+	f.volumes[volumeID] = vol
+	return nil
+}
+
+func (f *fakeClient) DeleteVolume(token string, volumeID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.volumes, volumeID)
+	return nil
+}
+
+func (f *fakeClient) CreateFirewall(token string, config FirewallConfig) (FirewallConfig, error) {
+	config.ID = "fw-1"
+	config.TagSources = config.Tags
+	return config, nil
+}
+
+func (f *fakeClient) ListFirewallsByTag(token string, tag string) ([]FirewallConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	firewalls := []FirewallConfig{}
+	for _, fw := range f.firewalls {
+		for _, t := range fw.Tags {
+			if t == tag {
+				firewalls = append(firewalls, fw)
+				break
+			}
+		}
+	}
+	return firewalls, nil
+}
+
+func (f *fakeClient) FindFirewallByName(token string, name string) (FirewallConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fw := range f.firewalls {
+		if fw.Name == name {
+			return fw, nil
+		}
+	}
+	return FirewallConfig{}, nil
+}
+
+func (f *fakeClient) AddFirewallTags(token string, firewallID string, tags []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, fw := range f.firewalls {
+		if fw.ID == firewallID {
+			f.firewalls[i].Tags = append(append([]string{}, fw.Tags...), tags...)
+			return nil
+		}
+	}
+	return fmt.Errorf("firewall %s not found", firewallID)
+}
+
+func (f *fakeClient) RemoveFirewallTags(token string, firewallID string, tags []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, fw := range f.firewalls {
+		if fw.ID == firewallID {
+			removed := map[string]bool{}
+			for _, t := range tags {
+				removed[t] = true
+			}
+			kept := []string{}
+			for _, t := range fw.Tags {
+				if !removed[t] {
+					kept = append(kept, t)
+				}
+			}
+			f.firewalls[i].Tags = kept
+			return nil
+		}
+	}
+	return fmt.Errorf("firewall %s not found", firewallID)
+}
+
+func (f *fakeClient) AllowLoadBalancer(token string, firewallID string, lbID string, port int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, fw := range f.firewalls {
+		if fw.ID == firewallID {
+			f.firewalls[i].LoadBalancerSources = append(append([]string{}, fw.LoadBalancerSources...), lbID)
+			return nil
+		}
+	}
+	return fmt.Errorf("firewall %s not found", firewallID)
+}
+
+func (f *fakeClient) DeleteFirewall(token string, firewallID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	kept := []FirewallConfig{}
+	for _, fw := range f.firewalls {
+		if fw.ID != firewallID {
+			kept = append(kept, fw)
+		}
+	}
+	f.firewalls = kept
+	return nil
+}
+
+func (f *fakeClient) CreateLoadBalancer(token string, config LoadBalancerConfig) (LoadBalancerConfig, error) {
+	config.ID = "lb-1"
+	return config, nil
+}
+
+func (f *fakeClient) GetLoadBalancer(token string, lbID string) (LoadBalancerConfig, error) {
+	return LoadBalancerConfig{ID: lbID, Status: "active", IP: "198.51.100.1"}, nil
+}
+
+func (f *fakeClient) FindLoadBalancersByName(token string, name string) ([]LoadBalancerConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lbs := []LoadBalancerConfig{}
+	for _, lb := range f.loadBalancers {
+		if lb.Name == name {
+			lbs = append(lbs, lb)
+		}
+	}
+	return lbs, nil
+}
+
+func (f *fakeClient) AddLoadBalancerDroplets(token string, lbID string, dropletIDs []int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, lb := range f.loadBalancers {
+		if lb.ID == lbID {
+			f.loadBalancers[i].DropletIDs = append(append([]int{}, lb.DropletIDs...), dropletIDs...)
+			return nil
+		}
+	}
+	return fmt.Errorf("load balancer %s not found", lbID)
+}
+
+func (f *fakeClient) DeleteLoadBalancer(token string, lbID string) error {
+	return nil
+}
+
+func (f *fakeClient) ReserveFloatingIP(token string, region string) (FloatingIPConfig, error) {
+	return FloatingIPConfig{IP: "198.51.100.2", Region: region}, nil
+}
+
+func (f *fakeClient) AssignFloatingIP(token string, ip string, dropletID int) error {
+	return nil
+}
+
+func (f *fakeClient) UnassignFloatingIP(token string, ip string) error {
+	return nil
+}
+
+func (f *fakeClient) ReleaseFloatingIP(token string, ip string) error {
+	return nil
+}
+
+func (f *fakeClient) ListFloatingIPsByTag(token string, tag string) ([]FloatingIPConfig, error) {
+	return nil, nil
+}
+
+func (f *fakeClient) DomainExists(token string, domain string) (bool, error) {
+	return true, nil
+}
+
+func (f *fakeClient) ListDNSRecords(token string, domain string, name string) ([]DNSRecordConfig, error) {
+	return nil, nil
+}
+
+func (f *fakeClient) CreateDNSRecord(token string, config DNSRecordConfig) (DNSRecordConfig, error) {
+	config.ID = 1
+	return config, nil
+}
+
+func (f *fakeClient) DeleteDNSRecord(token string, domain string, recordID int) error {
+	return nil
+}
+
+func (f *fakeClient) FindImage(token string, image string) (ImageConfig, error) {
+	return ImageConfig{ID: 1, Slug: image, Name: image, Regions: []string{"tor1"}}, nil
+}
+
+func (f *fakeClient) ListImages(token string) ([]ImageConfig, error) {
+	return nil, nil
+}
+
+func (f *fakeClient) ListSizes(token string) ([]SizeConfig, error) {
+	return []SizeConfig{{Slug: "s-1vcpu-1gb", Regions: []string{"tor1"}, Available: true, PriceHourly: 0.00744, PriceMonthly: 5}}, nil
+}
+
+func (f *fakeClient) GetAccountLimits(token string) (AccountLimits, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return AccountLimits{DropletLimit: f.dropletLimit, DropletCount: len(f.droplets)}, nil
+}
+
+func (f *fakeClient) ListRegions(token string) ([]RegionConfig, error) {
+	return []RegionConfig{{Slug: "tor1", Available: true, Features: []string{REGION_FEATURE_STORAGE, REGION_FEATURE_PRIVATE_NETWORKING}}}, nil
+}
+
+func (f *fakeClient) CreateKey(token string, config KeyConfig) (KeyConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	config.ID = len(f.keys) + 1
+	config.Fingerprint = fmt.Sprintf("fingerprint-%d", config.ID)
+	f.keys = append(f.keys, config)
+	return config, nil
+}
+
+func (f *fakeClient) FindKeyByFingerprint(token string, fingerprint string) (KeyConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, k := range f.keys {
+		if k.Fingerprint == fingerprint {
+			return k, nil
+		}
+	}
+	return KeyConfig{}, nil
+}
+
+func (f *fakeClient) FindKeyByName(token string, keyName string) (KeyConfig, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, k := range f.keys {
+		if k.Name == keyName {
+			return k, nil
+		}
+	}
+	return KeyConfig{}, nil
+}
+
+func (f *fakeClient) DeleteKeyByName(token string, keyName string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, k := range f.keys {
+		if k.Name == keyName {
+			f.keys = append(f.keys[:i], f.keys[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
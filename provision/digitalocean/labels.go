@@ -0,0 +1,98 @@
+package digitalocean
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/apprenda/kismatic-provision/provision/plan"
+)
+
+// Kubernetes label keys have an optional DNS prefix, and the names and values are limited
+// to alphanumerics, dashes, underscores and dots
+var (
+	labelKeyPattern   = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]*[a-z0-9])?/)?[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+	labelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?)?$`)
+)
+
+var taintEffects = []string{"NoSchedule", "PreferNoSchedule", "NoExecute"}
+
+// parseLabels converts the key=value labels to a map. A label without a value, such as
+// node-role.kubernetes.io/worker, has an empty value.
+func parseLabels(labels []string) (map[string]string, error) {
+	parsed := map[string]string{}
+	for _, l := range labels {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		key, value := parts[0], ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		if !labelKeyPattern.MatchString(key) || len(key[strings.LastIndex(key, "/")+1:]) > 63 {
+			return nil, fmt.Errorf("%q is not a valid label key", key)
+		}
+		if !labelValuePattern.MatchString(value) || len(value) > 63 {
+			return nil, fmt.Errorf("%q is not a valid value for the label %s", value, key)
+		}
+		parsed[key] = value
+	}
+	if len(parsed) == 0 {
+		return nil, nil
+	}
+	return parsed, nil
+}
+
+// parseTaints converts the key=value:Effect or key:Effect taints
+func parseTaints(taints []string) ([]plan.Taint, error) {
+	parsed := []plan.Taint{}
+	for _, t := range taints {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		i := strings.LastIndex(t, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("Taint %q has no effect. Use key=value:Effect, with the effect one of %s", t, strings.Join(taintEffects, ", "))
+		}
+		taint := plan.Taint{Effect: t[i+1:]}
+		valid := false
+		for _, e := range taintEffects {
+			if taint.Effect == e {
+				valid = true
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("%q is not a valid taint effect. Current options: %s", taint.Effect, strings.Join(taintEffects, ", "))
+		}
+		parts := strings.SplitN(t[:i], "=", 2)
+		taint.Key = parts[0]
+		if len(parts) == 2 {
+			taint.Value = parts[1]
+		}
+		if !labelKeyPattern.MatchString(taint.Key) {
+			return nil, fmt.Errorf("%q is not a valid taint key", taint.Key)
+		}
+		if !labelValuePattern.MatchString(taint.Value) || len(taint.Value) > 63 {
+			return nil, fmt.Errorf("%q is not a valid value for the taint %s", taint.Value, taint.Key)
+		}
+		parsed = append(parsed, taint)
+	}
+	if len(parsed) == 0 {
+		return nil, nil
+	}
+	return parsed, nil
+}
+
+// withLabels returns a copy of the nodes with the labels and taints
+func withLabels(nodes []plan.Node, labels map[string]string, taints []plan.Taint) []plan.Node {
+	out := []plan.Node{}
+	for _, n := range nodes {
+		n.Labels = labels
+		n.Taints = taints
+		out = append(out, n)
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package digitalocean
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func DOListCmd() *cobra.Command {
+	opts := DOOpts{}
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "Lists the nodes of a cluster",
+		Long:  `Lists the droplets with the given tag, with their role, region, size, IPs and status.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			return listNodes(opts)
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.ClusterTag, "tag", "", "apprenda", "TAG of the cluster to list the nodes of")
+	cmd.Flags().StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+	cmd.Flags().StringVarP(&opts.OutputFormat, "output", "o", "table", "Format of the node listing. Current options: table, json")
+
+	return cmd
+}
+
+func listNodes(opts DOOpts) error {
+	if err := validateOutputFormat(opts.OutputFormat); err != nil {
+		return err
+	}
+	if err := resolveToken(&opts); err != nil {
+		return err
+	}
+
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	droplets, err := provisioner.client.ListDropletsByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return err
+	}
+	if opts.OutputFormat == "json" {
+		nodes := nodesByRole(droplets, opts)
+		return printNodesJSON(os.Stdout, &nodes)
+	}
+	printDroplets(os.Stdout, droplets, opts.ClusterTag)
+	return nil
+}
+
+// dropletRole returns the role of the droplet from its metadata tag, then from its cluster
+// role tag. Droplets created before the role tags were introduced get their role from their name.
+func dropletRole(drop Droplet, clusterTag string) string {
+	if role := dropletMetadata(drop, ROLE_TAG_KEY); role != "" {
+		return role
+	}
+	for _, role := range ROLES {
+		for _, t := range drop.Tags {
+			if t == roleTag(clusterTag, role) {
+				return role
+			}
+		}
+	}
+	role, _ := parseNodeName(drop.Name)
+	return role
+}
+
+func printDroplets(out io.Writer, droplets []Droplet, clusterTag string) {
+	tw := tabwriter.NewWriter(out, 10, 4, 3, ' ', 0)
+	fmt.Fprint(tw, "ID\tNAME\tROLE\tKISMATIC\tREGION\tSIZE\tPUBLIC IP\tPRIVATE IP\tSTATUS\n")
+	for _, d := range droplets {
+		version := dropletMetadata(d, VERSION_TAG_KEY)
+		if version == "" {
+			version = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.ID, d.Name, dropletRole(d, clusterTag), version, d.Region, d.Size, d.PublicIP, d.PrivateIP, d.Status)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,96 @@
+package digitalocean
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LogLevel is the importance of a message. Messages below the level of the logger are discarded.
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var logLevelNames = map[string]LogLevel{
+	"debug": LOG_DEBUG,
+	"info":  LOG_INFO,
+	"warn":  LOG_WARN,
+	"error": LOG_ERROR,
+}
+
+// Logger writes the debug and info messages to Out, and the warnings and errors to Err.
+// Secrets must never be logged above the debug level.
+type Logger struct {
+	mu    sync.Mutex
+	Level LogLevel
+	Out   io.Writer
+	Err   io.Writer
+}
+
+var logger = &Logger{Level: LOG_INFO, Out: os.Stdout, Err: os.Stderr}
+
+func parseLogLevel(level string) (LogLevel, error) {
+	if l, ok := logLevelNames[strings.ToLower(level)]; ok {
+		return l, nil
+	}
+	return LOG_INFO, fmt.Errorf("%v is not a valid log level. Current options: debug, info, warn, error", level)
+}
+
+// configureLogger sets the level of the package logger. Quiet only lets warnings and errors through.
+func configureLogger(level string, quiet bool) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if quiet && l < LOG_WARN {
+		l = LOG_WARN
+	}
+	logger.mu.Lock()
+	logger.Level = l
+	logger.mu.Unlock()
+	return nil
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.Level {
+		return
+	}
+	out := l.Out
+	if level >= LOG_WARN {
+		out = l.Err
+	}
+	fmt.Fprintf(out, format, args...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LOG_DEBUG, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LOG_INFO, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LOG_WARN, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LOG_ERROR, format, args...)
+}
+
+// redact hides all but the last characters of a secret, for debug messages
+func redact(secret string) string {
+	if len(secret) <= 4 {
+		return strings.Repeat("*", len(secret))
+	}
+	return strings.Repeat("*", len(secret)-4) + secret[len(secret)-4:]
+}
@@ -0,0 +1,147 @@
+package digitalocean
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+
+	garbler "github.com/michaelbironneau/garbler/lib"
+)
+
+const (
+	PASSWORD_LOWERCASE = "abcdefghijklmnopqrstuvwxyz"
+	PASSWORD_UPPERCASE = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	PASSWORD_DIGITS    = "0123456789"
+	// The shortest admin password generated with --password-length
+	MIN_PASSWORD_LENGTH = 12
+)
+
+// validatePasswordLength checks the length of the generated admin password. A zero length
+// is replaced by the default.
+func validatePasswordLength(opts DOOpts) error {
+	if opts.AdminPassword == "" && opts.PasswordLength != 0 && opts.PasswordLength < MIN_PASSWORD_LENGTH {
+		return fmt.Errorf("The admin password must be at least %d characters long, --password-length is %d", MIN_PASSWORD_LENGTH, opts.PasswordLength)
+	}
+	return nil
+}
+
+// generateAlphaNumericPassword returns a random alphanumeric password of the given
+// length, with at least the given number of digits and uppercase letters. A negative
+// number of digits or uppercase letters picks a random minimum between 0 and 5.
+func generateAlphaNumericPassword(length, digits, uppercase int) (string, error) {
+	var err error
+	if uppercase < 0 {
+		if uppercase, err = randomInt(6); err != nil {
+			return "", err
+		}
+	}
+	if digits < 0 {
+		if digits, err = randomInt(6); err != nil {
+			return "", err
+		}
+	}
+	return generatePassword(&garbler.PasswordStrengthRequirements{
+		MinimumTotalLength: length,
+		MaximumTotalLength: length,
+		Uppercase:          uppercase,
+		Digits:             digits,
+		Punctuation:        -1, // disable punctuation
+	})
+}
+
+// generatePassword returns an alphanumeric password that meets the requirements,
+// using crypto/rand as the source of entropy. A negative number of uppercase
+// letters or digits excludes them from the password.
+func generatePassword(reqs *garbler.PasswordStrengthRequirements) (string, error) {
+	if reqs.Punctuation > 0 {
+		return "", fmt.Errorf("Punctuation is not allowed in an alphanumeric password")
+	}
+	alphabet := PASSWORD_LOWERCASE
+	if reqs.Uppercase >= 0 {
+		alphabet += PASSWORD_UPPERCASE
+	}
+	if reqs.Digits >= 0 {
+		alphabet += PASSWORD_DIGITS
+	}
+	required := 0
+	if reqs.Uppercase > 0 {
+		required += reqs.Uppercase
+	}
+	if reqs.Digits > 0 {
+		required += reqs.Digits
+	}
+	length := reqs.MinimumTotalLength
+	if length < required {
+		length = required
+	}
+	if length <= 0 {
+		return "", fmt.Errorf("The password length must be greater than 0")
+	}
+	if reqs.MaximumTotalLength > 0 && length > reqs.MaximumTotalLength {
+		return "", fmt.Errorf("A password with %d uppercase letters and %d digits cannot be at most %d characters long", reqs.Uppercase, reqs.Digits, reqs.MaximumTotalLength)
+	}
+
+	pass := make([]byte, 0, length)
+	for i := 0; i < reqs.Uppercase; i++ {
+		c, err := randomChar(PASSWORD_UPPERCASE)
+		if err != nil {
+			return "", err
+		}
+		pass = append(pass, c)
+	}
+	for i := 0; i < reqs.Digits; i++ {
+		c, err := randomChar(PASSWORD_DIGITS)
+		if err != nil {
+			return "", err
+		}
+		pass = append(pass, c)
+	}
+	for len(pass) < length {
+		c, err := randomChar(alphabet)
+		if err != nil {
+			return "", err
+		}
+		pass = append(pass, c)
+	}
+	// shuffle, so that the required characters are not always at the start
+	for i := len(pass) - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return "", err
+		}
+		pass[i], pass[j] = pass[j], pass[i]
+	}
+	return string(pass), nil
+}
+
+func randomChar(alphabet string) (byte, error) {
+	i, err := randomInt(len(alphabet))
+	if err != nil {
+		return 0, err
+	}
+	return alphabet[i], nil
+}
+
+// randomInt returns a uniformly distributed random number in [0, max)
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, fmt.Errorf("Unable to read random data: %v", err)
+	}
+	return int(n.Int64()), nil
+}
+
+// writePasswordFile writes the admin password to the given file, making sure
+// that only the current user can read it
+func writePasswordFile(path, password string) error {
+	if err := ioutil.WriteFile(path, []byte(password+"\n"), 0600); err != nil {
+		return fmt.Errorf("Unable to write password file %q: %v", path, err)
+	}
+	// WriteFile does not change the permissions of an existing file
+	if err := os.Chmod(path, 0600); err != nil {
+		return fmt.Errorf("Unable to set permissions of password file %q: %v", path, err)
+	}
+	return nil
+}
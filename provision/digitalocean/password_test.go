@@ -0,0 +1,113 @@
+package digitalocean
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	garbler "github.com/michaelbironneau/garbler/lib"
+)
+
+var alphaNumeric = regexp.MustCompile("^[a-zA-Z0-9]+$")
+
+func TestGenerateAlphaNumericPassword(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		pass, err := generateAlphaNumericPassword(16, -1, -1)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(pass) < 16 {
+			t.Errorf("password %q is shorter than 16 characters", pass)
+		}
+		if !alphaNumeric.MatchString(pass) {
+			t.Errorf("password %q is not alphanumeric", pass)
+		}
+	}
+}
+
+func TestGenerateAlphaNumericPasswordLength(t *testing.T) {
+	pass, err := generateAlphaNumericPassword(20, 3, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pass) != 20 {
+		t.Errorf("expected a password of 20 characters, got %q", pass)
+	}
+	if _, err := generateAlphaNumericPassword(8, 5, 5); err == nil {
+		t.Errorf("expected an error when the minimum counts exceed the length")
+	}
+}
+
+func TestValidatePasswordLength(t *testing.T) {
+	tests := []struct {
+		opts  DOOpts
+		valid bool
+	}{
+		{DOOpts{PasswordLength: 16}, true},
+		{DOOpts{PasswordLength: MIN_PASSWORD_LENGTH}, true},
+		{DOOpts{PasswordLength: 0}, true},
+		{DOOpts{PasswordLength: 4}, false},
+		{DOOpts{PasswordLength: -1}, false},
+		// the length does not apply to a given password
+		{DOOpts{PasswordLength: 4, AdminPassword: "secret"}, true},
+	}
+	for _, test := range tests {
+		err := validatePasswordLength(test.opts)
+		if test.valid && err != nil {
+			t.Errorf("unexpected error for %+v: %v", test.opts, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("expected an error for --password-length %d", test.opts.PasswordLength)
+		}
+	}
+}
+
+func TestGeneratePasswordMeetsRequirements(t *testing.T) {
+	reqs := &garbler.PasswordStrengthRequirements{
+		MinimumTotalLength: 20,
+		Uppercase:          5,
+		Digits:             4,
+		Punctuation:        -1,
+	}
+	for i := 0; i < 100; i++ {
+		pass, err := generatePassword(reqs)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(pass) != 20 {
+			t.Errorf("expected a password of 20 characters, got %q", pass)
+		}
+		if !alphaNumeric.MatchString(pass) {
+			t.Errorf("password %q is not alphanumeric", pass)
+		}
+		if n := countAny(pass, PASSWORD_UPPERCASE); n < 5 {
+			t.Errorf("expected at least 5 uppercase letters in %q, got %d", pass, n)
+		}
+		if n := countAny(pass, PASSWORD_DIGITS); n < 4 {
+			t.Errorf("expected at least 4 digits in %q, got %d", pass, n)
+		}
+	}
+}
+
+func TestGeneratePasswordRequirementsCannotBeMet(t *testing.T) {
+	tests := []garbler.PasswordStrengthRequirements{
+		{MinimumTotalLength: 16, Punctuation: 2},
+		{MinimumTotalLength: 16, MaximumTotalLength: 16, Uppercase: 10, Digits: 10},
+		{MinimumTotalLength: 0},
+	}
+	for _, reqs := range tests {
+		if pass, err := generatePassword(&reqs); err == nil {
+			t.Errorf("expected an error for requirements %+v, got password %q", reqs, pass)
+		}
+	}
+}
+
+func countAny(s, chars string) int {
+	n := 0
+	for _, c := range s {
+		if strings.ContainsRune(chars, c) {
+			n++
+		}
+	}
+	return n
+}
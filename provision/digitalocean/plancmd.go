@@ -0,0 +1,96 @@
+package digitalocean
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apprenda/kismatic-provision/provision/plan"
+	"github.com/spf13/cobra"
+)
+
+func DOPlanCmd() *cobra.Command {
+	opts := DOOpts{}
+	cmd := &cobra.Command{
+		Use:   "plan",
+		Short: "Generates the plan file of an existing cluster",
+		Long: `Generates the kismatic plan file from the droplets with the given tag, without creating anything.
+The droplets are grouped by their role tag. The plan is rendered and validated as with create, and references
+the local SSH key. A new admin password is generated unless --admin-password is given.`,
+		Example: `# Regenerate the plan of the cluster tagged apprenda
+provision do plan --tag apprenda --plan-file kismatic-cluster.yaml`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			return planInfra(opts)
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.ClusterTag, "tag", "", "apprenda", "TAG of the cluster to generate the plan of")
+	cmd.Flags().StringVarP(&opts.PlanFile, "plan-file", "", "", "Path the plan file is written to, or - to write it to stdout. Defaults to a new kismatic-cluster.yaml file in the current directory")
+	cmd.Flags().StringVarP(&opts.PlanTemplate, "plan-template", "", "", "Path to a Go template of the plan file, rendered instead of the built-in template. --network-mode does not apply to it.")
+	cmd.Flags().StringVarP(&opts.NetworkMode, "network-mode", "", "overlay", "Calico networking mode of the plan: overlay or routed.")
+	cmd.Flags().StringVarP(&opts.PodCIDR, "pod-cidr", "", plan.DefaultPodCIDR, "Network the pods are assigned IPs from.")
+	cmd.Flags().StringVarP(&opts.ServiceCIDR, "service-cidr", "", plan.DefaultServiceCIDR, "Network the services are assigned IPs from. It cannot overlap the pod network.")
+	cmd.Flags().StringVarP(&opts.SSHUser, "sshuser", "", "root", "SSH User name the plan accesses the nodes with.")
+	cmd.Flags().StringVarP(&opts.SSHPrivateKey, "ssh-key", "", "", "Path to the SSH private key referenced by the plan. Defaults to $DO_SECRET_ACCESS_KEY or ssh/cluster.pem next to the executable.")
+	cmd.Flags().IntVarP(&opts.SSHPort, "ssh-port", "", 22, "Port on which sshd listens on the nodes.")
+	cmd.Flags().StringVarP(&opts.AdminPassword, "admin-password", "", "", "Admin password of the cluster. If not set, a random password is generated.")
+	cmd.Flags().StringVarP(&opts.AdminUsername, "admin-username", "", "", "Name of the admin user of the cluster in the plan. If not set, the Kismatic default admin user is used.")
+	cmd.Flags().BoolVarP(&opts.Storage, "storage-cluster", "", false, "Use all Worker nodes as the storage cluster in the plan.")
+	cmd.Flags().StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+
+	return cmd
+}
+
+// planInfra renders the plan of the droplets with the cluster tag. Nothing is created, and the
+// plan is not copied to a bootstrap node.
+func planInfra(opts DOOpts) error {
+	if err := validatePlanOptions(opts); err != nil {
+		return err
+	}
+	if err := resolveToken(&opts); err != nil {
+		return err
+	}
+	opts.SSHPrivateKey = privateKeyPath(opts)
+	if opts.PasswordLength == 0 {
+		opts.PasswordLength = 16
+		opts.PasswordMinDigits = -1
+		opts.PasswordUppercase = -1
+	}
+
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	droplets, err := provisioner.client.ListDropletsByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return err
+	}
+	if len(droplets) == 0 {
+		return fmt.Errorf("No nodes found with the tag %q", opts.ClusterTag)
+	}
+	nodes := nodesByRole(droplets, opts)
+	if len(nodes.Etcd) == 0 || len(nodes.Master) == 0 {
+		return fmt.Errorf("The cluster %s needs at least one etcd and one master node for a plan, found %d etcd and %d master nodes", opts.ClusterTag, len(nodes.Etcd), len(nodes.Master))
+	}
+	// The droplets of a cluster are all created with or without private networking
+	for _, n := range nodes.allNodes() {
+		if n.PrivateIPv4 == "" {
+			opts.NoPrivateNetworking = true
+		}
+	}
+	if opts.AdminPassword == "" {
+		password, err := generateAlphaNumericPassword(opts.PasswordLength, opts.PasswordMinDigits, opts.PasswordUppercase)
+		if err != nil {
+			return fmt.Errorf("Unable to generate the admin password: %v", err)
+		}
+		opts.AdminPassword = password
+	}
+
+	pln, err := newPlan(opts, nodes, "", "")
+	if err != nil {
+		return err
+	}
+	return makePlan(context.Background(), pln, opts, nodes)
+}
@@ -0,0 +1,65 @@
+package digitalocean
+
+import (
+	"sync"
+
+	"github.com/apprenda/kismatic-provision/provision/plan"
+)
+
+// The stages of provisioning reported to a ProgressFunc
+const (
+	PROGRESS_CREATED = "created"
+	PROGRESS_SSH     = "ssh"
+)
+
+// ProgressEvent reports that a node is ready in a stage of provisioning
+type ProgressEvent struct {
+	Stage string
+	Node  plan.Node
+	// Ready nodes out of the Total nodes of the stage, this one included
+	Ready int
+	Total int
+}
+
+// ProgressFunc is called as each node becomes ready. The calls are not concurrent.
+type ProgressFunc func(ProgressEvent)
+
+// logProgress is the default ProgressFunc. The events are logged at the info level, so that
+// --quiet hides them.
+func logProgress(e ProgressEvent) {
+	switch e.Stage {
+	case PROGRESS_CREATED:
+		logger.Infof("Created %s (%s) [%d/%d]\n", e.Node.Host, e.Node.PublicIPv4, e.Ready, e.Total)
+	case PROGRESS_SSH:
+		logger.Infof("SSH ready on %s (%s) [%d/%d]\n", e.Node.Host, e.Node.PublicIPv4, e.Ready, e.Total)
+	}
+}
+
+// progressCounter counts the nodes that are ready in a stage and reports each of them
+type progressCounter struct {
+	mu     sync.Mutex
+	stage  string
+	ready  int
+	total  int
+	report ProgressFunc
+}
+
+func newProgressCounter(stage string, total int, report ProgressFunc) *progressCounter {
+	if report == nil {
+		report = logProgress
+	}
+	return &progressCounter{stage: stage, total: total, report: report}
+}
+
+func (c *progressCounter) done(n plan.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ready++
+	c.report(ProgressEvent{Stage: c.stage, Node: n, Ready: c.ready, Total: c.total})
+}
+
+func (c *progressCounter) readyCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ready
+}
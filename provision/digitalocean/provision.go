@@ -1,20 +1,51 @@
 package digitalocean
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
 	"time"
 
 	"github.com/apprenda/kismatic-provision/provision/plan"
+	"github.com/apprenda/kismatic-provision/provision/retry"
 )
 
+// ROLES are the node roles, each of them has its own tag derived from the cluster tag
+var ROLES = []string{"etcd", "master", "worker", "ingress", "bootstrap"}
+
 const (
-	SSHKEY          = "apprenda-key"
 	KET_INSTALL_DIR = "/ket"
+	PUBLIC_IP_URL   = "https://api.ipify.org"
+	KUBE_API_PORT   = 6443
+	// The key shared by the clusters created before the key was named after the cluster tag
+	LEGACY_KEY_NAME   = "apprenda-key"
+	LB_ACTIVE_TIMEOUT = 10 * time.Minute
+	// The metadata tags make the droplets self-describing, without a state file
+	ROLE_TAG_KEY    = "kismatic-role"
+	VERSION_TAG_KEY = "kismatic-version"
+	// The etcd data is kept on a dedicated volume with --etcd-separate-disk
+	ETCD_DATA_DIR           = "/var/lib/etcd"
+	MIN_ETCD_VOLUME_SIZE_GB = 10
+	MAX_VOLUME_SIZE_GB      = 16384
+	// The Prometheus node exporter installed with --node-exporter
+	NODE_EXPORTER_PORT    = 9100
+	NODE_EXPORTER_VERSION = "1.6.1"
+	// The versions downloaded by scripts/bootinit.sh when --ket-version and --kubectl-version are not set
+	DEFAULT_KET_VERSION     = "v1.2.1"
+	DEFAULT_KUBECTL_VERSION = "latest stable release"
 )
 
 type infrastructureProvisioner interface {
@@ -30,21 +61,39 @@ type infrastructureProvisioner interface {
 type LinuxDistro string
 
 type NodeCount struct {
-	Etcd     uint16
-	Master   uint16
-	Worker   uint16
-	Boostrap uint16
+	Etcd      uint16
+	Master    uint16
+	Worker    uint16
+	Ingress   uint16
+	Bootstrap uint16
 }
 
 func (nc NodeCount) Total() uint16 {
-	return nc.Etcd + nc.Master + nc.Worker
+	return nc.Etcd + nc.Master + nc.Worker + nc.Ingress
+}
+
+// Boostrap returns the bootstrap node count.
+//
+// Deprecated: use the Bootstrap field. This forwarder is kept for callers of the misspelled
+// field and will be removed.
+func (nc NodeCount) Boostrap() uint16 {
+	return nc.Bootstrap
 }
 
 type ProvisionedNodes struct {
-	Etcd     []plan.Node
-	Master   []plan.Node
-	Worker   []plan.Node
-	Boostrap []plan.Node
+	Etcd      []plan.Node `json:"etcd"`
+	Master    []plan.Node `json:"master"`
+	Worker    []plan.Node `json:"worker"`
+	Ingress   []plan.Node `json:"ingress"`
+	Bootstrap []plan.Node `json:"bootstrap"`
+}
+
+// Boostrap returns the bootstrap nodes.
+//
+// Deprecated: use the Bootstrap field. This forwarder is kept for callers of the misspelled
+// field and will be removed.
+func (p ProvisionedNodes) Boostrap() []plan.Node {
+	return p.Bootstrap
 }
 
 func (p ProvisionedNodes) allNodes() []plan.Node {
@@ -52,10 +101,179 @@ func (p ProvisionedNodes) allNodes() []plan.Node {
 	n = append(n, p.Etcd...)
 	n = append(n, p.Master...)
 	n = append(n, p.Worker...)
-	n = append(n, p.Boostrap...)
+	n = append(n, p.Ingress...)
+	n = append(n, p.Bootstrap...)
 	return n
 }
 
+// byRole returns the nodes with the given role
+func (p ProvisionedNodes) byRole(role string) []plan.Node {
+	switch role {
+	case "etcd":
+		return p.Etcd
+	case "master":
+		return p.Master
+	case "worker":
+		return p.Worker
+	case "ingress":
+		return p.Ingress
+	case "bootstrap":
+		return p.Bootstrap
+	}
+	return nil
+}
+
+// merge returns the nodes of both sets, the nodes of p first
+func (p ProvisionedNodes) merge(other ProvisionedNodes) ProvisionedNodes {
+	return ProvisionedNodes{
+		Etcd:      append(append([]plan.Node{}, p.Etcd...), other.Etcd...),
+		Master:    append(append([]plan.Node{}, p.Master...), other.Master...),
+		Worker:    append(append([]plan.Node{}, p.Worker...), other.Worker...),
+		Ingress:   append(append([]plan.Node{}, p.Ingress...), other.Ingress...),
+		Bootstrap: append(append([]plan.Node{}, p.Bootstrap...), other.Bootstrap...),
+	}
+}
+
+// remainingNodeCount returns the number of nodes of each role that must be created
+// to reach the requested count
+func remainingNodeCount(requested NodeCount, existing ProvisionedNodes) NodeCount {
+	remaining := func(want uint16, have []plan.Node) uint16 {
+		if int(want) <= len(have) {
+			return 0
+		}
+		return want - uint16(len(have))
+	}
+	return NodeCount{
+		Etcd:      remaining(requested.Etcd, existing.Etcd),
+		Master:    remaining(requested.Master, existing.Master),
+		Worker:    remaining(requested.Worker, existing.Worker),
+		Ingress:   remaining(requested.Ingress, existing.Ingress),
+		Bootstrap: remaining(requested.Bootstrap, existing.Bootstrap),
+	}
+}
+
+// lastIndex returns the highest index in the names of the nodes
+func lastIndex(nodes []plan.Node) uint16 {
+	var last uint16
+	for _, n := range nodes {
+		if _, index := parseNodeName(n.Host); uint16(index) > last {
+			last = uint16(index)
+		}
+	}
+	return last
+}
+
+// withPublicInternalIPs returns a copy of the nodes that use their public IP as their
+// internal IP, since private networking does not span regions
+func (p ProvisionedNodes) withPublicInternalIPs() ProvisionedNodes {
+	public := func(nodes []plan.Node) []plan.Node {
+		out := []plan.Node{}
+		for _, n := range nodes {
+			n.PrivateIPv4 = n.PublicIPv4
+			out = append(out, n)
+		}
+		return out
+	}
+	return ProvisionedNodes{
+		Etcd:      public(p.Etcd),
+		Master:    public(p.Master),
+		Worker:    public(p.Worker),
+		Ingress:   public(p.Ingress),
+		Bootstrap: public(p.Bootstrap),
+	}
+}
+
+// sizeForRole returns the size of the nodes with the given role. The role specific
+// sizes default to the instance type.
+func sizeForRole(opts *DOOpts, role string) string {
+	switch {
+	case role == "etcd" && opts.EtcdType != "":
+		return opts.EtcdType
+	case role == "master" && opts.MasterType != "":
+		return opts.MasterType
+	case role == "bootstrap" && opts.BootstrapType != "":
+		return opts.BootstrapType
+	case role == "worker" && opts.WorkerType != "":
+		return opts.WorkerType
+	}
+	return opts.InstanceType
+}
+
+// regionsForRole returns the regions the nodes with the given role are spread across.
+// The role specific regions default to the cluster regions.
+func regionsForRole(opts *DOOpts, role string) []string {
+	regions := opts.Region
+	switch {
+	case role == "etcd" && opts.EtcdRegion != "":
+		regions = opts.EtcdRegion
+	case role == "master" && opts.MasterRegion != "":
+		regions = opts.MasterRegion
+	case role == "worker" && opts.WorkerRegion != "":
+		regions = opts.WorkerRegion
+	}
+	list := []string{}
+	for _, r := range strings.Split(regions, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// regionForNode places the nodes of a role round-robin across the role's regions
+func regionForNode(opts *DOOpts, role string, index uint16) string {
+	regions := regionsForRole(opts, role)
+	if len(regions) == 0 {
+		return ""
+	}
+	return regions[int(index)%len(regions)]
+}
+
+// allRegions returns the distinct regions used by the cluster
+func allRegions(opts *DOOpts) []string {
+	seen := map[string]bool{}
+	all := []string{}
+	for _, role := range ROLES {
+		for _, r := range regionsForRole(opts, role) {
+			if !seen[r] {
+				seen[r] = true
+				all = append(all, r)
+			}
+		}
+	}
+	return all
+}
+
+// usesPublicInternalIPs returns whether the nodes talk to each other over their public IPs,
+// either because private networking is disabled or because it does not span the regions
+func usesPublicInternalIPs(opts *DOOpts) bool {
+	return opts.NoPrivateNetworking || len(allRegions(opts)) > 1
+}
+
+// validateRegions rejects region-scoped features when the cluster spans several regions
+func validateRegions(opts *DOOpts) error {
+	all := allRegions(opts)
+	if len(all) == 0 {
+		return fmt.Errorf("At least one region must be provided")
+	}
+	if len(all) == 1 {
+		return nil
+	}
+	if opts.VolumeSizeGB > 0 && len(regionsForRole(opts, "worker")) > 1 {
+		return fmt.Errorf("Block storage volumes are region scoped and cannot be used with workers in several regions")
+	}
+	if opts.EtcdSeparateDisk && len(regionsForRole(opts, "etcd")) > 1 {
+		return fmt.Errorf("Block storage volumes are region scoped and cannot be used with etcd nodes in several regions")
+	}
+	if opts.VPCUUID != "" {
+		return fmt.Errorf("A VPC is region scoped and cannot be used with nodes in several regions (%s)", strings.Join(all, ", "))
+	}
+	if opts.CreateLB && len(regionsForRole(opts, "master")) > 1 {
+		return fmt.Errorf("A load balancer is region scoped and cannot be used with masters in several regions")
+	}
+	return nil
+}
+
 type sshMachineProvisioner struct {
 	sshKey string
 }
@@ -66,31 +284,162 @@ func (p sshMachineProvisioner) SSHKey() string {
 
 type doProvisioner struct {
 	sshMachineProvisioner
-	client *Client
+	client DOClient
+	state  *State
+}
+
+// newClient creates the client of the Digital Ocean API. It is replaced in tests.
+var newClient = func() (DOClient, error) {
+	return &Client{}, nil
 }
 
-func GetProvisioner() (*doProvisioner, bool) {
-	c := Client{}
-	p := doProvisioner{client: &c}
-	return &p, true
+func GetProvisioner() (*doProvisioner, error) {
+	client, err := newClient()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create the Digital Ocean client: %v", err)
+	}
+	return newProvisioner(client), nil
+}
+
+func newProvisioner(client DOClient) *doProvisioner {
+	return &doProvisioner{client: client, state: &State{}}
 }
 
 func dropletToNode(drop *Droplet, opts *DOOpts) plan.Node {
 	node := plan.Node{}
-	node.ID = string(drop.ID)
+	node.ID = strconv.Itoa(drop.ID)
 	node.Host = drop.Name
 	node.PublicIPv4 = drop.PublicIP
 	node.PrivateIPv4 = drop.PrivateIP
+	node.PublicIPv6 = drop.PublicIPv6
 	node.SSHUser = opts.SSHUser
+	node.Region = drop.Region
+	node.Size = drop.Size
 	return node
 }
 
-func optionsToConfig(opts *DOOpts, name string, sizeOverride string, userData string) NodeConfig {
+// roleTag returns the tag applied to the nodes of the cluster with the given role
+func roleTag(clusterTag, role string) string {
+	return fmt.Sprintf("%s-%s", clusterTag, role)
+}
+
+var tagValueCharacters = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// metadataTag returns the key:value tag recording the value on the droplets. The characters
+// not allowed in tags are replaced, e.g. v1.2.1 is recorded as v1_2_1.
+func metadataTag(key, value string) string {
+	return key + ":" + tagValueCharacters.ReplaceAllString(value, "_")
+}
+
+// dropletMetadata returns the value of the metadata tag of the droplet, or an empty
+// string for droplets created before the metadata tags were introduced
+func dropletMetadata(drop Droplet, key string) string {
+	for _, t := range drop.Tags {
+		if strings.HasPrefix(t, key+":") {
+			return strings.TrimPrefix(t, key+":")
+		}
+	}
+	return ""
+}
+
+// DigitalOcean tags may only contain letters, numbers, colons, dashes and underscores
+var tagPattern = regexp.MustCompile(`^[a-zA-Z0-9_\-:]+$`)
+
+// The SSH user is written into the cloud-config, only plain user names are accepted
+var sshUserPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// parseExtraTags converts the key=value tags to the key:value format accepted by DigitalOcean
+func parseExtraTags(tags []string) ([]string, error) {
+	parsed := []string{}
+	for _, t := range tags {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%q is not a valid tag. Tags must be in the key=value format", t)
+		}
+		tag := parts[0] + ":" + parts[1]
+		if !tagPattern.MatchString(tag) || len(tag) > 255 {
+			return nil, fmt.Errorf("%q is not a valid tag. Keys and values may only contain letters, numbers, colons, dashes and underscores", t)
+		}
+		parsed = append(parsed, tag)
+	}
+	return parsed, nil
+}
+
+// hasAllTags reports whether the droplet carries all the given tags
+func hasAllTags(drop Droplet, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range drop.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeName returns the DNS-safe name of the node with the given role and index,
+// e.g. apprenda-worker-1
+func nodeName(opts *DOOpts, role string, index uint16) string {
+	prefix := opts.NamePrefix
+	if prefix == "" {
+		prefix = opts.ClusterTag
+	}
+	return fmt.Sprintf("%s-%s-%d", dnsSafe(prefix), role, index)
+}
+
+// dnsSafe lowercases the name and replaces any character other than letters
+// and digits with a hyphen
+func dnsSafe(name string) string {
+	name = regexp.MustCompile("[^a-z0-9]+").ReplaceAllString(strings.ToLower(name), "-")
+	return strings.Trim(name, "-")
+}
+
+// isRole returns whether the role is one of ROLES
+func isRole(role string) bool {
+	for _, r := range ROLES {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNodeName returns the role and the index of a node from its name. Both
+// the <prefix>-<role>-<index> names and the older <role><index> names are
+// recognized. The role is empty if the name was not given by the provisioner.
+func parseNodeName(name string) (string, int) {
+	parts := strings.Split(name, "-")
+	if len(parts) >= 3 {
+		if index, err := strconv.Atoi(parts[len(parts)-1]); err == nil {
+			if role := parts[len(parts)-2]; isRole(role) {
+				return role, index
+			}
+		}
+	}
+	for _, role := range ROLES {
+		if strings.HasPrefix(name, role) {
+			index, _ := strconv.Atoi(strings.TrimPrefix(name, role))
+			return role, index
+		}
+	}
+	return "", 0
+}
+
+func optionsToConfig(opts *DOOpts, name string, role string, region string, sizeOverride string, userData string) NodeConfig {
 	config := NodeConfig{}
 	config.Image = opts.Image
 	config.Name = name
-	config.Region = opts.Region
-	config.PrivateNetworking = true
+	config.Region = region
+	config.PrivateNetworking = !opts.NoPrivateNetworking
+	config.IPv6 = opts.IPv6
+	config.Monitoring = opts.Monitoring
+	config.Backups = backupsForRole(opts, role)
+	config.VPCUUID = opts.VPCUUID
 	if sizeOverride != "" {
 		config.Size = sizeOverride
 	} else {
@@ -100,88 +449,189 @@ func optionsToConfig(opts *DOOpts, name string, sizeOverride string, userData st
 		config.UserData = userData
 	}
 
-	if opts.ClusterTag != "" {
-		config.Tags = append(config.Tags, opts.ClusterTag)
-	} else {
-		config.Tags = append(config.Tags, "apprenda")
+	clusterTag := opts.ClusterTag
+	if clusterTag == "" {
+		clusterTag = "apprenda"
+	}
+	config.Tags = append(config.Tags, clusterTag, roleTag(clusterTag, role))
+	config.Tags = append(config.Tags, metadataTag(ROLE_TAG_KEY, role))
+	if opts.KETVersion != "" {
+		config.Tags = append(config.Tags, metadataTag(VERSION_TAG_KEY, normalizeVersion(opts.KETVersion)))
 	}
+	config.Tags = append(config.Tags, opts.ExtraTags...)
 	return config
 }
 
-func (p doProvisioner) ProvisionNodes(opts DOOpts, nodeCount NodeCount) (ProvisionedNodes, error) {
+func (p doProvisioner) ProvisionNodes(ctx context.Context, opts DOOpts, nodeCount NodeCount) (ProvisionedNodes, error) {
 	provisioned := ProvisionedNodes{}
-	keyconf := KeyConfig{}
-	keyconf.Name = SSHKEY
-	keyconf.PublicKeyFile = opts.SSHPublicKey
-	existing, _ := p.client.FindKeyByName(opts.Token, keyconf.Name)
-	var key KeyConfig
-	var errkey error
-	if existing.Fingerprint != "" {
-		key = existing
-		fmt.Println("Using existing key", key)
-	} else {
-		fmt.Println("Creating new key")
-		key, errkey = p.client.CreateKey(opts.Token, keyconf)
+	if err := p.validateRegion(opts); err != nil {
+		return provisioned, err
 	}
-	if errkey != nil {
-		fmt.Println("Cannot create key", errkey)
-		return provisioned, errkey
+	if err := p.validateSizes(&opts); err != nil {
+		return provisioned, err
 	}
-
-	var dropletsETCD []Droplet
-	var i uint16
-	for i = 0; i < nodeCount.Etcd; i++ {
-		config := optionsToConfig(&opts, fmt.Sprintf("etcd%d", i+1), "", "")
-		drop, err := p.client.CreateNode(opts.Token, config, key)
+	if err := p.validateImage(opts, nodeCount); err != nil {
+		return provisioned, err
+	}
+	if err := p.validateDomain(opts); err != nil {
+		return provisioned, err
+	}
+	if opts.VPCUUID != "" {
+		region, err := p.client.GetVPCRegion(opts.Token, opts.VPCUUID)
 		if err != nil {
-			return provisioned, err
+			return provisioned, fmt.Errorf("Unable to find VPC %s: %v", opts.VPCUUID, err)
+		}
+		if expected := allRegions(&opts)[0]; region != expected {
+			return provisioned, fmt.Errorf("VPC %s is in region %s, not in the requested region %s", opts.VPCUUID, region, expected)
 		}
-		dropletsETCD = append(dropletsETCD, drop)
 	}
-	var dropletsMaster []Droplet
-	for i = 0; i < nodeCount.Master; i++ {
-		config := optionsToConfig(&opts, fmt.Sprintf("master%d", i+1), "", "")
-		drop, err := p.client.CreateNode(opts.Token, config, key)
-		if err != nil {
+	if !opts.ReuseTag {
+		if err := p.checkTagUnused(opts); err != nil {
 			return provisioned, err
 		}
-		dropletsMaster = append(dropletsMaster, drop)
 	}
-	var dropletsWorker []Droplet
-	for i = 0; i < nodeCount.Worker; i++ {
-		config := optionsToConfig(&opts, fmt.Sprintf("worker%d", i+1), opts.WorkerType, "")
-		drop, err := p.client.CreateNode(opts.Token, config, key)
+	if err := p.checkDropletLimit(opts, nodeCount); err != nil {
+		return provisioned, err
+	}
+	// The firewall to join must exist before anything is created
+	var joined FirewallConfig
+	if opts.FirewallName != "" {
+		fw, err := p.client.FindFirewallByName(opts.Token, opts.FirewallName)
 		if err != nil {
-			return provisioned, err
+			return provisioned, fmt.Errorf("Unable to look up firewall %s: %v", opts.FirewallName, err)
+		}
+		if fw.ID == "" {
+			return provisioned, fmt.Errorf("Firewall %q was not found", opts.FirewallName)
+		}
+		joined = fw
+	}
+	if opts.SpreadControlPlane {
+		warnControlPlaneSpread(&opts, nodeCount)
+	}
+	// Extra keys are validated before anything is created
+	extraKeys, err := p.findExtraKeys(opts)
+	if err != nil {
+		return provisioned, err
+	}
+
+	key, errkey := p.findOrCreateKey(opts)
+	if errkey != nil {
+		logger.Warnf("Cannot create key %v\n", errkey)
+		return provisioned, errkey
+	}
+	p.state.ClusterTag = opts.ClusterTag
+	p.state.setKey(key)
+	// A key referenced by name belongs to the user and is never removed with the cluster, nor
+	// is a key uploaded by another cluster with the same public key
+	if opts.DOSshKeyName == "" && key.Name == clusterKeyName(opts.ClusterTag) {
+		p.state.KeyName = key.Name
+	}
+
+	userData, err := loadUserData(opts.UserDataFile)
+	if err != nil {
+		return provisioned, err
+	}
+	// Images that disable root logins are reached with a sudo user created by cloud-init
+	sudoData := ""
+	if opts.SSHUser != "root" {
+		pub, errpub := sshUserKey(opts)
+		if errpub != nil {
+			return provisioned, errpub
 		}
-		dropletsWorker = append(dropletsWorker, drop)
+		sudoData = sudoUserData(opts.SSHUser, pub)
+	}
+	exporterData := ""
+	if opts.NodeExporter {
+		exporterData = nodeExporterUserData(NODE_EXPORTER_VERSION)
+	}
+	nodeData, err := combineUserData(sudoData, userData, exporterData)
+	if err != nil {
+		return provisioned, err
 	}
 
-	var dropletsBoot []Droplet
-	for i = 0; i < nodeCount.Boostrap; i++ {
+	if opts.Monitoring {
+		logger.Infof("Monitoring is enabled: CPU, memory and disk metrics of the droplets will be available in the Digital Ocean control panel\n")
+	}
+	var configs []NodeConfig
+	var i uint16
+	for i = 0; i < nodeCount.Etcd; i++ {
+		configs = append(configs, optionsToConfig(&opts, nodeName(&opts, "etcd", opts.EtcdStartIndex+i+1), "etcd", regionForNode(&opts, "etcd", opts.EtcdStartIndex+i), opts.EtcdType, nodeData))
+	}
+	for i = 0; i < nodeCount.Master; i++ {
+		configs = append(configs, optionsToConfig(&opts, nodeName(&opts, "master", opts.MasterStartIndex+i+1), "master", regionForNode(&opts, "master", opts.MasterStartIndex+i), opts.MasterType, nodeData))
+	}
+	for i = 0; i < nodeCount.Worker; i++ {
+		configs = append(configs, optionsToConfig(&opts, nodeName(&opts, "worker", opts.WorkerStartIndex+i+1), "worker", regionForNode(&opts, "worker", opts.WorkerStartIndex+i), opts.WorkerType, nodeData))
+	}
+	for i = 0; i < nodeCount.Ingress; i++ {
+		configs = append(configs, optionsToConfig(&opts, nodeName(&opts, "ingress", opts.IngressStartIndex+i+1), "ingress", regionForNode(&opts, "ingress", opts.IngressStartIndex+i), "", nodeData))
+	}
+	for i = 0; i < nodeCount.Bootstrap; i++ {
 		cmd := ""
-		var cmderr error
 		if opts.BootstrapFile != "" {
-			cmd, cmderr = loadBootCmds(opts.BootstrapFile)
-			if cmderr != nil {
-				fmt.Println("Cannot load script file for boot init", cmderr)
+			var cmderr error
+			if cmd, cmderr = loadBootCmds(opts.BootstrapFile, opts); cmderr != nil {
+				return provisioned, fmt.Errorf("Cannot load the bootstrap commands file %q: %v", opts.BootstrapFile, cmderr)
 			}
 		}
-		config := optionsToConfig(&opts, fmt.Sprintf("bootstrap%d", i+1), "", cmd)
-		fmt.Println("Bootstrap node:", config)
-		drop, err := p.client.CreateNode(opts.Token, config, key)
-		if err != nil {
+		// The user data runs in addition to the bootstrap commands
+		bootData, errdata := combineUserData(sudoData, userData, exporterData, proxyUserData(opts), cmd)
+		if errdata != nil {
+			return provisioned, errdata
+		}
+		config := optionsToConfig(&opts, nodeName(&opts, "bootstrap", opts.BootstrapStartIndex+i+1), "bootstrap", regionForNode(&opts, "bootstrap", opts.BootstrapStartIndex+i), opts.BootstrapType, bootData)
+		logger.Debugf("Bootstrap node: %v\n", config)
+		configs = append(configs, config)
+	}
+
+	for j := range configs {
+		for _, k := range extraKeys {
+			configs[j].Keys = append(configs[j].Keys, k.Fingerprint)
+		}
+	}
+
+	created, err := p.createDroplets(ctx, opts, configs, key)
+	if err != nil {
+		return provisioned, err
+	}
+	// The droplets are returned in the order of the configs
+	dropletsETCD := created[:nodeCount.Etcd]
+	created = created[nodeCount.Etcd:]
+	dropletsMaster := created[:nodeCount.Master]
+	created = created[nodeCount.Master:]
+	dropletsWorker := created[:nodeCount.Worker]
+	created = created[nodeCount.Worker:]
+	dropletsIngress := created[:nodeCount.Ingress]
+	dropletsBoot := created[nodeCount.Ingress:]
+
+	// The firewall references the cluster tag, which exists once the droplets are created
+	if opts.LockSSH {
+		if err := p.lockSSH(opts); err != nil {
+			return provisioned, err
+		}
+	}
+	if joined.ID != "" {
+		if err := p.joinFirewall(opts, joined); err != nil {
 			return provisioned, err
 		}
-		dropletsBoot = append(dropletsBoot, drop)
 	}
 
 	//Wait for assigned IPs
+	progress := newProgressCounter(PROGRESS_CREATED, len(configs), opts.OnProgress)
 
 	for i = 0; i < nodeCount.Etcd; i++ {
-		drop := p.WaitForIPs(opts, dropletsETCD[i])
+		drop := p.WaitForIPs(ctx, opts, dropletsETCD[i])
 		if drop != nil {
 			n := dropletToNode(drop, &opts)
+			if opts.EtcdSeparateDisk {
+				device, err := p.attachVolume(opts, drop, opts.EtcdVolumeSizeGB, "etcd-data")
+				if err != nil {
+					return provisioned, err
+				}
+				n.VolumeDevice = device
+				n.DataDir = opts.EtcdDataDir
+			}
+			progress.done(n)
 			provisioned.Etcd = append(provisioned.Etcd, n)
 		} else {
 			return provisioned, fmt.Errorf("Unable to get IPs from %s", dropletsETCD[i].Name)
@@ -189,9 +639,10 @@ func (p doProvisioner) ProvisionNodes(opts DOOpts, nodeCount NodeCount) (Provisi
 	}
 
 	for i = 0; i < nodeCount.Master; i++ {
-		drop := p.WaitForIPs(opts, dropletsMaster[i])
+		drop := p.WaitForIPs(ctx, opts, dropletsMaster[i])
 		if drop != nil {
 			n := dropletToNode(drop, &opts)
+			progress.done(n)
 			provisioned.Master = append(provisioned.Master, n)
 		} else {
 			return provisioned, fmt.Errorf("Unable to get IPs from %s", dropletsMaster[i].Name)
@@ -199,85 +650,1591 @@ func (p doProvisioner) ProvisionNodes(opts DOOpts, nodeCount NodeCount) (Provisi
 	}
 
 	for i = 0; i < nodeCount.Worker; i++ {
-		drop := p.WaitForIPs(opts, dropletsWorker[i])
+		drop := p.WaitForIPs(ctx, opts, dropletsWorker[i])
 		if drop != nil {
 			n := dropletToNode(drop, &opts)
+			if opts.VolumeSizeGB > 0 {
+				device, err := p.attachVolume(opts, drop, opts.VolumeSizeGB, "volume")
+				if err != nil {
+					return provisioned, err
+				}
+				n.VolumeDevice = device
+			}
+			progress.done(n)
 			provisioned.Worker = append(provisioned.Worker, n)
 		} else {
 			return provisioned, fmt.Errorf("Unable to get IPs from %s", dropletsWorker[i].Name)
 		}
 	}
 
-	for i = 0; i < nodeCount.Boostrap; i++ {
-		drop := p.WaitForIPs(opts, dropletsBoot[i])
+	for i = 0; i < nodeCount.Ingress; i++ {
+		drop := p.WaitForIPs(ctx, opts, dropletsIngress[i])
+		if drop != nil {
+			n := dropletToNode(drop, &opts)
+			progress.done(n)
+			provisioned.Ingress = append(provisioned.Ingress, n)
+		} else {
+			return provisioned, fmt.Errorf("Unable to get IPs from %s", dropletsIngress[i].Name)
+		}
+	}
+
+	for i = 0; i < nodeCount.Bootstrap; i++ {
+		drop := p.WaitForIPs(ctx, opts, dropletsBoot[i])
 		if drop != nil {
 			n := dropletToNode(drop, &opts)
-			provisioned.Boostrap = append(provisioned.Boostrap, n)
+			progress.done(n)
+			provisioned.Bootstrap = append(provisioned.Bootstrap, n)
 		} else {
 			return provisioned, fmt.Errorf("Unable to get IPs from %s", dropletsBoot[i].Name)
 		}
 	}
 
-	fmt.Println("Done provisioning")
+	logger.Infof("Done provisioning\n")
 	return provisioned, nil
 }
 
-func (p doProvisioner) WaitForIPs(opts DOOpts, drop Droplet) *Droplet {
-	fmt.Printf("Waiting for IPs to be assigned for node %s\n", drop.Name)
-	for {
-		init, err := p.client.GetDroplet(opts.Token, drop.ID)
+// checkTagUnused fails when droplets already carry the cluster tag, so that the nodes of a new
+// cluster are not mixed with the nodes of another one, which delete-all would then remove too
+func (p doProvisioner) checkTagUnused(opts DOOpts) error {
+	droplets, err := p.client.ListDropletsByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return fmt.Errorf("Unable to list the droplets with the tag %s: %v", opts.ClusterTag, err)
+	}
+	if len(droplets) == 0 {
+		return nil
+	}
+	msg := ""
+	for _, d := range droplets {
+		msg = msg + fmt.Sprintf(" - %s (ID %d, IP %s)\n", d.Name, d.ID, d.PublicIP)
+	}
+	return fmt.Errorf("The tag %s is already used by the following droplets. Use another --tag, or --reuse-tag to add the nodes to them:\n%s", opts.ClusterTag, msg)
+}
 
-		if init.PublicIP != "" && err == nil {
-			// command succeeded
-			fmt.Printf("IP assinged to %s: Public = %s ; Private %s\n", init.Name, init.PublicIP, init.PrivateIP)
-			return &init
+// warnControlPlaneSpread warns about the control plane nodes that may share a hypervisor.
+// Digital Ocean does not offer anti-affinity for droplets, so the only placement the
+// provisioner controls is the region: nodes in different regions never share a hypervisor.
+func warnControlPlaneSpread(opts *DOOpts, nodeCount NodeCount) {
+	counts := map[string]uint16{"etcd": nodeCount.Etcd, "master": nodeCount.Master}
+	for _, role := range []string{"etcd", "master"} {
+		regions := regionsForRole(opts, role)
+		count := int(counts[role])
+		if count < 2 || len(regions) >= count {
+			continue
 		}
-		fmt.Printf(".")
-		time.Sleep(3 * time.Second)
+		logger.Warnf("Digital Ocean has no anti-affinity for droplets, %d %s nodes in %s may share a hypervisor. Give at least %d regions with --%s-region to spread them\n", count, role, strings.Join(regions, ", "), count, role)
 	}
 }
 
-func (p doProvisioner) TerminateNodes(opts DOOpts) error {
+// checkDropletLimit fails when the requested droplets do not fit in the droplet limit of the
+// account, so that provisioning does not stop halfway when the limit is reached
+func (p doProvisioner) checkDropletLimit(opts DOOpts, nodeCount NodeCount) error {
+	requested := int(nodeCount.Total() + nodeCount.Bootstrap)
+	if requested == 0 {
+		return nil
+	}
+	limits, err := p.client.GetAccountLimits(opts.Token)
+	if err != nil {
+		return fmt.Errorf("Unable to get the droplet limit of the account: %v", err)
+	}
+	logger.Debugf("Account droplet limit %d, %d in use\n", limits.DropletLimit, limits.DropletCount)
+	if limits.DropletLimit > 0 && limits.DropletCount+requested > limits.DropletLimit {
+		return fmt.Errorf("Requesting %d droplets but account limit is %d with %d already in use; increase your limit or reduce counts", requested, limits.DropletLimit, limits.DropletCount)
+	}
+	return nil
+}
 
-	key := ""
-	if opts.RemoveKey {
-		key = SSHKEY
+// attachVolume creates a block storage volume tagged with the cluster tag and attaches it
+// to the droplet. The volume is named after the droplet and the suffix. It returns the path
+// of the volume's device on the droplet.
+func (p doProvisioner) attachVolume(opts DOOpts, drop *Droplet, sizeGB int, suffix string) (string, error) {
+	volconf := VolumeConfig{
+		Name:   fmt.Sprintf("%s-%s", drop.Name, suffix),
+		Region: drop.Region,
+		SizeGB: int64(sizeGB),
+		Tags:   append([]string{opts.ClusterTag}, opts.ExtraTags...),
+	}
+	logger.Infof("Creating %dGB volume %s for node %s\n", volconf.SizeGB, volconf.Name, drop.Name)
+	vol, err := p.client.CreateVolume(opts.Token, volconf)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create volume for %s: %v", drop.Name, err)
+	}
+	p.state.addVolume(vol.ID)
+	if err = p.client.AttachVolume(opts.Token, vol.ID, drop.ID); err != nil {
+		return "", fmt.Errorf("Unable to attach volume %s (%s) to %s. The volume is orphaned and must be removed manually: %v", vol.Name, vol.ID, drop.Name, err)
 	}
+	return "/dev/disk/by-id/scsi-0DO_Volume_" + vol.Name, nil
+}
 
-	return p.client.DeleteDropletsByTag(opts.Token, opts.ClusterTag, key)
+// lockSSH creates a firewall for the cluster that only allows SSH from the public IP
+// of the machine running the provisioner
+func (p doProvisioner) lockSSH(opts DOOpts) error {
+	ip, err := detectPublicIP()
+	if err != nil {
+		logger.Warnf("Cannot detect the public IP of this machine: %v\n", err)
+		ip, err = promptForPublicIP()
+		if err != nil {
+			return err
+		}
+	}
+	name := firewallName(opts.ClusterTag)
+	firewalls, err := p.client.ListFirewallsByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return fmt.Errorf("Unable to list firewalls: %v", err)
+	}
+	for _, fw := range firewalls {
+		if fw.Name == name {
+			logger.Infof("Using existing firewall %v\n", name)
+			return nil
+		}
+	}
+	fwconf := FirewallConfig{
+		Name:       name,
+		Tags:       []string{opts.ClusterTag},
+		SSHSources: []string{ip},
+		SSHPort:    opts.SSHPort,
+	}
+	// The existing bootstrap node is not tagged, so it is allowed by its IP to run kismatic
+	if opts.ExistingBootstrap != "" {
+		fwconf.SSHSources = append(fwconf.SSHSources, opts.ExistingBootstrap)
+	}
+	logger.Infof("Creating firewall %s allowing SSH from %s\n", fwconf.Name, strings.Join(fwconf.SSHSources, ", "))
+	if opts.NodeExporter {
+		fwconf.MetricsSources = opts.NodeExporterSources
+		if len(fwconf.MetricsSources) == 0 {
+			fwconf.MetricsSources = []string{ip}
+		}
+		logger.Infof("Allowing the node exporter port %d from %s\n", NODE_EXPORTER_PORT, strings.Join(fwconf.MetricsSources, ", "))
+	}
+	fw, err := p.client.CreateFirewall(opts.Token, fwconf)
+	if err != nil {
+		return fmt.Errorf("Unable to create firewall: %v", err)
+	}
+	p.state.addFirewall(fw.ID)
+	return nil
 }
 
-func WaitForSSH(ProvisionedNodes ProvisionedNodes, sshKey string) error {
-	nodes := ProvisionedNodes.allNodes()
-	for _, n := range nodes {
-		BlockUntilSSHOpen(n.Host, n.PublicIPv4, n.SSHUser, sshKey)
+// joinFirewall adds the cluster tag to the targets of an existing firewall, so that its rules
+// apply to the nodes. The change is reported, to be reverted by removing the tag.
+func (p doProvisioner) joinFirewall(opts DOOpts, fw FirewallConfig) error {
+	for _, t := range fw.Tags {
+		if t == opts.ClusterTag {
+			logger.Infof("Firewall %s (%s) already applies to the tag %s\n", fw.Name, fw.ID, opts.ClusterTag)
+			return nil
+		}
+	}
+	if err := p.client.AddFirewallTags(opts.Token, fw.ID, []string{opts.ClusterTag}); err != nil {
+		return fmt.Errorf("Unable to add the tag %s to firewall %s: %v", opts.ClusterTag, fw.Name, err)
 	}
-	fmt.Println("SSH established on all nodes")
+	p.state.addJoinedFirewall(fw.ID)
+	logger.Infof("Added the tag %s to the targets of firewall %s (%s). Remove the tag from the firewall to revert\n", opts.ClusterTag, fw.Name, fw.ID)
 	return nil
 }
 
-func loadBootCmds(path string) (string, error) {
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+// firewallName returns the name of the firewall created with --lock-ssh
+func firewallName(tag string) string {
+	return fmt.Sprintf("%s-firewall", tag)
+}
+
+// isLockSSHFirewall reports whether the firewall is the one created with --lock-ssh: it has its
+// name, applies only to the cluster tag and allows the traffic between the nodes of the tag
+func isLockSSHFirewall(fw FirewallConfig, tag string) bool {
+	if fw.Name != firewallName(tag) || len(fw.Tags) != 1 || fw.Tags[0] != tag {
+		return false
+	}
+	for _, t := range fw.TagSources {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func masterLoadBalancerName(tag string) string {
+	return fmt.Sprintf("%s-master-lb", tag)
+}
+
+// CreateMasterLoadBalancer creates a load balancer for the Kubernetes API in front of the master
+// nodes and waits for it to become active. It returns the IP of the load balancer.
+func (p doProvisioner) CreateMasterLoadBalancer(ctx context.Context, opts DOOpts, nodes ProvisionedNodes) (string, error) {
+	// The cluster tag is shared by all the nodes, so the masters are targeted by ID
+	lbconf := LoadBalancerConfig{
+		Name:    masterLoadBalancerName(opts.ClusterTag),
+		Region:  regionsForRole(&opts, "master")[0],
+		VPCUUID: opts.VPCUUID,
+		Port:    KUBE_API_PORT,
+	}
+	for _, n := range nodes.Master {
+		id, err := strconv.Atoi(n.ID)
+		if err != nil {
+			return "", fmt.Errorf("Invalid droplet ID %q: %v", n.ID, err)
+		}
+		lbconf.DropletIDs = append(lbconf.DropletIDs, id)
+	}
+
+	lbs, err := p.client.FindLoadBalancersByName(opts.Token, lbconf.Name)
 	if err != nil {
-		return "", fmt.Errorf("Cannot get path to exec %v\n", err)
+		return "", fmt.Errorf("Unable to look up load balancer %s: %v", lbconf.Name, err)
+	}
+	var lb LoadBalancerConfig
+	if len(lbs) > 0 {
+		lb = lbs[0]
+		logger.Infof("Using existing load balancer %v\n", lb.Name)
+		// The masters added by a converge join the existing load balancer
+		targets := map[int]bool{}
+		for _, id := range lb.DropletIDs {
+			targets[id] = true
+		}
+		missing := []int{}
+		for _, id := range lbconf.DropletIDs {
+			if !targets[id] {
+				missing = append(missing, id)
+			}
+		}
+		if len(missing) > 0 {
+			logger.Infof("Adding %d master node(s) to load balancer %v\n", len(missing), lb.Name)
+			if err = p.client.AddLoadBalancerDroplets(opts.Token, lb.ID, missing); err != nil {
+				return "", fmt.Errorf("Unable to add the master nodes to load balancer %s: %v", lb.Name, err)
+			}
+		}
+	} else {
+		logger.Infof("Creating load balancer %v\n", lbconf.Name)
+		lb, err = p.client.CreateLoadBalancer(opts.Token, lbconf)
+		if err != nil {
+			return "", fmt.Errorf("Unable to create load balancer: %v", err)
+		}
+		p.state.addLoadBalancer(lb.ID)
+	}
+	if opts.LockSSH {
+		if err = p.allowLoadBalancer(opts, lb); err != nil {
+			return "", err
+		}
 	}
 
-	cmdpath := filepath.Join(dir, path)
-	cmd, errcmd := ioutil.ReadFile(cmdpath)
-	if errcmd != nil {
-		fmt.Println("Cannot read public boot init file", errcmd)
-		return "", errcmd
+	logger.Infof("Waiting for load balancer %s to become active\n", lb.Name)
+	timeout := time.After(LB_ACTIVE_TIMEOUT)
+	for {
+		lb, err = p.client.GetLoadBalancer(opts.Token, lb.ID)
+		if err == nil && lb.Status == "active" && lb.IP != "" {
+			logger.Infof("Load balancer %s active on IP %s\n", lb.Name, lb.IP)
+			return lb.IP, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-timeout:
+			return "", fmt.Errorf("Timed out waiting for load balancer %s to become active", lbconf.Name)
+		case <-time.After(5 * time.Second):
+			logger.Infof(".")
+		}
 	}
-	s := string(cmd)
+}
 
-	root := os.Getenv("DO_KET_INSTALL_DIR")
-	if root == "" {
-		root = KET_INSTALL_DIR
+// allowLoadBalancer lets the load balancer reach the API server of the masters through the
+// --lock-ssh firewall, which otherwise only allows the traffic between the nodes
+func (p doProvisioner) allowLoadBalancer(opts DOOpts, lb LoadBalancerConfig) error {
+	name := firewallName(opts.ClusterTag)
+	fw, err := p.client.FindFirewallByName(opts.Token, name)
+	if err != nil {
+		return fmt.Errorf("Unable to look up firewall %s: %v", name, err)
 	}
-	initstatement := fmt.Sprintf("#!/bin/bash\nmkdir -p %s\ncd %s && ", root, root)
-	s = strings.Replace(s, "#!/bin/bash", initstatement, -1)
+	if fw.ID == "" {
+		return fmt.Errorf("Unable to find firewall %s to allow load balancer %s", name, lb.Name)
+	}
+	for _, id := range fw.LoadBalancerSources {
+		if id == lb.ID {
+			return nil
+		}
+	}
+	logger.Infof("Allowing load balancer %s through firewall %s on port %d\n", lb.Name, name, KUBE_API_PORT)
+	if err = p.client.AllowLoadBalancer(opts.Token, fw.ID, lb.ID, KUBE_API_PORT); err != nil {
+		return fmt.Errorf("Unable to allow load balancer %s through firewall %s: %v", lb.Name, name, err)
+	}
+	return nil
+}
 
-	re := regexp.MustCompile(`\r?\n`)
-	s = re.ReplaceAllString(s, "\n")
-	return s, nil
+// AssignMasterFloatingIP reserves a floating IP in the cluster region and assigns it to the master.
+// Floating IPs are region scoped, so the IP is always reserved in the region of the droplets.
+func (p doProvisioner) AssignMasterFloatingIP(opts DOOpts, master plan.Node) (string, error) {
+	id, err := strconv.Atoi(master.ID)
+	if err != nil {
+		return "", fmt.Errorf("Invalid droplet ID %q: %v", master.ID, err)
+	}
+	fips, err := p.client.ListFloatingIPsByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return "", fmt.Errorf("Unable to list floating IPs: %v", err)
+	}
+	for _, fip := range fips {
+		if fip.DropletID == id {
+			logger.Infof("Using floating IP %s already assigned to %s\n", fip.IP, master.Host)
+			return fip.IP, nil
+		}
+	}
+	region := regionsForRole(&opts, "master")[0]
+	logger.Infof("Reserving floating IP in region %v\n", region)
+	fip, err := p.client.ReserveFloatingIP(opts.Token, region)
+	if err != nil {
+		return "", fmt.Errorf("Unable to reserve floating IP: %v", err)
+	}
+	logger.Infof("Assigning floating IP %s to %s\n", fip.IP, master.Host)
+	if err = p.client.AssignFloatingIP(opts.Token, fip.IP, id); err != nil {
+		if relerr := p.client.ReleaseFloatingIP(opts.Token, fip.IP); relerr != nil {
+			p.state.addFloatingIP(fip.IP)
+			return "", fmt.Errorf("Unable to assign floating IP %s to %s: %v. The IP could not be released and must be removed manually: %v", fip.IP, master.Host, err, relerr)
+		}
+		return "", fmt.Errorf("Unable to assign floating IP %s to %s: %v", fip.IP, master.Host, err)
+	}
+	p.state.addFloatingIP(fip.IP)
+	return fip.IP, nil
+}
+
+// validateDomain checks that the domain of the master DNS record is managed in the account
+func (p doProvisioner) validateDomain(opts DOOpts) error {
+	if opts.DNSDomain == "" {
+		return nil
+	}
+	exists, err := p.client.DomainExists(opts.Token, opts.DNSDomain)
+	if err != nil {
+		return fmt.Errorf("Unable to look up domain %s: %v", opts.DNSDomain, err)
+	}
+	if !exists {
+		return fmt.Errorf("Domain %s was not found in the Digital Ocean account. Add the domain under Networking > Domains first", opts.DNSDomain)
+	}
+	return nil
+}
+
+// CreateMasterDNSRecord creates the A record of the master pointing at the IP and returns its
+// fully qualified name. A record that already points at the IP is reused.
+func (p doProvisioner) CreateMasterDNSRecord(opts DOOpts, ip string) (string, error) {
+	if err := p.validateDomain(opts); err != nil {
+		return "", err
+	}
+	fqdn := dnsRecordFQDN(opts)
+	records, err := p.client.ListDNSRecords(opts.Token, opts.DNSDomain, opts.DNSRecord)
+	if err != nil {
+		return "", fmt.Errorf("Unable to list the DNS records of %s: %v", opts.DNSDomain, err)
+	}
+	for _, r := range records {
+		if r.Data != ip {
+			return "", fmt.Errorf("The DNS record %s already exists and points at %s", fqdn, r.Data)
+		}
+	}
+	if len(records) > 0 {
+		logger.Infof("Using existing DNS record %s\n", fqdn)
+		return fqdn, nil
+	}
+	logger.Infof("Creating DNS record %s pointing at %s\n", fqdn, ip)
+	record, err := p.client.CreateDNSRecord(opts.Token, DNSRecordConfig{
+		Domain: opts.DNSDomain,
+		Name:   opts.DNSRecord,
+		Type:   "A",
+		Data:   ip,
+		TTL:    DNS_RECORD_TTL,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to create DNS record %s: %v", fqdn, err)
+	}
+	p.state.addDNSRecord(opts.DNSDomain, record.ID)
+	return fqdn, nil
+}
+
+// ListRegions returns all the Digital Ocean regions
+func (p doProvisioner) ListRegions(opts DOOpts) ([]RegionConfig, error) {
+	return p.client.ListRegions(opts.Token)
+}
+
+// validateRegion verifies that the requested region exists and supports the requested features
+func (p doProvisioner) validateRegion(opts DOOpts) error {
+	regions, err := p.client.ListRegions(opts.Token)
+	if err != nil {
+		return fmt.Errorf("Unable to load the available regions: %v", err)
+	}
+	for _, slug := range allRegions(&opts) {
+		if _, err = findRegion(slug, regions); err != nil {
+			return err
+		}
+	}
+	if opts.VolumeSizeGB > 0 {
+		for _, slug := range regionsForRole(&opts, "worker") {
+			region, _ := findRegion(slug, regions)
+			if !region.HasFeature(REGION_FEATURE_STORAGE) {
+				return fmt.Errorf("Region %s does not support block storage volumes", region.Slug)
+			}
+		}
+	}
+	if opts.EtcdSeparateDisk {
+		for _, slug := range regionsForRole(&opts, "etcd") {
+			region, _ := findRegion(slug, regions)
+			if !region.HasFeature(REGION_FEATURE_STORAGE) {
+				return fmt.Errorf("Region %s does not support block storage volumes for the etcd data", region.Slug)
+			}
+		}
+	}
+	if opts.IPv6 {
+		for _, slug := range allRegions(&opts) {
+			region, _ := findRegion(slug, regions)
+			if !region.HasFeature(REGION_FEATURE_IPV6) {
+				return fmt.Errorf("Region %s does not support IPv6", region.Slug)
+			}
+		}
+	}
+	if opts.Backups {
+		for _, role := range opts.BackupRoles {
+			for _, slug := range regionsForRole(&opts, role) {
+				region, _ := findRegion(slug, regions)
+				if !region.HasFeature(REGION_FEATURE_BACKUPS) {
+					logger.Warnf("Region %s does not report support for backups, the %s droplets may be created without them\n", region.Slug, role)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// backupsForRole reports whether the droplets of the role are created with backups enabled
+func backupsForRole(opts *DOOpts, role string) bool {
+	if !opts.Backups {
+		return false
+	}
+	for _, r := range opts.BackupRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ListSizes returns the sizes that can be deployed in the region of the options
+func (p doProvisioner) ListSizes(opts DOOpts) ([]SizeConfig, error) {
+	sizes, err := p.client.ListSizes(opts.Token)
+	if err != nil {
+		return nil, err
+	}
+	return sizesInRegion(sizes, opts.Region), nil
+}
+
+// ResolveDropletClass replaces the instance type with the size picked for the droplet class,
+// if one is requested. The role specific sizes are not changed.
+func (p doProvisioner) ResolveDropletClass(opts *DOOpts) error {
+	if opts.DropletClass == "" {
+		return nil
+	}
+	sizes, err := p.client.ListSizes(opts.Token)
+	if err != nil {
+		return fmt.Errorf("Unable to load the available sizes: %v", err)
+	}
+	sz, err := sizeForClass(opts.DropletClass, opts.VCPUs, opts.MemoryGB, allRegions(opts), sizes)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Using size %s (%d vCPUs, %dMB of memory, $%.2f/month) for the %s droplet class\n", sz.Slug, sz.VCPUs, sz.MemoryMB, sz.PriceMonthly, opts.DropletClass)
+	opts.InstanceType = sz.Slug
+	opts.DropletClass = ""
+	return nil
+}
+
+// validateSizes resolves the size aliases in the options and verifies that the
+// sizes can be deployed in the requested region
+func (p doProvisioner) validateSizes(opts *DOOpts) error {
+	if err := p.ResolveDropletClass(opts); err != nil {
+		return err
+	}
+	opts.InstanceType = resolveSize(opts.InstanceType)
+	opts.WorkerType = resolveSize(opts.WorkerType)
+	opts.EtcdType = resolveSize(opts.EtcdType)
+	opts.MasterType = resolveSize(opts.MasterType)
+	opts.BootstrapType = resolveSize(opts.BootstrapType)
+	sizes, err := p.client.ListSizes(opts.Token)
+	if err != nil {
+		return fmt.Errorf("Unable to load the available sizes: %v", err)
+	}
+	for _, role := range ROLES {
+		size := sizeForRole(opts, role)
+		for _, region := range regionsForRole(opts, role) {
+			if err = validateSize(size, region, sizes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EstimateCost returns the estimated cost of the nodes to be provisioned, priced with the
+// sizes listed by the Digital Ocean API
+func (p doProvisioner) EstimateCost(opts DOOpts, nodeCount NodeCount) (costEstimate, error) {
+	if err := p.ResolveDropletClass(&opts); err != nil {
+		return costEstimate{}, err
+	}
+	opts.InstanceType = resolveSize(opts.InstanceType)
+	opts.WorkerType = resolveSize(opts.WorkerType)
+	opts.EtcdType = resolveSize(opts.EtcdType)
+	opts.MasterType = resolveSize(opts.MasterType)
+	opts.BootstrapType = resolveSize(opts.BootstrapType)
+	sizes, err := p.client.ListSizes(opts.Token)
+	if err != nil {
+		return costEstimate{}, fmt.Errorf("Unable to load the size prices: %v", err)
+	}
+	return estimateCost(&opts, nodeCount, sizes)
+}
+
+// createDroplets creates the droplets concurrently, with at most opts.MaxParallel creations
+// in flight. The returned droplets are in the same order as the configs. If a creation fails,
+// the remaining creations are not started and the errors of all failed creations are returned.
+func (p doProvisioner) createDroplets(ctx context.Context, opts DOOpts, configs []NodeConfig, key KeyConfig) ([]Droplet, error) {
+	maxParallel := opts.MaxParallel
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+	droplets := make([]Droplet, len(configs))
+	errs := make([]error, len(configs))
+	sem := make(chan struct{}, maxParallel)
+	cancel := make(chan struct{})
+	var cancelOnce sync.Once
+	var wg sync.WaitGroup
+
+launch:
+	for i := range configs {
+		sem <- struct{}{}
+		select {
+		case <-cancel:
+			<-sem
+			break launch
+		case <-ctx.Done():
+			<-sem
+			break launch
+		default:
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			drop, err := p.client.CreateNode(opts.Token, configs[i], key)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %v", configs[i].Name, err)
+				cancelOnce.Do(func() { close(cancel) })
+				return
+			}
+			p.state.addDroplet(drop.ID)
+			droplets[i] = drop
+		}(i)
+	}
+	wg.Wait()
+
+	msg := ""
+	for _, err := range errs {
+		if err != nil {
+			msg = msg + fmt.Sprintf(" - %v\n", err)
+		}
+	}
+	if msg != "" {
+		return nil, fmt.Errorf("Unable to create droplets. Droplets that were created carry the tag %q:\n%s", opts.ClusterTag, msg)
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return droplets, nil
+}
+
+// WaitForIPs polls the droplet until its public IP is assigned. With WaitForActive, it also
+// waits until the droplet is active and its private IP is assigned. It returns nil if the
+// droplet is not ready before the timeout elapses.
+func (p doProvisioner) WaitForIPs(ctx context.Context, opts DOOpts, drop Droplet) *Droplet {
+	logger.Debugf("Waiting for IPs to be assigned for node %s\n", drop.Name)
+	deadline := time.Now().Add(opts.ActiveTimeout)
+	for {
+		init, err := p.client.GetDroplet(opts.Token, drop.ID)
+
+		if err == nil && dropletReady(init, opts.WaitForActive) {
+			// command succeeded
+			logger.Debugf("IP assinged to %s: Public = %s ; Private %s\n", init.Name, init.PublicIP, init.PrivateIP)
+			return &init
+		}
+		if time.Now().After(deadline) {
+			logger.Warnf("Timed out after %v waiting for node %s (status %q)\n", opts.ActiveTimeout, drop.Name, init.Status)
+			return nil
+		}
+		logger.Infof(".")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+func dropletReady(drop Droplet, waitForActive bool) bool {
+	if drop.PublicIP == "" {
+		return false
+	}
+	if !waitForActive {
+		return true
+	}
+	return drop.Status == "active" && drop.PrivateIP != ""
+}
+
+// TerminateNodes removes the cluster infrastructure. If a state file is given, only the resources
+// recorded in it are removed. Otherwise, all the resources carrying the cluster tag, or the role
+// tag if a role is given, are removed.
+func (p doProvisioner) TerminateNodes(opts DOOpts) error {
+	if opts.StateFile != "" {
+		state, err := loadState(opts.StateFile)
+		if err != nil {
+			return err
+		}
+		droplets := []Droplet{}
+		for _, id := range state.DropletIDs {
+			drop, err := p.client.GetDroplet(opts.Token, id)
+			if err != nil {
+				// the droplet may already be gone, it is still listed by its ID
+				drop = Droplet{ID: id}
+			}
+			droplets = append(droplets, drop)
+		}
+		if !opts.AssumeYes {
+			confirmed, err := confirmDeletion(droplets, state, opts.ClusterTag)
+			if err != nil {
+				return err
+			}
+			if !confirmed {
+				logger.Infof("Aborted, nothing was deleted\n")
+				return nil
+			}
+		}
+		return p.removeResources(opts, state, false)
+	}
+
+	tag := opts.ClusterTag
+	tagged, err := p.client.ListDropletsByTag(opts.Token, tag)
+	if err != nil {
+		return err
+	}
+	droplets := []Droplet{}
+	dropletIDs := map[int]bool{}
+	for _, d := range tagged {
+		// The role is read from the tags, or from the name of older droplets
+		if opts.Role != "" && dropletRole(d, opts.ClusterTag) != opts.Role {
+			continue
+		}
+		if !hasAllTags(d, opts.ExtraTags) {
+			continue
+		}
+		if opts.OlderThan > 0 && !createdBefore(d, time.Now().Add(-opts.OlderThan)) {
+			continue
+		}
+		droplets = append(droplets, d)
+		dropletIDs[d.ID] = true
+	}
+	if opts.OlderThan > 0 && len(droplets) == 0 {
+		logger.Infof("No droplet with the tag %s is older than %v, nothing was deleted\n", tag, opts.OlderThan)
+		return nil
+	}
+
+	// When a role or extra tags are given, or when only some of the droplets are old enough,
+	// only the selected droplets and their volumes and floating IPs are removed. The resources
+	// shared by the cluster are kept.
+	aged := opts.OlderThan > 0 && len(droplets) < len(tagged)
+	partial := opts.Role != "" || len(opts.ExtraTags) > 0 || aged
+	state := &State{ClusterTag: tag, KeyName: clusterKeyName(tag)}
+	if partial {
+		state = &State{ClusterTag: tag}
+	}
+	if opts.Role != "" {
+		state.ClusterTag = roleTag(opts.ClusterTag, opts.Role)
+	}
+	for _, d := range droplets {
+		state.DropletIDs = append(state.DropletIDs, d.ID)
+	}
+	volumes, err := p.client.ListVolumesByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return err
+	}
+	for _, vol := range volumes {
+		if partial && !attachedToAny(vol, dropletIDs) {
+			continue
+		}
+		state.VolumeIDs = append(state.VolumeIDs, vol.ID)
+	}
+	// Floating IPs are found through the droplets they are assigned to
+	fips, err := p.client.ListFloatingIPsByTag(opts.Token, tag)
+	if err != nil {
+		return err
+	}
+	for _, fip := range fips {
+		if !dropletIDs[fip.DropletID] {
+			continue
+		}
+		state.FloatingIPs = append(state.FloatingIPs, fip.IP)
+	}
+	if !partial {
+		lbs, err := p.client.FindLoadBalancersByName(opts.Token, masterLoadBalancerName(opts.ClusterTag))
+		if err != nil {
+			return err
+		}
+		for _, lb := range lbs {
+			state.LoadBalancerIDs = append(state.LoadBalancerIDs, lb.ID)
+		}
+		firewalls, err := p.client.ListFirewallsByTag(opts.Token, opts.ClusterTag)
+		if err != nil {
+			return err
+		}
+		// Only the firewall created with --lock-ssh is deleted. Which of the other firewalls were
+		// joined by create is only known from its state file, so they are left alone.
+		for _, fw := range firewalls {
+			if isLockSSHFirewall(fw, tag) {
+				state.FirewallIDs = append(state.FirewallIDs, fw.ID)
+			} else {
+				logger.Warnf("Firewall %s (%s) still applies to the tag %s. Use --from-state to remove the tag from the firewalls joined by create\n", fw.Name, fw.ID, tag)
+			}
+		}
+		// DNS records are not tagged, so the record is only removed when it is named
+		if opts.DNSDomain != "" {
+			records, err := p.client.ListDNSRecords(opts.Token, opts.DNSDomain, opts.DNSRecord)
+			if err != nil {
+				return fmt.Errorf("Unable to list the DNS records of %s: %v", opts.DNSDomain, err)
+			}
+			for _, r := range records {
+				state.DNSRecords = append(state.DNSRecords, dnsRecordRef{Domain: r.Domain, ID: r.ID})
+			}
+		}
+	}
+
+	if !opts.AssumeYes {
+		confirmed, err := confirmDeletion(droplets, state, opts.ClusterTag)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			logger.Infof("Aborted, nothing was deleted\n")
+			return nil
+		}
+	}
+	// Other droplets with the tag may remain, so the filtered droplets are removed by ID
+	if err = p.removeResources(opts, state, !partial); err != nil {
+		return err
+	}
+	// The tags are still used by the droplets that are not old enough
+	if len(opts.ExtraTags) > 0 || (opts.OlderThan > 0 && len(droplets) < len(tagged)) {
+		return nil
+	}
+	return p.removeTags(opts)
+}
+
+// Rollback removes the resources created by this provisioner so far. It is best
+// effort: resources that cannot be removed are left in the state file.
+func (p doProvisioner) Rollback(opts DOOpts) {
+	// The resources of a resumed run are left alone
+	created := p.state.created()
+	if created.isEmpty() {
+		logger.Infof("Nothing to clean up\n")
+		return
+	}
+	logger.Infof("Removing the infrastructure created by this run\n")
+	opts.RemoveKey = false
+	if err := p.removeResources(opts, created, false); err != nil {
+		logger.Warnf("Unable to remove all the infrastructure created by this run: %v\n", err)
+		return
+	}
+	p.state.clear()
+}
+
+// removeTags deletes the tags that were only used by the removed droplets
+func (p doProvisioner) removeTags(opts DOOpts) error {
+	tags := []string{}
+	if opts.Role != "" {
+		tags = append(tags, roleTag(opts.ClusterTag, opts.Role))
+	} else {
+		tags = append(tags, opts.ClusterTag)
+		for _, role := range ROLES {
+			tags = append(tags, roleTag(opts.ClusterTag, role))
+		}
+	}
+	for _, tag := range tags {
+		if err := p.client.DeleteTag(opts.Token, tag); err != nil {
+			return fmt.Errorf("Unable to delete tag %s: %v", tag, err)
+		}
+	}
+	return nil
+}
+
+// createdBefore reports whether the droplet was created before the time. Droplets whose
+// creation time is unknown are never considered old.
+func createdBefore(drop Droplet, t time.Time) bool {
+	return !drop.Created.IsZero() && drop.Created.Before(t)
+}
+
+// dropletAge formats the age of the droplet in days and hours, or in hours and minutes
+func dropletAge(drop Droplet, now time.Time) string {
+	if drop.Created.IsZero() {
+		return "-"
+	}
+	age := now.Sub(drop.Created)
+	if age >= 24*time.Hour {
+		return fmt.Sprintf("%dd%dh", int(age.Hours())/24, int(age.Hours())%24)
+	}
+	return fmt.Sprintf("%dh%dm", int(age.Hours()), int(age.Minutes())%60)
+}
+
+func attachedToAny(vol AttachedVolume, dropletIDs map[int]bool) bool {
+	for _, id := range vol.DropletIDs {
+		if dropletIDs[id] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p doProvisioner) removeResources(opts DOOpts, state *State, byTag bool) error {
+	// Floating IPs are released before the droplets are deleted
+	for _, ip := range state.FloatingIPs {
+		logger.Infof("Releasing floating IP %v\n", ip)
+		if err := p.client.UnassignFloatingIP(opts.Token, ip); err != nil {
+			return fmt.Errorf("Unable to unassign floating IP %s: %v", ip, err)
+		}
+		err := retry.WithBackoff(5, func() error {
+			return p.client.ReleaseFloatingIP(opts.Token, ip)
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to release floating IP %s: %v", ip, err)
+		}
+	}
+
+	// Volumes must be detached before they can be deleted
+	for _, id := range state.VolumeIDs {
+		vol, err := p.client.GetVolume(opts.Token, id)
+		if err != nil {
+			return fmt.Errorf("Unable to load volume %s: %v", id, err)
+		}
+		for _, dropletID := range vol.DropletIDs {
+			logger.Infof("Detaching volume %s from droplet %d\n", vol.Name, dropletID)
+			if err = p.client.DetachVolume(opts.Token, vol.ID, dropletID); err != nil {
+				return fmt.Errorf("Unable to detach volume %s: %v", vol.Name, err)
+			}
+		}
+	}
+
+	if byTag {
+		if err := p.client.DeleteDropletsByTag(opts.Token, state.ClusterTag, ""); err != nil {
+			return err
+		}
+	} else {
+		for _, id := range state.DropletIDs {
+			logger.Infof("Deleting droplet %v\n", id)
+			if err := p.client.DeleteDroplet(opts.Token, id); err != nil {
+				return fmt.Errorf("Unable to delete droplet %d: %v", id, err)
+			}
+		}
+	}
+
+	for _, id := range state.LoadBalancerIDs {
+		logger.Infof("Deleting load balancer %v\n", id)
+		if err := p.client.DeleteLoadBalancer(opts.Token, id); err != nil {
+			return fmt.Errorf("Unable to delete load balancer %s: %v", id, err)
+		}
+	}
+
+	for _, id := range state.FirewallIDs {
+		logger.Infof("Deleting firewall %v\n", id)
+		if err := p.client.DeleteFirewall(opts.Token, id); err != nil {
+			return fmt.Errorf("Unable to delete firewall %s: %v", id, err)
+		}
+	}
+	for _, id := range state.JoinedFirewallIDs {
+		logger.Infof("Removing the tag %s from firewall %v\n", state.ClusterTag, id)
+		if err := p.client.RemoveFirewallTags(opts.Token, id, []string{state.ClusterTag}); err != nil {
+			return fmt.Errorf("Unable to remove the tag %s from firewall %s: %v", state.ClusterTag, id, err)
+		}
+	}
+
+	for _, r := range state.DNSRecords {
+		logger.Infof("Deleting DNS record %d of %s\n", r.ID, r.Domain)
+		if err := p.client.DeleteDNSRecord(opts.Token, r.Domain, r.ID); err != nil {
+			return fmt.Errorf("Unable to delete DNS record %d of %s: %v", r.ID, r.Domain, err)
+		}
+	}
+
+	// Detaching is asynchronous, so the volume may still be reported as attached for a while
+	for _, id := range state.VolumeIDs {
+		logger.Infof("Deleting volume %v\n", id)
+		err := retry.WithBackoff(5, func() error {
+			return p.client.DeleteVolume(opts.Token, id)
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to delete volume %s: %v", id, err)
+		}
+	}
+
+	keysRemoved := 0
+	if opts.RemoveKey && state.KeyName != "" {
+		removed, err := p.client.DeleteKeyByName(opts.Token, state.KeyName)
+		if err != nil {
+			return err
+		}
+		if !removed && state.KeyName == clusterKeyName(state.ClusterTag) {
+			removed, err = p.client.DeleteKeyByName(opts.Token, LEGACY_KEY_NAME)
+			if err != nil {
+				return err
+			}
+			if removed {
+				logger.Infof("Removed the key %s of the clusters created by earlier versions\n", LEGACY_KEY_NAME)
+			}
+		}
+		if removed {
+			keysRemoved++
+		}
+	}
+
+	logger.Infof("Removed %d droplet(s), %d volume(s), %d floating IP(s), %d load balancer(s), %d firewall(s), %d DNS record(s) and %d key(s)\n",
+		len(state.DropletIDs), len(state.VolumeIDs), len(state.FloatingIPs), len(state.LoadBalancerIDs), len(state.FirewallIDs), len(state.DNSRecords), keysRemoved)
+	return nil
+}
+
+// ExistingNodes returns the nodes with the cluster tag, grouped by role
+func (p doProvisioner) ExistingNodes(opts DOOpts) (ProvisionedNodes, error) {
+	droplets, err := p.client.ListDropletsByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return ProvisionedNodes{}, fmt.Errorf("Unable to list the existing nodes: %v", err)
+	}
+	return nodesByRole(droplets, opts), nil
+}
+
+// ImportNodes returns the droplets with the tag given with --reuse-droplets-from-tag, grouped
+// by role and ordered by their index. Droplets whose role is unknown are skipped. They are
+// only tagged by TagImportedNodes, once the run has passed its checks.
+func (p doProvisioner) ImportNodes(opts DOOpts) (ProvisionedNodes, error) {
+	droplets, err := p.client.ListDropletsByTag(opts.Token, opts.ImportTag)
+	if err != nil {
+		return ProvisionedNodes{}, fmt.Errorf("Unable to list the droplets with the tag %s: %v", opts.ImportTag, err)
+	}
+	imported := []Droplet{}
+	for _, d := range droplets {
+		if dropletRole(d, opts.ImportTag) == "" {
+			logger.Warnf("Droplet %s (%d) has no role tag and no role in its name, it is not reused\n", d.Name, d.ID)
+			continue
+		}
+		imported = append(imported, d)
+	}
+	// The roles are read from the tags of the imported droplets
+	importOpts := opts
+	importOpts.ClusterTag = opts.ImportTag
+	nodes := nodesByRole(imported, importOpts)
+	for _, role := range ROLES {
+		sortNodes(nodes.byRole(role))
+	}
+	logger.Infof("Reusing %d droplet(s) with the tag %s\n", len(imported), opts.ImportTag)
+	return nodes, nil
+}
+
+// TagImportedNodes tags the imported nodes with the cluster tag and their role tag, so that
+// they belong to the cluster from then on
+func (p doProvisioner) TagImportedNodes(opts DOOpts, nodes ProvisionedNodes) error {
+	if opts.ImportTag == opts.ClusterTag {
+		return nil
+	}
+	for _, role := range ROLES {
+		ids := []int{}
+		for _, n := range nodes.byRole(role) {
+			id, err := strconv.Atoi(n.ID)
+			if err != nil {
+				return fmt.Errorf("Invalid droplet ID %q: %v", n.ID, err)
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		for _, tag := range []string{opts.ClusterTag, roleTag(opts.ClusterTag, role)} {
+			if err := p.client.TagDroplets(opts.Token, tag, ids); err != nil {
+				return fmt.Errorf("Unable to tag the reused %s droplets with %s: %v", role, tag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sortNodes orders the nodes by the index in their name, then by name
+func sortNodes(nodes []plan.Node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		_, a := parseNodeName(nodes[i].Host)
+		_, b := parseNodeName(nodes[j].Host)
+		if a != b {
+			return a < b
+		}
+		return nodes[i].Host < nodes[j].Host
+	})
+}
+
+// ResumeFromState continues the run recorded in the state file: the resources of the file
+// are recorded by this provisioner again, and the droplets that still exist are returned.
+// Droplets that were removed since are dropped from the state, so that they are recreated.
+func (p doProvisioner) ResumeFromState(opts DOOpts) (ProvisionedNodes, error) {
+	state, err := loadState(opts.StateFile)
+	if err != nil {
+		return ProvisionedNodes{}, err
+	}
+	if state.ClusterTag != opts.ClusterTag {
+		return ProvisionedNodes{}, fmt.Errorf("The state file %q records the cluster %q, not %q", opts.StateFile, state.ClusterTag, opts.ClusterTag)
+	}
+	droplets := []Droplet{}
+	ids := []int{}
+	for _, id := range state.DropletIDs {
+		drop, err := p.client.GetDroplet(opts.Token, id)
+		if err != nil {
+			logger.Warnf("Droplet %d of the state file cannot be loaded, it will be recreated: %v\n", id, err)
+			continue
+		}
+		droplets = append(droplets, drop)
+		ids = append(ids, id)
+	}
+	state.DropletIDs = ids
+	state.path = opts.StateFile
+	p.state.restore(state)
+	return nodesByRole(droplets, opts), nil
+}
+
+// nodesByRole groups the droplets by role
+func nodesByRole(droplets []Droplet, opts DOOpts) ProvisionedNodes {
+	nodes := ProvisionedNodes{}
+	for i := range droplets {
+		n := dropletToNode(&droplets[i], &opts)
+		switch dropletRole(droplets[i], opts.ClusterTag) {
+		case "etcd":
+			nodes.Etcd = append(nodes.Etcd, n)
+		case "master":
+			nodes.Master = append(nodes.Master, n)
+		case "worker":
+			nodes.Worker = append(nodes.Worker, n)
+		case "ingress":
+			nodes.Ingress = append(nodes.Ingress, n)
+		case "bootstrap":
+			nodes.Bootstrap = append(nodes.Bootstrap, n)
+		}
+	}
+	return nodes
+}
+
+// validateImage makes sure the image, given by slug or by numeric ID, exists and is
+// available in all the regions of the cluster
+func (p doProvisioner) validateImage(opts DOOpts, nodeCount NodeCount) error {
+	img, err := p.client.FindImage(opts.Token, opts.Image)
+	if err != nil {
+		return fmt.Errorf("Unable to look up image %s: %v", opts.Image, err)
+	}
+	if img.ID == 0 {
+		images, err := p.client.ListImages(opts.Token)
+		if err != nil {
+			return fmt.Errorf("Image %q was not found", opts.Image)
+		}
+		valid := []string{}
+		for _, i := range images {
+			if i.Slug != "" {
+				valid = append(valid, i.Slug)
+			} else {
+				valid = append(valid, fmt.Sprintf("%d (%s)", i.ID, i.Name))
+			}
+		}
+		sort.Strings(valid)
+		return fmt.Errorf("Image %q was not found. Valid images: %s", opts.Image, strings.Join(valid, ", "))
+	}
+	for _, region := range allRegions(&opts) {
+		found := false
+		for _, r := range img.Regions {
+			if r == region {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("Image %s (%s) is not available in region %s", opts.Image, img.Name, region)
+		}
+	}
+	if img.MinDiskSize == 0 {
+		return nil
+	}
+	sizes, err := p.client.ListSizes(opts.Token)
+	if err != nil {
+		return fmt.Errorf("Unable to load the available sizes: %v", err)
+	}
+	return validateImageDisk(img, &opts, nodeCount, sizes)
+}
+
+// validateImageDisk checks that the disk of the size of every requested role is large enough
+// for the image. The sizes must be resolved.
+func validateImageDisk(img ImageConfig, opts *DOOpts, nodeCount NodeCount, sizes []SizeConfig) error {
+	counts := map[string]uint16{
+		"etcd":      nodeCount.Etcd,
+		"master":    nodeCount.Master,
+		"worker":    nodeCount.Worker,
+		"ingress":   nodeCount.Ingress,
+		"bootstrap": nodeCount.Bootstrap,
+	}
+	for _, role := range ROLES {
+		if counts[role] == 0 {
+			continue
+		}
+		slug := sizeForRole(opts, role)
+		for _, sz := range sizes {
+			if sz.Slug == slug && sz.DiskGB < img.MinDiskSize {
+				return fmt.Errorf("Image %s requires a disk of at least %dGB, size %s of the %s nodes provides only %dGB", opts.Image, img.MinDiskSize, slug, role, sz.DiskGB)
+			}
+		}
+	}
+	return nil
+}
+
+// clusterKeyName returns the name of the key uploaded for the cluster. The name includes the
+// cluster tag, so that removing the key of one cluster leaves the keys of the others.
+func clusterKeyName(tag string) string {
+	return tag + "-cluster-key"
+}
+
+// findOrCreateKey returns the key the droplets are created with. A key referenced by name
+// must already exist in the account, otherwise the local public key is uploaded if needed.
+func (p doProvisioner) findOrCreateKey(opts DOOpts) (KeyConfig, error) {
+	if opts.DOSshKeyName != "" {
+		key, err := p.client.FindKeyByName(opts.Token, opts.DOSshKeyName)
+		if err != nil {
+			return key, err
+		}
+		if key.Fingerprint == "" {
+			return key, fmt.Errorf("SSH key %q was not found in the account", opts.DOSshKeyName)
+		}
+		logger.Infof("Using existing key %v\n", key)
+		return key, nil
+	}
+
+	keyconf := KeyConfig{}
+	keyconf.Name = clusterKeyName(opts.ClusterTag)
+	keyconf.PublicKeyFile = opts.SSHPublicKey
+	// Look the key up by its fingerprint, so that a newly generated key is uploaded
+	// even if another key with the same name already exists
+	fingerprint, errfp := publicKeyFingerprint(opts.SSHPublicKey)
+	if errfp != nil {
+		return keyconf, errfp
+	}
+	existing, err := p.client.FindKeyByFingerprint(opts.Token, fingerprint)
+	if err != nil {
+		return keyconf, fmt.Errorf("Unable to look up key %s: %v", fingerprint, err)
+	}
+	if existing.Fingerprint != "" {
+		logger.Infof("Using existing key %v\n", existing)
+		return existing, nil
+	}
+	logger.Infof("Creating new key\n")
+	return p.client.CreateKey(opts.Token, keyconf)
+}
+
+// findExtraKeys looks up the extra SSH keys by fingerprint or by name. All the keys
+// must already exist in the account.
+func (p doProvisioner) findExtraKeys(opts DOOpts) ([]KeyConfig, error) {
+	fingerprintRE := regexp.MustCompile("^([0-9a-f]{2}:){15}[0-9a-f]{2}$")
+	keys := []KeyConfig{}
+	msg := ""
+	for _, ref := range opts.ExtraSSHKeys {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			continue
+		}
+		var key KeyConfig
+		var err error
+		if fingerprintRE.MatchString(ref) {
+			key, err = p.client.FindKeyByFingerprint(opts.Token, ref)
+		} else {
+			key, err = p.client.FindKeyByName(opts.Token, ref)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to look up SSH key %s: %v", ref, err)
+		}
+		if key.Fingerprint == "" {
+			msg = msg + fmt.Sprintf(" - %s\n", ref)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if msg != "" {
+		return nil, fmt.Errorf("The following SSH keys were not found in the account:\n%s", msg)
+	}
+	return keys, nil
+}
+
+// FindDroplet looks up a droplet by ID or, if no ID is given, by name among
+// the droplets with the cluster tag
+func (p doProvisioner) FindDroplet(opts DOOpts, id int, name string) (Droplet, error) {
+	if id != 0 {
+		drop, err := p.client.GetDroplet(opts.Token, id)
+		if err != nil {
+			return drop, fmt.Errorf("Unable to find droplet %d: %v", id, err)
+		}
+		return drop, nil
+	}
+	droplets, err := p.client.ListDropletsByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return Droplet{}, err
+	}
+	matches := []Droplet{}
+	for _, d := range droplets {
+		if d.Name == name {
+			matches = append(matches, d)
+		}
+	}
+	if len(matches) == 0 {
+		return Droplet{}, fmt.Errorf("No droplet named %q found with the tag %q", name, opts.ClusterTag)
+	}
+	if len(matches) > 1 {
+		return Droplet{}, fmt.Errorf("Found %d droplets named %q with the tag %q. Use --id to select one", len(matches), name, opts.ClusterTag)
+	}
+	return matches[0], nil
+}
+
+// TerminateNode deletes a single droplet and, if requested, the volumes attached to it
+func (p doProvisioner) TerminateNode(opts DOOpts, drop Droplet, withVolume bool) error {
+	if withVolume {
+		for _, id := range drop.VolumeIDs {
+			logger.Infof("Detaching volume %s from droplet %d\n", id, drop.ID)
+			if err := p.client.DetachVolume(opts.Token, id, drop.ID); err != nil {
+				return fmt.Errorf("Unable to detach volume %s: %v", id, err)
+			}
+		}
+	}
+
+	logger.Infof("Deleting droplet %v\n", drop.ID)
+	if err := p.client.DeleteDroplet(opts.Token, drop.ID); err != nil {
+		return fmt.Errorf("Unable to delete droplet %d: %v", drop.ID, err)
+	}
+
+	if withVolume {
+		// Detaching is asynchronous, so the volume may still be reported as attached for a while
+		for _, id := range drop.VolumeIDs {
+			logger.Infof("Deleting volume %v\n", id)
+			err := retry.WithBackoff(5, func() error {
+				return p.client.DeleteVolume(opts.Token, id)
+			})
+			if err != nil {
+				return fmt.Errorf("Unable to delete volume %s: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// WaitForSSH polls all the nodes in parallel until they are accessible via SSH. If some
+// nodes are not accessible before the timeout elapses, the error lists them.
+func WaitForSSH(ctx context.Context, ProvisionedNodes ProvisionedNodes, sshKey string, sshPort int, timeout time.Duration) error {
+	return waitForSSH(ctx, ProvisionedNodes, sshKey, sshPort, timeout, nil)
+}
+
+// SSH_PROGRESS_INTERVAL is the time between two reports of the number of nodes accessible via SSH
+const SSH_PROGRESS_INTERVAL = 15 * time.Second
+
+// waitForSSH is WaitForSSH reporting each node that becomes accessible to the ProgressFunc
+func waitForSSH(ctx context.Context, ProvisionedNodes ProvisionedNodes, sshKey string, sshPort int, timeout time.Duration, report ProgressFunc) error {
+	nodes := ProvisionedNodes.allNodes()
+	deadline := time.Now().Add(timeout)
+	errs := make([]error, len(nodes))
+	progress := newProgressCounter(PROGRESS_SSH, len(nodes), report)
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func(i int, n plan.Node) {
+			defer wg.Done()
+			errs[i] = waitUntilSSHOpen(ctx, n, sshKey, sshPort, deadline)
+			if errs[i] == nil {
+				progress.done(n)
+			}
+		}(i, n)
+	}
+	finished := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(SSH_PROGRESS_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-finished:
+				return
+			case <-ticker.C:
+				logger.Infof("Waiting for SSH: %d/%d nodes ready\n", progress.readyCount(), len(nodes))
+			}
+		}
+	}()
+	wg.Wait()
+	close(finished)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// A rejected key is reported separately from a node that cannot be reached
+	msg := ""
+	for i, n := range nodes {
+		if errs[i] == nil {
+			continue
+		}
+		if isSSHAuthError(errs[i]) {
+			msg = msg + fmt.Sprintf(" - %s (ID %s, IP %s): the key %s was rejected for user %s: %v\n", n.Host, n.ID, n.PublicIPv4, sshKey, n.SSHUser, errs[i])
+		} else {
+			msg = msg + fmt.Sprintf(" - %s (ID %s, IP %s): cannot connect: %v\n", n.Host, n.ID, n.PublicIPv4, errs[i])
+		}
+	}
+	if msg != "" {
+		return fmt.Errorf("Timed out after %v waiting for SSH on the following nodes:\n%s", timeout, msg)
+	}
+	logger.Infof("SSH established on all nodes\n")
+	return nil
+}
+
+// MountDataVolumes formats the volume attached to each node with a data directory, unless it
+// already has a file system, and mounts it on the data directory. The mount is added to
+// /etc/fstab so that it survives reboots.
+func MountDataVolumes(ctx context.Context, nodes []plan.Node, sshKey string, sshPort int) error {
+	for _, n := range nodes {
+		if n.DataDir == "" || n.VolumeDevice == "" {
+			continue
+		}
+		logger.Infof("Mounting %s on %s of %s\n", n.VolumeDevice, n.DataDir, n.Host)
+		script := fmt.Sprintf(`set -e
+for i in $(seq 60); do [ -e %[1]s ] && break; sleep 2; done
+blkid %[1]s >/dev/null || mkfs.ext4 -q -F %[1]s
+mkdir -p %[2]s
+grep -q " %[2]s " /etc/fstab || echo "%[1]s %[2]s ext4 defaults,nofail,discard,noatime 0 2" >> /etc/fstab
+mountpoint -q %[2]s || mount %[2]s`, n.VolumeDevice, n.DataDir)
+		command := fmt.Sprintf("sh -c '%s'", script)
+		if n.SSHUser != "root" {
+			command = "sudo " + command
+		}
+		if out, err := runOnNode(ctx, command, n.SSHUser, nodeAddress(ctx, n), sshKey, sshPort); err != nil {
+			return fmt.Errorf("Unable to mount %s on %s of %s: %v: %s", n.VolumeDevice, n.DataDir, n.Host, err, strings.TrimSpace(out))
+		}
+	}
+	return nil
+}
+
+// BOOTSTRAP_POLL_INTERVAL is the time between two checks of the bootstrap node by WaitForBootstrap
+const BOOTSTRAP_POLL_INTERVAL = 10 * time.Second
+
+// WaitForBootstrap polls the bootstrap node until the kismatic binary downloaded by the
+// bootstrap commands is executable in the install directory. It fails early when cloud-init
+// has finished without installing it.
+func WaitForBootstrap(ctx context.Context, opts DOOpts, boot plan.Node, timeout time.Duration) error {
+	binary := path.Join(ketInstallDir(opts), "kismatic")
+	check := fmt.Sprintf("if [ -x '%s' ]; then echo ready; else cloud-init status 2>/dev/null; fi", binary)
+	logger.Infof("Waiting for the bootstrap commands to install %s on %s\n", binary, boot.Host)
+	deadline := time.After(timeout)
+	for {
+		out, err := runOnNode(ctx, check, boot.SSHUser, boot.PublicIPv4, opts.SSHPrivateKey, opts.SSHPort)
+		out = strings.TrimSpace(out)
+		switch {
+		case err != nil:
+			logger.Debugf("Cannot check the bootstrap node %s: %v: %s\n", boot.Host, err, out)
+		case out == "ready":
+			logger.Infof("Kismatic installed on the bootstrap node %s\n", boot.Host)
+			return nil
+		case strings.Contains(out, "status: done") || strings.Contains(out, "status: error"):
+			return fmt.Errorf("The bootstrap commands finished on %s without installing %s (cloud-init %s). See /var/log/cloud-init-output.log on the node", boot.Host, binary, out)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("Timed out after %v waiting for the bootstrap commands to install %s on %s", timeout, binary, boot.Host)
+		case <-time.After(BOOTSTRAP_POLL_INTERVAL):
+			logger.Infof(".")
+		}
+	}
+}
+
+// MAX_PING_SESSIONS limits the concurrent SSH sessions opened on the master by VerifyNetwork,
+// so that sshd does not drop them
+const MAX_PING_SESSIONS = 8
+
+// VerifyNetwork pings the internal IP of every other node from the first master, in parallel,
+// and reports the nodes that cannot be reached.
+func VerifyNetwork(ctx context.Context, nodes ProvisionedNodes, sshKey string, sshPort int) error {
+	if len(nodes.Master) == 0 {
+		return nil
+	}
+	from := nodes.Master[0]
+	targets := []plan.Node{}
+	for _, n := range nodes.allNodes() {
+		if n.Host != from.Host && net.ParseIP(n.PrivateIPv4) != nil {
+			targets = append(targets, n)
+		}
+	}
+	logger.Infof("Checking the network between %s and %d node(s)\n", from.Host, len(targets))
+	errs := make([]error, len(targets))
+	sessions := make(chan struct{}, MAX_PING_SESSIONS)
+	var wg sync.WaitGroup
+	for i, n := range targets {
+		wg.Add(1)
+		go func(i int, n plan.Node) {
+			defer wg.Done()
+			sessions <- struct{}{}
+			defer func() { <-sessions }()
+			out, err := runOnNode(ctx, fmt.Sprintf("ping -c 3 -W 2 %s", n.PrivateIPv4), from.SSHUser, nodeAddress(ctx, from), sshKey, sshPort)
+			if err != nil {
+				errs[i] = fmt.Errorf("%v: %s", err, strings.TrimSpace(out))
+			}
+		}(i, n)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	msg := ""
+	for i, n := range targets {
+		if errs[i] != nil {
+			msg = msg + fmt.Sprintf(" - %s (%s) -> %s (%s): %v\n", from.Host, from.PrivateIPv4, n.Host, n.PrivateIPv4, errs[i])
+		}
+	}
+	if msg != "" {
+		return fmt.Errorf("The following nodes cannot be reached over the internal network. Check the VPC and the firewall rules:\n%s", msg)
+	}
+	logger.Infof("All nodes are reachable from %s\n", from.Host)
+	return nil
+}
+
+func loadBootCmds(path string, opts DOOpts) (string, error) {
+	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		return "", fmt.Errorf("Cannot get path to exec %v\n", err)
+	}
+
+	cmdpath := filepath.Join(dir, path)
+	cmd, errcmd := ioutil.ReadFile(cmdpath)
+	if errcmd != nil {
+		return "", errcmd
+	}
+	s := string(cmd)
+
+	root := ketInstallDir(opts)
+	// The versions are exported so that the script downloads the requested releases
+	exports := ""
+	if opts.KETVersion != "" {
+		exports += fmt.Sprintf("export KET_VERSION=%s\n", shellQuote(normalizeVersion(opts.KETVersion)))
+	}
+	if opts.KubectlVersion != "" {
+		exports += fmt.Sprintf("export KUBECTL_VERSION=%s\n", shellQuote(normalizeVersion(opts.KubectlVersion)))
+	}
+	exports += fmt.Sprintf("export INSTALL_KISMATIC=%t\nexport INSTALL_KUBECTL=%t\n", opts.InstallKismatic, opts.InstallKubectl)
+	// The install directory is handed over to the SSH user, to copy the plan into it
+	exports += fmt.Sprintf("export SSH_USER=%s\n", opts.SSHUser)
+	exports += proxyExports(opts)
+	initstatement := fmt.Sprintf("#!/bin/bash\n%smkdir -p %s\ncd %s && ", exports, root, root)
+	s = strings.Replace(s, "#!/bin/bash", initstatement, -1)
+
+	re := regexp.MustCompile(`\r?\n`)
+	s = re.ReplaceAllString(s, "\n")
+	return s, nil
+}
+
+// proxyExports exports the proxy of the bootstrap node, in both cases since the tools of the
+// bootstrap commands read either
+func proxyExports(opts DOOpts) string {
+	exports := ""
+	vars := []struct{ name, value string }{
+		{"http_proxy", opts.HTTPProxy},
+		{"https_proxy", opts.HTTPSProxy},
+		{"no_proxy", strings.Join(opts.NoProxy, ",")},
+	}
+	for _, v := range vars {
+		if v.value != "" {
+			value := shellQuote(v.value)
+			exports += fmt.Sprintf("export %s=%s\nexport %s=%s\n", v.name, value, strings.ToUpper(v.name), value)
+		}
+	}
+	return exports
+}
+
+// proxyUserData returns the script that exports the proxy to the login shells of the bootstrap
+// node, which run kismatic, whether or not there are bootstrap commands
+func proxyUserData(opts DOOpts) string {
+	exports := proxyExports(opts)
+	if exports == "" {
+		return ""
+	}
+	return "#!/bin/bash\ncat > /etc/profile.d/proxy.sh <<'PROXY'\n" + exports + "PROXY\n"
+}
+
+// shellQuote quotes the value for a shell with single quotes
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// normalizeVersion prefixes the version with a "v", as used in the release names
+func normalizeVersion(version string) string {
+	if strings.HasPrefix(version, "v") {
+		return version
+	}
+	return "v" + version
+}
+
+// detectPublicIP asks an external service for the public IP of the machine running the provisioner
+func detectPublicIP() (string, error) {
+	client := http.Client{Timeout: 10 * time.Second, Transport: proxyTransport()}
+	resp, err := client.Get(PUBLIC_IP_URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response from %s: %s", PUBLIC_IP_URL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil || ip.To4() == nil {
+		return "", fmt.Errorf("%s did not return a valid IPv4 address", PUBLIC_IP_URL)
+	}
+	return ip.String(), nil
+}
+
+func promptForPublicIP() (string, error) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Enter the public IP of this machine: ")
+	text, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("Unable to read the public IP: %v", err)
+	}
+	text = strings.TrimSpace(text)
+	if net.ParseIP(text) == nil {
+		return "", fmt.Errorf("%q is not a valid IP address", text)
+	}
+	return text, nil
+}
+
+// confirmDeletion lists the resources that are about to be removed and asks the
+// user to confirm. Anything other than "y" or "yes" is a refusal.
+func confirmDeletion(droplets []Droplet, state *State, clusterTag string) (bool, error) {
+	if len(droplets) == 0 {
+		fmt.Println("No droplets will be destroyed.")
+	} else {
+		fmt.Println("The following droplets will be destroyed:")
+		w := tabwriter.NewWriter(os.Stdout, 10, 4, 3, ' ', 0)
+		fmt.Fprintf(w, "ID\tNAME\tROLE\tPUBLIC IP\tAGE\n")
+		for _, d := range droplets {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", d.ID, d.Name, dropletRole(d, clusterTag), d.PublicIP, dropletAge(d, time.Now()))
+		}
+		w.Flush()
+	}
+	fmt.Printf("Also removing %d volume(s), %d floating IP(s), %d load balancer(s), %d firewall(s) and %d DNS record(s).\n",
+		len(state.VolumeIDs), len(state.FloatingIPs), len(state.LoadBalancerIDs), len(state.FirewallIDs), len(state.DNSRecords))
+	if len(state.JoinedFirewallIDs) > 0 {
+		fmt.Printf("The tag %s will be removed from the firewall(s) %s, which are kept.\n", state.ClusterTag, strings.Join(state.JoinedFirewallIDs, ", "))
+	}
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Print("Are you sure? [y/N]: ")
+	text, err := reader.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("Unable to read the confirmation: %v", err)
+	}
+	text = strings.ToLower(strings.TrimSpace(text))
+	return text == "y" || text == "yes", nil
+}
+
+// isTerminal reports whether the file is a terminal rather than a pipe or a regular file
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
 }
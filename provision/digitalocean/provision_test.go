@@ -0,0 +1,619 @@
+package digitalocean
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apprenda/kismatic-provision/provision/plan"
+)
+
+func fakeProvisioner() (*doProvisioner, *fakeClient) {
+	client := newFakeClient()
+	client.keys = append(client.keys, KeyConfig{ID: 1, Name: "mykey", Fingerprint: "aa:bb"})
+	return newProvisioner(client), client
+}
+
+func testOptions() DOOpts {
+	return DOOpts{
+		Token:         "token",
+		ClusterTag:    "test",
+		Region:        "tor1",
+		Image:         "ubuntu-16-04-x64",
+		InstanceType:  "s-1vcpu-1gb",
+		SSHUser:       "root",
+		DOSshKeyName:  "mykey",
+		MaxParallel:   2,
+		ActiveTimeout: time.Second,
+	}
+}
+
+func TestProvisionNodes(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	var nodes ProvisionedNodes
+	var err error
+	captureOutput(t, func() {
+		nodes, err = p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1, Worker: 2})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(nodes.Etcd) != 1 || len(nodes.Master) != 1 || len(nodes.Worker) != 2 || len(nodes.Bootstrap) != 0 {
+		t.Fatalf("unexpected node counts: %+v", nodes)
+	}
+	if nodes.Worker[1].Host != "test-worker-2" {
+		t.Errorf("expected worker host test-worker-2, got %s", nodes.Worker[1].Host)
+	}
+	for _, n := range nodes.allNodes() {
+		if n.PublicIPv4 == "" || n.PrivateIPv4 == "" {
+			t.Errorf("node %s has no IPs", n.Host)
+		}
+	}
+	if len(client.droplets) != 4 {
+		t.Errorf("expected 4 droplets, got %d", len(client.droplets))
+	}
+	if len(p.state.DropletIDs) != 4 {
+		t.Errorf("expected 4 droplets in the state, got %d", len(p.state.DropletIDs))
+	}
+	if p.state.KeyName != "" {
+		t.Errorf("a key referenced by name must not be recorded in the state, got %q", p.state.KeyName)
+	}
+	for _, d := range client.droplets {
+		if !hasAllTags(d, []string{"test"}) {
+			t.Errorf("droplet %s does not have the cluster tag: %v", d.Name, d.Tags)
+		}
+	}
+}
+
+func TestProvisionNodesReportsProgress(t *testing.T) {
+	p, _ := fakeProvisioner()
+	opts := testOptions()
+	events := []ProgressEvent{}
+	opts.OnProgress = func(e ProgressEvent) {
+		events = append(events, e)
+	}
+	captureOutput(t, func() {
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1, Worker: 1}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if len(events) != 3 {
+		t.Fatalf("expected 3 progress events, got %d", len(events))
+	}
+	for i, e := range events {
+		if e.Stage != PROGRESS_CREATED || e.Ready != i+1 || e.Total != 3 || e.Node.PublicIPv4 == "" {
+			t.Errorf("unexpected progress event %d: %+v", i, e)
+		}
+	}
+}
+
+func TestProvisionNodesPartialFailureRollback(t *testing.T) {
+	p, client := fakeProvisioner()
+	client.createFailures["test-worker-2"] = true
+	opts := testOptions()
+	opts.MaxParallel = 1
+	captureOutput(t, func() {
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1, Worker: 2}); err == nil {
+			t.Fatalf("expected an error when a droplet cannot be created")
+		}
+	})
+	if len(client.droplets) == 0 {
+		t.Fatalf("expected the droplets created before the failure to exist")
+	}
+	if len(p.state.DropletIDs) != len(client.droplets) {
+		t.Errorf("expected the state to record the %d created droplets, got %d", len(client.droplets), len(p.state.DropletIDs))
+	}
+
+	captureOutput(t, func() {
+		p.Rollback(opts)
+	})
+	if len(client.droplets) != 0 {
+		t.Errorf("expected all the droplets to be removed, %d remain", len(client.droplets))
+	}
+	if !p.state.isEmpty() {
+		t.Errorf("expected the state to be cleared after the rollback")
+	}
+	if len(client.keys) != 1 {
+		t.Errorf("the rollback must not remove the SSH key")
+	}
+}
+
+func TestRollbackKeepsResumedResources(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	opts.VolumeSizeGB = 10
+	dir, err := ioutil.TempDir("", "kismatic-provision-state")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	captureOutput(t, func() {
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1, Worker: 1}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	p.state.ClusterTag = opts.ClusterTag
+	p.state.path = filepath.Join(dir, "state.json")
+	if _, err := writeState(p.state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	droplets, volumes, keys := len(client.droplets), len(client.volumes), len(client.keys)
+	if volumes == 0 {
+		t.Fatalf("expected the first run to create a volume")
+	}
+
+	resumed := newProvisioner(client)
+	opts.StateFile = p.state.path
+	opts.WorkerStartIndex = 1
+	opts.MaxParallel = 1
+	client.createFailures["test-worker-3"] = true
+	captureOutput(t, func() {
+		if _, err := resumed.ResumeFromState(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := resumed.ProvisionNodes(context.Background(), opts, NodeCount{Worker: 2}); err == nil {
+			t.Fatalf("expected an error when a droplet cannot be created")
+		}
+		resumed.Rollback(opts)
+	})
+	if len(client.droplets) != droplets {
+		t.Errorf("expected the %d droplets of the resumed run to remain, got %d", droplets, len(client.droplets))
+	}
+	for _, id := range p.state.DropletIDs {
+		if _, ok := client.droplets[id]; !ok {
+			t.Errorf("droplet %d of the resumed run was removed by the rollback", id)
+		}
+	}
+	for _, id := range p.state.VolumeIDs {
+		if _, ok := client.volumes[id]; !ok {
+			t.Errorf("volume %s of the resumed run was removed by the rollback", id)
+		}
+	}
+	if len(client.keys) != keys {
+		t.Errorf("expected the %d keys to remain, got %d", keys, len(client.keys))
+	}
+	if len(resumed.state.DropletIDs) != droplets {
+		t.Errorf("expected the state to keep the %d droplets of the resumed run, got %v", droplets, resumed.state.DropletIDs)
+	}
+}
+
+func TestRollbackKeepsExistingDroplets(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	existing, _ := client.CreateNode(opts.Token, NodeConfig{Name: "test-etcd-1", Tags: []string{"test"}}, KeyConfig{})
+	client.createFailures["test-worker-1"] = true
+	opts.ReuseTag = true
+	captureOutput(t, func() {
+		opts.EtcdStartIndex = 1
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Master: 1, Worker: 1}); err == nil {
+			t.Fatalf("expected an error when a droplet cannot be created")
+		}
+		p.Rollback(opts)
+	})
+	if len(client.droplets) != 1 {
+		t.Fatalf("expected only the existing droplet to remain, got %d droplets", len(client.droplets))
+	}
+	if _, ok := client.droplets[existing.ID]; !ok {
+		t.Errorf("the existing droplet was removed by the rollback")
+	}
+}
+
+func TestProvisionNodesTagInUse(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	client.CreateNode(opts.Token, NodeConfig{Name: "other-worker-1", Tags: []string{"test"}}, KeyConfig{})
+	var err error
+	captureOutput(t, func() {
+		_, err = p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1})
+	})
+	if err == nil || !strings.Contains(err.Error(), "other-worker-1") {
+		t.Fatalf("expected an error listing the droplet with the tag, got %v", err)
+	}
+	if len(client.droplets) != 1 {
+		t.Errorf("no droplet must be created when the tag is in use, got %d droplets", len(client.droplets))
+	}
+
+	opts.ReuseTag = true
+	captureOutput(t, func() {
+		_, err = p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error with --reuse-tag: %v", err)
+	}
+}
+
+func TestSecondRunWithSameTag(t *testing.T) {
+	for _, recreate := range []bool{false, true} {
+		p, client := fakeProvisioner()
+		opts := testOptions()
+		captureOutput(t, func() {
+			if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+		second := newProvisioner(client)
+		opts.ReuseTag = true
+		opts.Recreate = recreate
+		var err error
+		captureOutput(t, func() {
+			var existing ProvisionedNodes
+			if existing, err = existingNodes(second, &opts); err != nil {
+				return
+			}
+			opts.WorkerStartIndex = lastIndex(existing.Worker)
+			_, err = second.ProvisionNodes(context.Background(), opts, NodeCount{Worker: 1})
+		})
+		if err != nil {
+			t.Errorf("recreate %v: unexpected error on the second run: %v", recreate, err)
+		}
+		if len(client.droplets) != 3 {
+			t.Errorf("recreate %v: expected 3 droplets, got %d", recreate, len(client.droplets))
+		}
+	}
+}
+
+func TestExistingNodesOfAnotherCluster(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	client.CreateNode(opts.Token, NodeConfig{Name: "other-etcd-1", Tags: []string{"test", "test-etcd"}}, KeyConfig{})
+	client.CreateNode(opts.Token, NodeConfig{Name: "other-master-1", Tags: []string{"test", "test-master"}}, KeyConfig{})
+	var err error
+	captureOutput(t, func() {
+		var existing ProvisionedNodes
+		if existing, err = existingNodes(p, &opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(existing.allNodes()) != 0 {
+			t.Errorf("expected no node to be reused without --reuse-tag, got %d", len(existing.allNodes()))
+		}
+		_, err = p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1})
+	})
+	if err == nil || !strings.Contains(err.Error(), "--reuse-tag") {
+		t.Fatalf("expected an error for the tag in use, got %v", err)
+	}
+	if len(client.droplets) != 2 {
+		t.Errorf("no droplet must be created when the tag is in use, got %d droplets", len(client.droplets))
+	}
+}
+
+func TestLoadBalancerAllowedThroughFirewall(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	opts.LockSSH = true
+	client.firewalls = []FirewallConfig{{ID: "fw-1", Name: firewallName(opts.ClusterTag), Tags: []string{opts.ClusterTag}}}
+	nodes := ProvisionedNodes{Master: []plan.Node{{ID: "1", Host: "test-master-1"}}}
+	for i := 0; i < 2; i++ {
+		captureOutput(t, func() {
+			if _, err := p.CreateMasterLoadBalancer(context.Background(), opts, nodes); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+	if sources := client.firewalls[0].LoadBalancerSources; len(sources) != 1 || sources[0] != "lb-1" {
+		t.Errorf("expected the load balancer to be allowed once through the firewall, got %v", sources)
+	}
+}
+
+func TestValidateImageDiskRequestedRoles(t *testing.T) {
+	img := ImageConfig{MinDiskSize: 30}
+	sizes := []SizeConfig{{Slug: "s-1vcpu-1gb", DiskGB: 25}, {Slug: "s-2vcpu-4gb", DiskGB: 80}}
+	opts := testOptions()
+	opts.InstanceType = "s-2vcpu-4gb"
+	opts.BootstrapType = "s-1vcpu-1gb"
+	if err := validateImageDisk(img, &opts, NodeCount{Etcd: 1, Master: 1, Worker: 1}, sizes); err != nil {
+		t.Errorf("the size of the bootstrap node must not be checked without a bootstrap node: %v", err)
+	}
+	if err := validateImageDisk(img, &opts, NodeCount{Etcd: 1, Master: 1, Bootstrap: 1}, sizes); err == nil || !strings.Contains(err.Error(), "bootstrap nodes") {
+		t.Errorf("expected an error for the disk of the bootstrap node, got %v", err)
+	}
+}
+
+func TestExistingLoadBalancerGetsNewMasters(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	client.loadBalancers = []LoadBalancerConfig{{ID: "lb-0", Name: masterLoadBalancerName(opts.ClusterTag), DropletIDs: []int{1}}}
+	nodes := ProvisionedNodes{Master: []plan.Node{{ID: "1", Host: "test-master-1"}, {ID: "2", Host: "test-master-2"}}}
+	captureOutput(t, func() {
+		if _, err := p.CreateMasterLoadBalancer(context.Background(), opts, nodes); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if ids := client.loadBalancers[0].DropletIDs; len(ids) != 2 || ids[1] != 2 {
+		t.Errorf("expected the new master to be added to the load balancer, got %v", ids)
+	}
+	if len(p.state.LoadBalancerIDs) != 0 {
+		t.Errorf("the existing load balancer must not be recorded as created")
+	}
+}
+
+func TestProvisionNodesDropletLimit(t *testing.T) {
+	p, client := fakeProvisioner()
+	client.dropletLimit = 4
+	opts := testOptions()
+	opts.ReuseTag = true
+	client.CreateNode(opts.Token, NodeConfig{Name: "other-1"}, KeyConfig{})
+	var err error
+	captureOutput(t, func() {
+		_, err = p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1, Worker: 2})
+	})
+	if err == nil || !strings.Contains(err.Error(), "Requesting 4 droplets but account limit is 4 with 1 already in use") {
+		t.Fatalf("expected an error about the droplet limit, got %v", err)
+	}
+	if len(client.droplets) != 1 {
+		t.Errorf("no droplet must be created over the limit, got %d droplets", len(client.droplets))
+	}
+}
+
+func TestWarnControlPlaneSpread(t *testing.T) {
+	opts := testOptions()
+	opts.MasterRegion = "tor1,nyc3,sfo2"
+	out := captureOutput(t, func() {
+		warnControlPlaneSpread(&opts, NodeCount{Etcd: 3, Master: 3, Worker: 5})
+	})
+	if !strings.Contains(out, "3 etcd nodes in tor1 may share a hypervisor") {
+		t.Errorf("expected a warning about the etcd nodes, got %q", out)
+	}
+	if strings.Contains(out, "master") {
+		t.Errorf("the master nodes spread across 3 regions must not be reported, got %q", out)
+	}
+}
+
+func TestTerminateNodesByRole(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	captureOutput(t, func() {
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1, Worker: 2}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		opts.Role = "worker"
+		opts.AssumeYes = true
+		if err := p.TerminateNodes(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if len(client.droplets) != 2 {
+		t.Errorf("expected the etcd and master droplets to remain, got %d droplets", len(client.droplets))
+	}
+	for _, d := range client.droplets {
+		if role, _ := parseNodeName(d.Name); role == "worker" {
+			t.Errorf("worker droplet %s was not removed", d.Name)
+		}
+	}
+	if len(client.deletedTags) != 1 || client.deletedTags[0] != "test-worker" {
+		t.Errorf("expected only the worker role tag to be deleted, got %v", client.deletedTags)
+	}
+}
+
+func TestTerminateNodesRemovesOnlyClusterKey(t *testing.T) {
+	p, client := fakeProvisioner()
+	client.keys = append(client.keys,
+		KeyConfig{ID: 2, Name: clusterKeyName("test"), Fingerprint: "cc:dd"},
+		KeyConfig{ID: 3, Name: clusterKeyName("other"), Fingerprint: "ee:ff"})
+	opts := testOptions()
+	captureOutput(t, func() {
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		opts.RemoveKey = true
+		opts.AssumeYes = true
+		if err := p.TerminateNodes(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	names := []string{}
+	for _, k := range client.keys {
+		names = append(names, k.Name)
+	}
+	if len(names) != 2 || names[0] != "mykey" || names[1] != "other-cluster-key" {
+		t.Errorf("expected only the key of the cluster to be removed, got %v", names)
+	}
+}
+
+func TestTerminateNodesRemovesLegacyKey(t *testing.T) {
+	p, client := fakeProvisioner()
+	client.keys = append(client.keys, KeyConfig{ID: 2, Name: LEGACY_KEY_NAME, Fingerprint: "cc:dd"})
+	opts := testOptions()
+	captureOutput(t, func() {
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		opts.RemoveKey = true
+		opts.AssumeYes = true
+		if err := p.TerminateNodes(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if len(client.keys) != 1 || client.keys[0].Name != "mykey" {
+		t.Errorf("expected the legacy key to be removed, got %v", client.keys)
+	}
+}
+
+func TestImportNodes(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	opts.ClusterTag = "old"
+	captureOutput(t, func() {
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1, Worker: 2}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	client.droplets[client.nextID] = Droplet{ID: client.nextID, Name: "stray", Tags: []string{"old"}}
+	client.nextID++
+
+	opts.ClusterTag = "new"
+	opts.ImportTag = "old"
+	var nodes ProvisionedNodes
+	var err error
+	out := captureOutput(t, func() {
+		nodes, err = p.ImportNodes(opts)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, d := range client.droplets {
+		if hasAllTags(d, []string{"new"}) {
+			t.Fatalf("droplet %s was tagged before the checks of the run", d.Name)
+		}
+	}
+	if err = p.TagImportedNodes(opts, nodes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out, "Droplet stray") {
+		t.Errorf("expected a warning about the droplet without a role, got %q", out)
+	}
+	if len(nodes.Etcd) != 1 || len(nodes.Master) != 1 || len(nodes.Worker) != 2 {
+		t.Fatalf("unexpected imported nodes: %+v", nodes)
+	}
+	if nodes.Worker[0].Host != "old-worker-1" || nodes.Worker[1].Host != "old-worker-2" {
+		t.Errorf("expected the workers ordered by index, got %s and %s", nodes.Worker[0].Host, nodes.Worker[1].Host)
+	}
+	for _, d := range client.droplets {
+		role, _ := parseNodeName(d.Name)
+		if d.Name == "stray" {
+			if hasAllTags(d, []string{"new"}) {
+				t.Errorf("the droplet without a role must not be tagged")
+			}
+		} else if !hasAllTags(d, []string{"new", roleTag("new", role)}) {
+			t.Errorf("droplet %s was not tagged with the cluster and role tags: %v", d.Name, d.Tags)
+		}
+	}
+	if remaining := remainingNodeCount(NodeCount{Etcd: 3, Master: 1, Worker: 2}, nodes); remaining != (NodeCount{Etcd: 2}) {
+		t.Errorf("expected only 2 etcd nodes to be missing, got %+v", remaining)
+	}
+}
+
+func TestJoinExistingFirewall(t *testing.T) {
+	p, client := fakeProvisioner()
+	client.firewalls = []FirewallConfig{{ID: "fw-audited", Name: "audited", Tags: []string{"prod"}}}
+	opts := testOptions()
+	opts.FirewallName = "missing"
+	var err error
+	captureOutput(t, func() {
+		_, err = p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1})
+	})
+	if err == nil || !strings.Contains(err.Error(), `Firewall "missing" was not found`) {
+		t.Fatalf("expected an error for a missing firewall, got %v", err)
+	}
+	if len(client.droplets) != 0 {
+		t.Fatalf("no droplet must be created when the firewall is missing, got %d", len(client.droplets))
+	}
+
+	opts.FirewallName = "audited"
+	out := captureOutput(t, func() {
+		_, err = p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tags := client.firewalls[0].Tags; len(tags) != 2 || tags[1] != "test" {
+		t.Errorf("expected the cluster tag to be added to the firewall, got %v", tags)
+	}
+	if !strings.Contains(out, "Added the tag test to the targets of firewall audited (fw-audited)") {
+		t.Errorf("expected the change to be reported, got %q", out)
+	}
+	if len(p.state.JoinedFirewallIDs) != 1 || len(p.state.FirewallIDs) != 0 {
+		t.Errorf("expected the firewall to be recorded as joined, got %+v", p.state)
+	}
+
+	// Deleting by tag cannot tell the joined firewalls from the others
+	opts.AssumeYes = true
+	captureOutput(t, func() {
+		if err := p.TerminateNodes(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if len(client.firewalls) != 1 || len(client.firewalls[0].Tags) != 2 {
+		t.Errorf("expected the firewall to be kept with the cluster tag, got %+v", client.firewalls)
+	}
+
+	dir, err := ioutil.TempDir("", "kismatic-provision-state")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	p.state.path = filepath.Join(dir, "state.json")
+	if _, err = writeState(p.state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts.StateFile = p.state.path
+	captureOutput(t, func() {
+		if err := p.TerminateNodes(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if len(client.firewalls) != 1 || len(client.firewalls[0].Tags) != 1 || client.firewalls[0].Tags[0] != "prod" {
+		t.Errorf("expected the firewall to be kept without the cluster tag, got %+v", client.firewalls)
+	}
+}
+
+func TestTerminateNodesKeepsUserFirewall(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	opts.AssumeYes = true
+	client.firewalls = []FirewallConfig{
+		{ID: "fw-lock", Name: firewallName(opts.ClusterTag), Tags: []string{opts.ClusterTag}, TagSources: []string{opts.ClusterTag}},
+		{ID: "fw-user", Name: firewallName(opts.ClusterTag), Tags: []string{opts.ClusterTag, "prod"}},
+	}
+	captureOutput(t, func() {
+		if err := p.TerminateNodes(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if len(client.firewalls) != 1 || client.firewalls[0].ID != "fw-user" || len(client.firewalls[0].Tags) != 2 {
+		t.Errorf("expected only the lock-ssh firewall to be deleted, got %+v", client.firewalls)
+	}
+}
+
+func TestImportNodesTagInUse(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	client.CreateNode(opts.Token, NodeConfig{Name: "old-worker-1", Tags: []string{"old"}}, KeyConfig{})
+	client.CreateNode(opts.Token, NodeConfig{Name: "other-worker-1", Tags: []string{"test"}}, KeyConfig{})
+	opts.ImportTag = "old"
+	var err error
+	captureOutput(t, func() {
+		_, err = existingNodes(p, &opts)
+	})
+	if err == nil || !strings.Contains(err.Error(), "other-worker-1") {
+		t.Errorf("expected an error listing the droplet with the cluster tag, got %v", err)
+	}
+}
+
+func TestTerminateNodesOlderThan(t *testing.T) {
+	p, client := fakeProvisioner()
+	opts := testOptions()
+	captureOutput(t, func() {
+		if _, err := p.ProvisionNodes(context.Background(), opts, NodeCount{Etcd: 1, Master: 1, Worker: 1}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	for id, d := range client.droplets {
+		if d.Name != "test-worker-1" {
+			d.Created = time.Now().Add(-48 * time.Hour)
+			client.droplets[id] = d
+		}
+	}
+	opts.OlderThan = 24 * time.Hour
+	opts.AssumeYes = true
+	captureOutput(t, func() {
+		if err := p.TerminateNodes(opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+	if len(client.droplets) != 1 {
+		t.Fatalf("expected only the recent droplet to remain, got %d droplets", len(client.droplets))
+	}
+	for _, d := range client.droplets {
+		if d.Name != "test-worker-1" {
+			t.Errorf("droplet %s should have been removed", d.Name)
+		}
+	}
+	if len(client.deletedTags) != 0 {
+		t.Errorf("the tags of the remaining droplet must be kept, deleted %v", client.deletedTags)
+	}
+}
@@ -0,0 +1,89 @@
+package digitalocean
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	REGION_FEATURE_STORAGE            = "storage"
+	REGION_FEATURE_PRIVATE_NETWORKING = "private_networking"
+	REGION_FEATURE_IPV6               = "ipv6"
+	REGION_FEATURE_BACKUPS            = "backups"
+)
+
+func DORegionsCmd() *cobra.Command {
+	opts := DOOpts{}
+	cmd := &cobra.Command{
+		Use:   "regions",
+		Short: "Lists the Digital Ocean regions",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			return listRegions(opts)
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+
+	return cmd
+}
+
+func listRegions(opts DOOpts) error {
+	if err := resolveToken(&opts); err != nil {
+		return err
+	}
+
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	regions, err := provisioner.ListRegions(opts)
+	if err != nil {
+		return err
+	}
+	printRegions(os.Stdout, regions)
+	return nil
+}
+
+// HasFeature reports whether the region supports the Digital Ocean feature
+func (r RegionConfig) HasFeature(feature string) bool {
+	for _, f := range r.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// findRegion returns the available region with the given slug
+func findRegion(slug string, regions []RegionConfig) (RegionConfig, error) {
+	slugs := []string{}
+	for _, r := range regions {
+		if !r.Available {
+			continue
+		}
+		if r.Slug == slug {
+			return r, nil
+		}
+		slugs = append(slugs, r.Slug)
+	}
+	sort.Strings(slugs)
+	return RegionConfig{}, fmt.Errorf("Region %q is not available. Valid regions: %s", slug, strings.Join(slugs, ", "))
+}
+
+func printRegions(out io.Writer, regions []RegionConfig) {
+	tw := tabwriter.NewWriter(out, 10, 4, 3, ' ', 0)
+	fmt.Fprint(tw, "SLUG\tNAME\tAVAILABLE\tPRIVATE NETWORKING\tBLOCK STORAGE\n")
+	for _, r := range regions {
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%v\t%v\n", r.Slug, r.Name, r.Available, r.HasFeature(REGION_FEATURE_PRIVATE_NETWORKING), r.HasFeature(REGION_FEATURE_STORAGE))
+	}
+	tw.Flush()
+}
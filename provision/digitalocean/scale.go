@@ -0,0 +1,190 @@
+package digitalocean
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/apprenda/kismatic-provision/provision/plan"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func DOScaleCmd() *cobra.Command {
+	opts := DOOpts{}
+	var planFile string
+	cmd := &cobra.Command{
+		Use:   "scale",
+		Short: "Adds worker nodes to an existing cluster.",
+		Long: `Adds worker nodes to an existing cluster. The new nodes use the same region, image, size and VPC
+as the existing worker nodes of the cluster with the given tag. If a plan file is provided, the new nodes are appended
+to its worker section. Comments in the plan file are not preserved.`,
+		Example: `# Add 3 worker nodes to the cluster tagged apprenda
+provision do scale --workers 3 --tag apprenda`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			return scaleInfra(opts, planFile)
+		},
+	}
+
+	cmd.Flags().Uint16VarP(&opts.WorkerNodeCount, "workers", "w", 1, "Count of worker nodes to add.")
+	cmd.Flags().StringVarP(&opts.ClusterTag, "tag", "", "apprenda", "TAG of the cluster to add nodes to")
+	cmd.Flags().StringVarP(&opts.NamePrefix, "name-prefix", "", "", "Prefix of the new droplet names, e.g. apprenda-worker-4. Defaults to the cluster tag")
+	cmd.Flags().StringVarP(&opts.SSHUser, "sshuser", "", "root", "SSH User name. A user other than root is created on the nodes with passwordless sudo and the provisioning key")
+	cmd.Flags().StringVarP(&opts.SSHPrivateKey, "ssh-key", "", "", "Path to the SSH private key used to access the nodes. Defaults to $DO_SECRET_ACCESS_KEY or ssh/cluster.pem next to the executable.")
+	cmd.Flags().StringVarP(&opts.SSHPublicKey, "ssh-pubkey", "", "", "Path to the SSH public key uploaded to Digital Ocean. Defaults to the private key path with a .pub suffix.")
+	cmd.Flags().StringSliceVarP(&opts.ExtraSSHKeys, "extra-ssh-keys", "", []string{}, "Comma separated names or fingerprints of SSH keys in the Digital Ocean account that are also authorized on the new nodes.")
+	cmd.Flags().StringVarP(&planFile, "plan-file", "", "", "Path to an existing plan file to append the new worker nodes to")
+	cmd.Flags().IntVarP(&opts.MaxParallel, "max-parallel", "", 10, "Maximum number of droplets being created at the same time.")
+	cmd.Flags().IntVarP(&opts.SSHPort, "ssh-port", "", 22, "Port on which sshd listens on the nodes.")
+	cmd.Flags().BoolVarP(&opts.WaitForActive, "wait-for-active", "", false, "If present, waits until each droplet is active and has both its public and private IP before continuing.")
+	cmd.Flags().DurationVarP(&opts.ActiveTimeout, "active-timeout", "", 10*time.Minute, "How long to wait for the IPs of each droplet to be assigned.")
+	cmd.Flags().DurationVarP(&opts.SSHTimeout, "ssh-timeout", "", 5*time.Minute, "How long to wait for all the nodes to become accessible via SSH.")
+	cmd.Flags().StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+
+	return cmd
+}
+
+func scaleInfra(opts DOOpts, planFile string) error {
+	if opts.WorkerNodeCount == 0 {
+		return fmt.Errorf("At least one worker node must be requested")
+	}
+	if err := resolveToken(&opts); err != nil {
+		return err
+	}
+	if err := resolveKeyFiles(&opts); err != nil {
+		return err
+	}
+	resolveInstallDir(&opts)
+
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	existing, err := provisioner.client.ListDropletsByTag(opts.Token, opts.ClusterTag)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return fmt.Errorf("No nodes found with the tag %q", opts.ClusterTag)
+	}
+
+	// Use an existing worker as the template for the new ones
+	template := existing[0]
+	// New workers are numbered after the highest existing index, so that names stay
+	// unique even if some workers were deleted
+	var workers, lastIndex int
+	for _, d := range existing {
+		if role, index := parseNodeName(d.Name); role == "worker" {
+			if workers == 0 {
+				template = d
+			}
+			workers++
+			if index > lastIndex {
+				lastIndex = index
+			}
+		}
+	}
+	if template.Image == "" {
+		return fmt.Errorf("Cannot determine the image of node %s", template.Name)
+	}
+	opts.Region = template.Region
+	opts.Image = template.Image
+	opts.InstanceType = template.Size
+	opts.WorkerType = template.Size
+	opts.VPCUUID = template.VPCUUID
+	opts.NoPrivateNetworking = template.PrivateIP == ""
+	opts.IPv6 = template.PublicIPv6 != ""
+	opts.WorkerStartIndex = uint16(lastIndex)
+	// The new workers join the nodes of the cluster
+	opts.ReuseTag = true
+
+	logger.Infof("Adding %d worker node(s) to the cluster %s\n", opts.WorkerNodeCount, opts.ClusterTag)
+	defer saveState(provisioner.state)
+	ctx, cancel := interruptContext()
+	defer cancel()
+	nodes, err := provisioner.ProvisionNodes(ctx, opts, NodeCount{Worker: opts.WorkerNodeCount})
+	if err == nil {
+		logger.Infof("Waiting for SSH\n")
+		err = WaitForSSH(ctx, nodes, opts.SSHPrivateKey, opts.SSHPort, opts.SSHTimeout)
+	}
+	if err != nil {
+		// Only the new workers are removed, the existing nodes are left alone
+		if ctx.Err() != nil {
+			provisioner.Rollback(opts)
+			return fmt.Errorf("Scaling was interrupted")
+		}
+		return err
+	}
+
+	printNodesTable(os.Stdout, &ProvisionedNodes{Worker: nodes.Worker}, provisioner.sizesForTable(opts))
+
+	if planFile != "" {
+		if err = appendWorkersToPlan(planFile, nodes.Worker); err != nil {
+			return err
+		}
+		logger.Infof("Added the new worker nodes to %v\n", planFile)
+	}
+	return nil
+}
+
+// appendWorkersToPlan adds the nodes to the worker section of an existing plan file
+func appendWorkersToPlan(planFile string, workers []plan.Node) error {
+	data, err := ioutil.ReadFile(planFile)
+	if err != nil {
+		return fmt.Errorf("Cannot read plan file %q: %v", planFile, err)
+	}
+	pln := yaml.MapSlice{}
+	if err = yaml.Unmarshal(data, &pln); err != nil {
+		return fmt.Errorf("Cannot parse plan file %q: %v", planFile, err)
+	}
+
+	found := false
+	for i := range pln {
+		if pln[i].Key != "worker" {
+			continue
+		}
+		section, ok := pln[i].Value.(yaml.MapSlice)
+		if !ok {
+			return fmt.Errorf("Unexpected format of the worker section in %q", planFile)
+		}
+		for j := range section {
+			if section[j].Key != "nodes" {
+				continue
+			}
+			nodes, _ := section[j].Value.([]interface{})
+			for _, w := range workers {
+				internalIP := w.PrivateIPv4
+				if internalIP == "" {
+					internalIP = w.PublicIPv4
+				}
+				nodes = append(nodes, yaml.MapSlice{
+					{Key: "host", Value: w.Host},
+					{Key: "ip", Value: w.PublicIPv4},
+					{Key: "internalip", Value: internalIP},
+					{Key: "labels", Value: map[string]string{}},
+				})
+			}
+			section[j].Value = nodes
+			for k := range section {
+				if section[k].Key == "expected_count" {
+					section[k].Value = len(nodes)
+				}
+			}
+			found = true
+		}
+		pln[i].Value = section
+	}
+	if !found {
+		return fmt.Errorf("No worker nodes section found in %q", planFile)
+	}
+
+	out, err := yaml.Marshal(pln)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(planFile, out, 0644)
+}
@@ -1,9 +1,19 @@
 #!/bin/bash
-sudo apt-get update -y &&
-wget --no-check-certificate -O - https://github.com/apprenda/kismatic/releases/download/v1.2.1/kismatic-v1.2.1-linux-amd64.tar.gz | tar -zx && 
-sudo apt-get -y install git build-essential &&
-sudo apt-get install -qq python2.7 && ln -s /usr/bin/python2.7 /usr/bin/python &&
-curl -LO https://storage.googleapis.com/kubernetes-release/release/$(curl -s https://storage.googleapis.com/kubernetes-release/release/stable.txt)/bin/linux/amd64/kubectl &&
-chmod +x ./kubectl &&
-sudo mv ./kubectl /usr/local/bin/kubectl
-
+KET_VERSION=${KET_VERSION:-v1.2.1} &&
+INSTALL_KISMATIC=${INSTALL_KISMATIC:-true} &&
+INSTALL_KUBECTL=${INSTALL_KUBECTL:-true} &&
+sudo -E apt-get update -y &&
+if [ "$INSTALL_KISMATIC" = "true" ]; then
+  wget --no-check-certificate -O - https://github.com/apprenda/kismatic/releases/download/${KET_VERSION}/kismatic-${KET_VERSION}-linux-amd64.tar.gz | tar -zx
+fi &&
+sudo -E apt-get -y install git build-essential &&
+sudo -E apt-get install -qq python2.7 && ln -s /usr/bin/python2.7 /usr/bin/python &&
+if [ "$INSTALL_KUBECTL" = "true" ]; then
+  KUBECTL_VERSION=${KUBECTL_VERSION:-$(curl -s https://storage.googleapis.com/kubernetes-release/release/stable.txt)} &&
+  curl -LO https://storage.googleapis.com/kubernetes-release/release/${KUBECTL_VERSION}/bin/linux/amd64/kubectl &&
+  chmod +x ./kubectl &&
+  sudo mv ./kubectl /usr/local/bin/kubectl
+fi &&
+if [ -n "$SSH_USER" ] && [ "$SSH_USER" != "root" ]; then
+  sudo chown -R "$SSH_USER" .
+fi
@@ -0,0 +1,260 @@
+package digitalocean
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+func DOSizesCmd() *cobra.Command {
+	opts := DOOpts{}
+	cmd := &cobra.Command{
+		Use:   "sizes",
+		Short: "Lists the instance sizes available in a region",
+		Example: `# List the sizes that can be deployed in Toronto
+provision do sizes --region tor1`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			return listSizes(opts)
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.Region, "region", "", "tor1", "Region to list the sizes for")
+	cmd.Flags().StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+
+	return cmd
+}
+
+func listSizes(opts DOOpts) error {
+	if err := resolveToken(&opts); err != nil {
+		return err
+	}
+
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	sizes, err := provisioner.ListSizes(opts)
+	if err != nil {
+		return err
+	}
+	printSizes(os.Stdout, sizes)
+	return nil
+}
+
+func printSizes(out io.Writer, sizes []SizeConfig) {
+	tw := tabwriter.NewWriter(out, 10, 4, 3, ' ', 0)
+	fmt.Fprint(tw, "SLUG\tVCPUS\tMEMORY\tDISK\tHOURLY\tMONTHLY\n")
+	for _, sz := range sizes {
+		fmt.Fprintf(tw, "%s\t%d\t%dMB\t%dGB\t$%.5f\t$%.2f\n", sz.Slug, sz.VCPUs, sz.MemoryMB, sz.DiskGB, sz.PriceHourly, sz.PriceMonthly)
+	}
+	tw.Flush()
+}
+
+// sizeAliases maps the legacy size names to the current Digital Ocean size slugs
+var sizeAliases = map[string]string{
+	"1gb": "s-1vcpu-1gb",
+	"2gb": "s-1vcpu-2gb",
+	"4gb": "s-2vcpu-4gb",
+}
+
+// resolveSize returns the Digital Ocean size slug for the given size or alias
+func resolveSize(size string) string {
+	if slug, ok := sizeAliases[size]; ok {
+		return slug
+	}
+	return size
+}
+
+// dropletClassPrefixes maps the droplet classes to the prefix of their size slugs
+var dropletClassPrefixes = map[string]string{
+	"basic":  "s-",
+	"cpu":    "c-",
+	"memory": "m-",
+}
+
+// sizeForClass returns the cheapest size of the droplet class with at least the requested
+// vCPUs and memory that is available in all the regions
+func sizeForClass(class string, vcpus int, memoryGB int, regions []string, sizes []SizeConfig) (SizeConfig, error) {
+	prefix, ok := dropletClassPrefixes[class]
+	if !ok {
+		return SizeConfig{}, fmt.Errorf("%v is not a valid droplet class. Current options: basic, cpu, memory", class)
+	}
+	candidates := []SizeConfig{}
+	for _, sz := range sizes {
+		if !strings.HasPrefix(sz.Slug, prefix) || sz.VCPUs < vcpus || sz.MemoryMB < memoryGB*1024 {
+			continue
+		}
+		inAll := true
+		for _, region := range regions {
+			if len(sizesInRegion([]SizeConfig{sz}, region)) == 0 {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			candidates = append(candidates, sz)
+		}
+	}
+	if len(candidates) == 0 {
+		return SizeConfig{}, fmt.Errorf("No %s size with at least %d vCPUs and %dGB of memory is available in %s", class, vcpus, memoryGB, strings.Join(regions, ", "))
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].PriceMonthly != candidates[j].PriceMonthly {
+			return candidates[i].PriceMonthly < candidates[j].PriceMonthly
+		}
+		return candidates[i].Slug < candidates[j].Slug
+	})
+	return candidates[0], nil
+}
+
+// sizesInRegion returns the sizes that can be deployed in the region
+func sizesInRegion(sizes []SizeConfig, region string) []SizeConfig {
+	available := []SizeConfig{}
+	for _, sz := range sizes {
+		if !sz.Available {
+			continue
+		}
+		for _, r := range sz.Regions {
+			if r == region {
+				available = append(available, sz)
+				break
+			}
+		}
+	}
+	return available
+}
+
+// validateSize checks that the size is available in the region
+func validateSize(size string, region string, sizes []SizeConfig) error {
+	slugs := []string{}
+	for _, sz := range sizesInRegion(sizes, region) {
+		if sz.Slug == size {
+			return nil
+		}
+		slugs = append(slugs, sz.Slug)
+	}
+	sort.Strings(slugs)
+	return fmt.Errorf("Size %q is not available in region %s. Valid sizes: %s", size, region, strings.Join(slugs, ", "))
+}
+
+// VOLUME_PRICE_PER_GB is the monthly price of a GB of block storage
+const VOLUME_PRICE_PER_GB = 0.10
+
+// BACKUP_PRICE_RATIO is the price of the weekly backups of a droplet, relative to its price
+const BACKUP_PRICE_RATIO = 0.20
+
+// costItem is the cost of the nodes of one role
+type costItem struct {
+	Role         string
+	Count        uint16
+	Size         string
+	PriceMonthly float64
+	PriceHourly  float64
+}
+
+// costEstimate is the estimated cost of the infrastructure to be provisioned
+type costEstimate struct {
+	Items             []costItem
+	VolumeCount       uint16
+	VolumeSizeGB      int
+	VolumeMonthly     float64
+	EtcdVolumeCount   uint16
+	EtcdVolumeSizeGB  int
+	EtcdVolumeMonthly float64
+	BackupRoles       []string
+	BackupHourly      float64
+	BackupMonthly     float64
+	Hourly            float64
+	Monthly           float64
+}
+
+// estimateCost sums the price of each requested size times the node count, plus the
+// backups and the worker and etcd volumes. The sizes must be resolved.
+func estimateCost(opts *DOOpts, nodeCount NodeCount, sizes []SizeConfig) (costEstimate, error) {
+	estimate := costEstimate{}
+	counts := map[string]uint16{
+		"etcd":      nodeCount.Etcd,
+		"master":    nodeCount.Master,
+		"worker":    nodeCount.Worker,
+		"ingress":   nodeCount.Ingress,
+		"bootstrap": nodeCount.Bootstrap,
+	}
+	for _, role := range ROLES {
+		count := counts[role]
+		if count == 0 {
+			continue
+		}
+		slug := sizeForRole(opts, role)
+		var size *SizeConfig
+		for i := range sizes {
+			if sizes[i].Slug == slug {
+				size = &sizes[i]
+				break
+			}
+		}
+		if size == nil {
+			return estimate, fmt.Errorf("No price found for size %s", slug)
+		}
+		item := costItem{
+			Role:         role,
+			Count:        count,
+			Size:         slug,
+			PriceHourly:  size.PriceHourly * float64(count),
+			PriceMonthly: size.PriceMonthly * float64(count),
+		}
+		estimate.Items = append(estimate.Items, item)
+		estimate.Hourly += item.PriceHourly
+		estimate.Monthly += item.PriceMonthly
+		if backupsForRole(opts, role) {
+			estimate.BackupRoles = append(estimate.BackupRoles, role)
+			estimate.BackupHourly += item.PriceHourly * BACKUP_PRICE_RATIO
+			estimate.BackupMonthly += item.PriceMonthly * BACKUP_PRICE_RATIO
+		}
+	}
+	estimate.Hourly += estimate.BackupHourly
+	estimate.Monthly += estimate.BackupMonthly
+	if opts.VolumeSizeGB > 0 && nodeCount.Worker > 0 {
+		estimate.VolumeCount = nodeCount.Worker
+		estimate.VolumeSizeGB = opts.VolumeSizeGB
+		estimate.VolumeMonthly = float64(opts.VolumeSizeGB) * VOLUME_PRICE_PER_GB * float64(nodeCount.Worker)
+		estimate.Monthly += estimate.VolumeMonthly
+		// volumes are billed hourly, based on a month of 672 hours
+		estimate.Hourly += estimate.VolumeMonthly / 672
+	}
+	if opts.EtcdSeparateDisk && nodeCount.Etcd > 0 {
+		estimate.EtcdVolumeCount = nodeCount.Etcd
+		estimate.EtcdVolumeSizeGB = opts.EtcdVolumeSizeGB
+		estimate.EtcdVolumeMonthly = float64(opts.EtcdVolumeSizeGB) * VOLUME_PRICE_PER_GB * float64(nodeCount.Etcd)
+		estimate.Monthly += estimate.EtcdVolumeMonthly
+		estimate.Hourly += estimate.EtcdVolumeMonthly / 672
+	}
+	return estimate, nil
+}
+
+func printCostEstimate(out io.Writer, estimate costEstimate) {
+	fmt.Fprintln(out, "Estimated cost:")
+	tw := tabwriter.NewWriter(out, 10, 4, 3, ' ', 0)
+	fmt.Fprint(tw, "  ROLE\tCOUNT\tSIZE\tHOURLY\tMONTHLY\n")
+	for _, item := range estimate.Items {
+		fmt.Fprintf(tw, "  %s\t%d\t%s\t$%.5f\t$%.2f\n", item.Role, item.Count, item.Size, item.PriceHourly, item.PriceMonthly)
+	}
+	if estimate.BackupMonthly > 0 {
+		fmt.Fprintf(tw, "  backups\t\t%s\t$%.5f\t$%.2f\n", strings.Join(estimate.BackupRoles, ","), estimate.BackupHourly, estimate.BackupMonthly)
+	}
+	if estimate.VolumeCount > 0 {
+		fmt.Fprintf(tw, "  volume\t%d\t%dGB\t\t$%.2f\n", estimate.VolumeCount, estimate.VolumeSizeGB, estimate.VolumeMonthly)
+	}
+	if estimate.EtcdVolumeCount > 0 {
+		fmt.Fprintf(tw, "  etcd volume\t%d\t%dGB\t\t$%.2f\n", estimate.EtcdVolumeCount, estimate.EtcdVolumeSizeGB, estimate.EtcdVolumeMonthly)
+	}
+	fmt.Fprintf(tw, "  total\t\t\t$%.5f\t$%.2f\n", estimate.Hourly, estimate.Monthly)
+	tw.Flush()
+}
@@ -0,0 +1,315 @@
+package digitalocean
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ClusterSpec is the declarative description of a cluster provisioned by the apply command.
+// A role without a section gets no nodes.
+type ClusterSpec struct {
+	Tag       string         `yaml:"tag"`
+	Region    string         `yaml:"region"`
+	Image     string         `yaml:"image"`
+	Size      string         `yaml:"size"`
+	SSHUser   string         `yaml:"ssh_user"`
+	Tags      []string       `yaml:"tags"`
+	Etcd      *EtcdSpec      `yaml:"etcd"`
+	Master    *MasterSpec    `yaml:"master"`
+	Worker    *WorkerSpec    `yaml:"worker"`
+	Ingress   *IngressSpec   `yaml:"ingress"`
+	Bootstrap *BootstrapSpec `yaml:"bootstrap"`
+	Network   NetworkSpec    `yaml:"network"`
+	Firewall  FirewallSpec   `yaml:"firewall"`
+}
+
+// RoleSpec holds the settings shared by the etcd, master and worker roles
+type RoleSpec struct {
+	Count   uint16 `yaml:"count"`
+	Size    string `yaml:"size"`
+	Region  string `yaml:"region"`
+	Backups bool   `yaml:"backups"`
+}
+
+type EtcdSpec struct {
+	RoleSpec     `yaml:",inline"`
+	VolumeSizeGB int `yaml:"volume_size_gb"`
+}
+
+type MasterSpec struct {
+	RoleSpec     `yaml:",inline"`
+	LoadBalancer bool   `yaml:"load_balancer"`
+	FloatingIP   bool   `yaml:"floating_ip"`
+	DNSDomain    string `yaml:"dns_domain"`
+	DNSRecord    string `yaml:"dns_record"`
+}
+
+type WorkerSpec struct {
+	RoleSpec     `yaml:",inline"`
+	VolumeSizeGB int      `yaml:"volume_size_gb"`
+	Storage      bool     `yaml:"storage"`
+	Labels       []string `yaml:"labels"`
+	Taints       []string `yaml:"taints"`
+}
+
+// IngressSpec describes the dedicated ingress nodes, which use the default size and regions
+type IngressSpec struct {
+	Count   uint16   `yaml:"count"`
+	Backups bool     `yaml:"backups"`
+	Labels  []string `yaml:"labels"`
+	Taints  []string `yaml:"taints"`
+}
+
+type BootstrapSpec struct {
+	Size    string `yaml:"size"`
+	Backups bool   `yaml:"backups"`
+}
+
+type NetworkSpec struct {
+	VPC                 string `yaml:"vpc"`
+	NoPrivateNetworking bool   `yaml:"no_private_networking"`
+	IPv6                bool   `yaml:"ipv6"`
+	Mode                string `yaml:"mode"`
+	PodCIDR             string `yaml:"pod_cidr"`
+	ServiceCIDR         string `yaml:"service_cidr"`
+}
+
+type FirewallSpec struct {
+	LockSSH           bool     `yaml:"lock_ssh"`
+	NodeExporter      bool     `yaml:"node_exporter"`
+	NodeExporterCIDRs []string `yaml:"node_exporter_cidrs"`
+}
+
+func DOApplyCmd() *cobra.Command {
+	opts := DOOpts{}
+	var specFile string
+	cmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Creates the infrastructure described by a cluster spec file.",
+		Long: `Creates the infrastructure described by a declarative cluster spec file. The spec sets the node counts,
+sizes and regions of each role, together with the volumes, networking and firewall of the cluster. A role without a
+section in the spec gets no nodes. Unknown fields are rejected.
+The flags of the create command are accepted as well. An explicit flag takes precedence over the spec.`,
+		Example: `# Create the cluster described in cluster-spec.yaml
+provision do apply -f cluster-spec.yaml
+
+# cluster-spec.yaml
+tag: demo
+region: tor1
+size: 2gb
+etcd:
+  count: 3
+  volume_size_gb: 20
+master:
+  count: 1
+  load_balancer: true
+worker:
+  count: 3
+  size: 4gb
+  labels: [tier=app]
+bootstrap: {}
+firewall:
+  lock_ssh: true`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if specFile == "" {
+				return fmt.Errorf("A cluster spec file is required, set it with -f")
+			}
+			if opts.Preset != "" {
+				return fmt.Errorf("The --preset option cannot be used with a cluster spec file")
+			}
+			spec, err := loadSpec(specFile)
+			if err != nil {
+				return err
+			}
+			if err := applyEnvironment(cmd.LocalFlags()); err != nil {
+				return err
+			}
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			applySpec(&opts, spec, cmd.Flags())
+			return makeInfra(opts)
+		},
+	}
+
+	cmd.Flags().StringVarP(&specFile, "file", "f", "", "Path to the cluster spec file")
+	addCreateFlags(cmd.Flags(), &opts)
+
+	return cmd
+}
+
+// loadSpec reads and validates the cluster spec file
+func loadSpec(path string) (*ClusterSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read cluster spec file %q: %v", path, err)
+	}
+	spec := &ClusterSpec{}
+	if err = yaml.UnmarshalStrict(data, spec); err != nil {
+		return nil, fmt.Errorf("Cannot parse cluster spec file %q: %v", path, err)
+	}
+	if err = validateSpec(spec); err != nil {
+		return nil, fmt.Errorf("Invalid cluster spec file %q:\n%v", path, err)
+	}
+	return spec, nil
+}
+
+// validateSpec checks the spec for the errors that cannot be attributed to a flag
+func validateSpec(spec *ClusterSpec) error {
+	msg := ""
+	if spec.Tag == "" {
+		msg = msg + " - tag is required\n"
+	}
+	if spec.Etcd == nil && spec.Master == nil && spec.Worker == nil {
+		msg = msg + " - at least one of etcd, master or worker is required\n"
+	}
+	counts := map[string]*uint16{}
+	if spec.Etcd != nil {
+		counts["etcd"] = &spec.Etcd.Count
+	}
+	if spec.Master != nil {
+		counts["master"] = &spec.Master.Count
+	}
+	if spec.Worker != nil {
+		counts["worker"] = &spec.Worker.Count
+	}
+	if spec.Ingress != nil {
+		counts["ingress"] = &spec.Ingress.Count
+	}
+	for _, role := range ROLES {
+		if count, ok := counts[role]; ok && *count == 0 {
+			msg = msg + fmt.Sprintf(" - %s.count must be at least 1, remove the %s section for no %s nodes\n", role, role, role)
+		}
+	}
+	if spec.Etcd != nil && spec.Etcd.VolumeSizeGB < 0 {
+		msg = msg + " - etcd.volume_size_gb cannot be negative\n"
+	}
+	if spec.Worker != nil && spec.Worker.VolumeSizeGB < 0 {
+		msg = msg + " - worker.volume_size_gb cannot be negative\n"
+	}
+	if len(spec.Firewall.NodeExporterCIDRs) > 0 && !spec.Firewall.NodeExporter {
+		msg = msg + " - firewall.node_exporter_cidrs requires firewall.node_exporter\n"
+	}
+	if msg != "" {
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// applySpec sets the options from the spec. Values of flags that were explicitly set are
+// left untouched.
+func applySpec(opts *DOOpts, spec *ClusterSpec, flags *pflag.FlagSet) {
+	setFromConfig(&opts.ClusterTag, spec.Tag, "tag", flags)
+	setFromConfig(&opts.Region, spec.Region, "region", flags)
+	setFromConfig(&opts.Image, spec.Image, "image", flags)
+	setFromConfig(&opts.InstanceType, spec.Size, "instance-type", flags)
+	// the worker size has its own default, which the spec size replaces as well
+	setFromConfig(&opts.WorkerType, spec.Size, "worker-type", flags)
+	setFromConfig(&opts.SSHUser, spec.SSHUser, "sshuser", flags)
+	setSliceFromSpec(&opts.ExtraTags, spec.Tags, "extra-tag", flags)
+
+	backupRoles := []string{}
+	setCount := func(field *uint16, count uint16, flag string) {
+		if !flagChanged(flags, flag) {
+			*field = count
+		}
+	}
+	setBool := func(field *bool, value bool, flag string) {
+		if value && !flagChanged(flags, flag) {
+			*field = true
+		}
+	}
+
+	setCount(&opts.EtcdNodeCount, 0, "etcdNodeCount")
+	if e := spec.Etcd; e != nil {
+		setCount(&opts.EtcdNodeCount, e.Count, "etcdNodeCount")
+		setFromConfig(&opts.EtcdType, e.Size, "etcd-type", flags)
+		setFromConfig(&opts.EtcdRegion, e.Region, "etcd-region", flags)
+		if e.Backups {
+			backupRoles = append(backupRoles, "etcd")
+		}
+		if e.VolumeSizeGB > 0 {
+			setBool(&opts.EtcdSeparateDisk, true, "etcd-separate-disk")
+			if !flagChanged(flags, "etcd-volume-size") {
+				opts.EtcdVolumeSizeGB = e.VolumeSizeGB
+			}
+		}
+	}
+
+	setCount(&opts.MasterNodeCount, 0, "masterdNodeCount")
+	if m := spec.Master; m != nil {
+		setCount(&opts.MasterNodeCount, m.Count, "masterdNodeCount")
+		setFromConfig(&opts.MasterType, m.Size, "master-type", flags)
+		setFromConfig(&opts.MasterRegion, m.Region, "master-region", flags)
+		if m.Backups {
+			backupRoles = append(backupRoles, "master")
+		}
+		setBool(&opts.CreateLB, m.LoadBalancer, "lb")
+		setBool(&opts.FloatingIP, m.FloatingIP, "floating-ip")
+		setFromConfig(&opts.DNSDomain, m.DNSDomain, "dns-domain", flags)
+		setFromConfig(&opts.DNSRecord, m.DNSRecord, "dns-record", flags)
+	}
+
+	setCount(&opts.WorkerNodeCount, 0, "workerNodeCount")
+	if w := spec.Worker; w != nil {
+		setCount(&opts.WorkerNodeCount, w.Count, "workerNodeCount")
+		setFromConfig(&opts.WorkerType, w.Size, "worker-type", flags)
+		setFromConfig(&opts.WorkerRegion, w.Region, "worker-region", flags)
+		if w.Backups {
+			backupRoles = append(backupRoles, "worker")
+		}
+		if w.VolumeSizeGB > 0 && !flagChanged(flags, "volume-size") {
+			opts.VolumeSizeGB = w.VolumeSizeGB
+		}
+		setBool(&opts.Storage, w.Storage, "storage-cluster")
+		setSliceFromSpec(&opts.WorkerLabels, w.Labels, "worker-labels", flags)
+		setSliceFromSpec(&opts.WorkerTaints, w.Taints, "worker-taints", flags)
+	}
+
+	setCount(&opts.IngressNodeCount, 0, "ingress-count")
+	if i := spec.Ingress; i != nil {
+		setCount(&opts.IngressNodeCount, i.Count, "ingress-count")
+		if i.Backups {
+			backupRoles = append(backupRoles, "ingress")
+		}
+		setSliceFromSpec(&opts.IngressLabels, i.Labels, "ingress-labels", flags)
+		setSliceFromSpec(&opts.IngressTaints, i.Taints, "ingress-taints", flags)
+	}
+
+	if !flagChanged(flags, "bootstrap") {
+		opts.BootstrapNode = spec.Bootstrap != nil
+	}
+	if b := spec.Bootstrap; b != nil {
+		setFromConfig(&opts.BootstrapType, b.Size, "bootstrap-type", flags)
+		if b.Backups {
+			backupRoles = append(backupRoles, "bootstrap")
+		}
+	}
+
+	if len(backupRoles) > 0 && !flagChanged(flags, "backups") && !flagChanged(flags, "backups-roles") {
+		opts.Backups = true
+		opts.BackupRoles = backupRoles
+	}
+
+	setFromConfig(&opts.VPCUUID, spec.Network.VPC, "vpc", flags)
+	setBool(&opts.NoPrivateNetworking, spec.Network.NoPrivateNetworking, "no-private-networking")
+	setBool(&opts.IPv6, spec.Network.IPv6, "ipv6")
+	setFromConfig(&opts.NetworkMode, spec.Network.Mode, "network-mode", flags)
+	setFromConfig(&opts.PodCIDR, spec.Network.PodCIDR, "pod-cidr", flags)
+	setFromConfig(&opts.ServiceCIDR, spec.Network.ServiceCIDR, "service-cidr", flags)
+
+	setBool(&opts.LockSSH, spec.Firewall.LockSSH, "lock-ssh")
+	setBool(&opts.NodeExporter, spec.Firewall.NodeExporter, "node-exporter")
+	setSliceFromSpec(&opts.NodeExporterSources, spec.Firewall.NodeExporterCIDRs, "node-exporter-cidr", flags)
+}
+
+func setSliceFromSpec(field *[]string, value []string, flag string, flags *pflag.FlagSet) {
+	if len(value) == 0 || flagChanged(flags, flag) {
+		return
+	}
+	*field = value
+}
@@ -0,0 +1,100 @@
+package digitalocean
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSpec(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "spec")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path := filepath.Join(dir, "cluster-spec.yaml")
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return path
+}
+
+func TestLoadSpecRejectsUnknownFields(t *testing.T) {
+	path := writeSpec(t, "tag: demo\nworker:\n  count: 1\n  flavor: large\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	if _, err := loadSpec(path); err == nil || !strings.Contains(err.Error(), "flavor") {
+		t.Errorf("expected an error for the unknown field, got %v", err)
+	}
+}
+
+func TestLoadSpecValidation(t *testing.T) {
+	path := writeSpec(t, "etcd:\n  count: 0\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	_, err := loadSpec(path)
+	if err == nil {
+		t.Fatalf("expected an error for an invalid spec")
+	}
+	for _, want := range []string{"tag is required", "etcd.count must be at least 1"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to contain %q, got %v", want, err)
+		}
+	}
+}
+
+func TestApplySpec(t *testing.T) {
+	path := writeSpec(t, `tag: demo
+region: nyc3
+size: 2gb
+etcd:
+  count: 3
+  volume_size_gb: 20
+  backups: true
+master:
+  count: 1
+  load_balancer: true
+worker:
+  count: 2
+  size: 8gb
+  labels: [tier=app]
+firewall:
+  lock_ssh: true
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	spec, err := loadSpec(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts := DOOpts{}
+	cmd := DOApplyCmd()
+	flags := cmd.Flags()
+	if err = flags.Parse([]string{"-w", "5"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts.WorkerNodeCount = 5
+	opts.BootstrapNode = true
+	applySpec(&opts, spec, flags)
+
+	if opts.ClusterTag != "demo" || opts.Region != "nyc3" || opts.InstanceType != "2gb" || opts.WorkerType != "8gb" {
+		t.Errorf("unexpected cluster options: %+v", opts)
+	}
+	if opts.EtcdNodeCount != 3 || opts.MasterNodeCount != 1 || opts.IngressNodeCount != 0 {
+		t.Errorf("unexpected node counts %d/%d/%d", opts.EtcdNodeCount, opts.MasterNodeCount, opts.IngressNodeCount)
+	}
+	if opts.WorkerNodeCount != 5 {
+		t.Errorf("the flag must take precedence over the spec, got %d workers", opts.WorkerNodeCount)
+	}
+	if opts.BootstrapNode {
+		t.Errorf("no bootstrap node must be created without a bootstrap section")
+	}
+	if !opts.EtcdSeparateDisk || opts.EtcdVolumeSizeGB != 20 {
+		t.Errorf("expected a 20GB etcd volume, got %v %d", opts.EtcdSeparateDisk, opts.EtcdVolumeSizeGB)
+	}
+	if !opts.Backups || len(opts.BackupRoles) != 1 || opts.BackupRoles[0] != "etcd" {
+		t.Errorf("expected backups of the etcd nodes only, got %v %v", opts.Backups, opts.BackupRoles)
+	}
+	if !opts.CreateLB || !opts.LockSSH || len(opts.WorkerLabels) != 1 {
+		t.Errorf("unexpected options: %+v", opts)
+	}
+}
@@ -1,16 +1,24 @@
 package digitalocean
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/apprenda/kismatic-provision/provision/plan"
+	"golang.org/x/crypto/ssh"
 )
 
-func runViaSSH(cmds []string, hosts []plan.Node, sshKey string, period time.Duration) error {
+func runViaSSH(cmds []string, hosts []plan.Node, sshKey string, sshPort int, period time.Duration) error {
 	timeout := time.After(period)
 	bail := make(chan struct{})
 	cmdSuccess := make(chan bool)
@@ -22,8 +30,8 @@ func runViaSSH(cmds []string, hosts []plan.Node, sshKey string, period time.Dura
 	for _, host := range hosts {
 		go func(node plan.Node) {
 			for _, cmd := range cmds {
-				res, err := ExecuteCmd(cmd, node.PublicIPv4, node.SSHUser, sshKey)
-				fmt.Println(res)
+				res, err := ExecuteCmd(cmd, node.PublicIPv4, node.SSHUser, sshKey, sshPort)
+				logger.Infof("%v\n", res)
 				select {
 				case cmdSuccess <- err == nil:
 					if err != nil {
@@ -54,20 +62,20 @@ func runViaSSH(cmds []string, hosts []plan.Node, sshKey string, period time.Dura
 	return nil
 }
 
-func ExecuteCmd(cmd, hostname, user, sshKey string) (string, error) {
-	fmt.Println("Running command", cmd)
-	sshCmd := exec.Command("ssh", "-o", "StrictHostKeyChecking no", "-t", "-t", "-i", sshKey, user+"@"+hostname, cmd)
+func ExecuteCmd(cmd, hostname, user, sshKey string, sshPort int) (string, error) {
+	logger.Debugf("Running command %v\n", cmd)
+	sshCmd := exec.Command("ssh", "-o", "StrictHostKeyChecking no", "-t", "-t", "-i", sshKey, "-p", strconv.Itoa(sshPort), user+"@"+hostname, cmd)
 	sshCmd.Stdin = os.Stdin
 	sshOut, sshErr := sshCmd.CombinedOutput()
 	return hostname + ": " + string(sshOut), sshErr
 }
 
-func copyFileToRemote(file string, destFile string, node plan.Node, sshKey string, period time.Duration) error {
+func copyFileToRemote(file string, destFile string, node plan.Node, sshKey string, sshPort int, period time.Duration) error {
 	timeout := time.After(period)
 	success := make(chan bool)
 	go func() {
-		out, err := scpFile(file, destFile, node.SSHUser, node.PublicIPv4, sshKey)
-		fmt.Println(out)
+		out, err := scpFile(context.Background(), file, destFile, node.SSHUser, node.PublicIPv4, sshKey, sshPort)
+		logger.Debugf("%v\n", out)
 		success <- err == nil
 	}()
 	select {
@@ -81,27 +89,397 @@ func copyFileToRemote(file string, destFile string, node plan.Node, sshKey strin
 	return nil
 }
 
-func scpFile(filePath string, destFilePath string, user, hostname, sshKey string) (string, error) {
-	ver := exec.Command("scp", "-o", "StrictHostKeyChecking no", "-i", sshKey, filePath, user+"@"+hostname+":"+destFilePath)
-	out, err := ver.CombinedOutput()
+const (
+	scpRetryAttempts     = 3
+	scpRetryInitialDelay = 2 * time.Second
+)
+
+// scpFile copies the file to the node, retrying with backoff so that a network blip does not
+// lose the copy. The output of the last attempt is returned.
+func scpFile(ctx context.Context, filePath string, destFilePath string, user, hostname, sshKey string, sshPort int) (string, error) {
+	delay := scpRetryInitialDelay
+	for attempt := 1; ; attempt++ {
+		ver := exec.CommandContext(ctx, "scp", "-o", "StrictHostKeyChecking no", "-i", sshKey, "-P", strconv.Itoa(sshPort))
+		ver.Args = append(ver.Args, jumpFor(ctx, hostname).proxyArgs()...)
+		ver.Args = append(ver.Args, filePath, user+"@"+hostname+":"+destFilePath)
+		out, err := ver.CombinedOutput()
+		if err == nil {
+			return string(out), nil
+		}
+		if attempt == scpRetryAttempts || ctx.Err() != nil {
+			return string(out), fmt.Errorf("%v after %d attempts: %s", err, attempt, strings.TrimSpace(string(out)))
+		}
+		logger.Debugf("Copy of %s to %s failed, retrying in %v: %v\n", filePath, hostname, delay, err)
+		select {
+		case <-ctx.Done():
+			return string(out), ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// verifyRemoteFile checks over SSH that the file exists on the node and is not empty
+func verifyRemoteFile(ctx context.Context, destFilePath string, user, hostname, sshKey string, sshPort int) error {
+	out, err := runRemoteCommand(ctx, fmt.Sprintf("test -s '%s'", destFilePath), user, hostname, sshKey, sshPort)
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok && len(strings.TrimSpace(out)) == 0 {
+			return fmt.Errorf("%s is missing or empty on %s", destFilePath, hostname)
+		}
+		return fmt.Errorf("Cannot check %s on %s: %v: %s", destFilePath, hostname, err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// runRemoteCommand runs the command on the node without a terminal and returns its output
+func runRemoteCommand(ctx context.Context, command string, user, hostname, sshKey string, sshPort int) (string, error) {
+	cmd := exec.CommandContext(ctx, "ssh")
+	cmd.Args = append(cmd.Args, "-i", sshKey)
+	cmd.Args = append(cmd.Args, "-p", strconv.Itoa(sshPort))
+	cmd.Args = append(cmd.Args, "-o", "BatchMode=yes")
+	cmd.Args = append(cmd.Args, "-o", "StrictHostKeyChecking=no")
+	cmd.Args = append(cmd.Args, jumpFor(ctx, hostname).proxyArgs()...)
+	cmd.Args = append(cmd.Args, fmt.Sprintf("%s@%s", user, hostname), command)
+	out, err := cmd.CombinedOutput()
 	return string(out), err
 }
 
+// The remote operations of pushSSHKey, replaced in tests
+var (
+	copyToNode = scpFile
+	runOnNode  = runRemoteCommand
+)
+
+// bootstrapKeyPath is where the private key is copied on the bootstrap node, and the key
+// file referenced by the plan when a bootstrap node is requested
+func bootstrapKeyPath(opts DOOpts) string {
+	return path.Join(ketInstallDir(opts), "ssh", opts.SSHKeyName)
+}
+
+// pushSSHKey copies the private key to the bootstrap node, so that kismatic can reach the
+// nodes from there, and returns the path of the copy
+func pushSSHKey(ctx context.Context, opts DOOpts, boot plan.Node) (string, error) {
+	destPath := bootstrapKeyPath(opts)
+	dir := path.Dir(destPath)
+	mkdir := mkdirCommand(dir, boot.SSHUser) + fmt.Sprintf(" && chmod 700 '%s'", dir)
+	if out, err := runOnNode(ctx, mkdir, boot.SSHUser, boot.PublicIPv4, opts.SSHPrivateKey, opts.SSHPort); err != nil {
+		return "", fmt.Errorf("Cannot create %s on %s: %v: %s", dir, boot.PublicIPv4, err, strings.TrimSpace(out))
+	}
+	if _, err := copyToNode(ctx, opts.SSHPrivateKey, destPath, boot.SSHUser, boot.PublicIPv4, opts.SSHPrivateKey, opts.SSHPort); err != nil {
+		return "", err
+	}
+	if out, err := runOnNode(ctx, fmt.Sprintf("chmod 600 '%s'", destPath), boot.SSHUser, boot.PublicIPv4, opts.SSHPrivateKey, opts.SSHPort); err != nil {
+		return "", fmt.Errorf("Cannot set the permissions of %s on %s: %v: %s", destPath, boot.PublicIPv4, err, strings.TrimSpace(out))
+	}
+	return destPath, nil
+}
+
+// mkdirCommand returns the command that creates the directory owned by the SSH user, with
+// sudo for users other than root
+func mkdirCommand(dir, sshUser string) string {
+	if sshUser != "root" {
+		return fmt.Sprintf("sudo mkdir -p '%s' && sudo chown %s '%s'", dir, sshUser, dir)
+	}
+	return fmt.Sprintf("mkdir -p '%s'", dir)
+}
+
+// sshJump is the bastion the SSH connections to the nodes go through, when the nodes cannot be
+// reached directly
+type sshJump struct {
+	Host string
+	User string
+	Port int
+	Key  string
+}
+
+// parseJumpHost parses a jump host given as [user@]host[:port]
+func parseJumpHost(value, defaultUser string, defaultPort int, key string) (*sshJump, error) {
+	jump := &sshJump{User: defaultUser, Port: defaultPort, Key: key}
+	given := value
+	if i := strings.LastIndex(value, "@"); i >= 0 {
+		jump.User = value[:i]
+		value = value[i+1:]
+	}
+	jump.Host = value
+	if host, port, err := net.SplitHostPort(value); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("%q is not a valid port for the jump host", port)
+		}
+		jump.Host = host
+		jump.Port = p
+	}
+	if jump.Host == "" || jump.User == "" || !sshUserPattern.MatchString(jump.User) {
+		return nil, fmt.Errorf("%q is not a valid jump host, use [user@]host[:port]", given)
+	}
+	return jump, nil
+}
+
+// proxyArgs returns the options of ssh and scp that connect through the jump host. ProxyCommand
+// is used rather than -J, so that the key is also used for the jump host.
+func (j *sshJump) proxyArgs() []string {
+	if j == nil {
+		return nil
+	}
+	// ssh runs the proxy command with the shell
+	proxy := fmt.Sprintf("ssh -i %s -p %d -o BatchMode=yes -o StrictHostKeyChecking=no -W %%h:%%p %s@%s", shellQuote(j.Key), j.Port, j.User, j.Host)
+	return []string{"-o", "ProxyCommand=" + proxy}
+}
+
+type sshJumpKey struct{}
+
+// withSSHJump returns a context whose SSH connections to the nodes go through the jump host
+func withSSHJump(ctx context.Context, jump *sshJump) context.Context {
+	return context.WithValue(ctx, sshJumpKey{}, jump)
+}
+
+// jumpFor returns the jump host of the context to reach the host, or nil when the host is
+// reached directly
+func jumpFor(ctx context.Context, host string) *sshJump {
+	jump, _ := ctx.Value(sshJumpKey{}).(*sshJump)
+	if jump == nil || jump.Host == host {
+		return nil
+	}
+	return jump
+}
+
+// nodeAddress returns the IP the node is reached on over SSH: its private IP through the jump
+// host of the context, its public IP otherwise
+func nodeAddress(ctx context.Context, node plan.Node) string {
+	if jump := jumpFor(ctx, node.PublicIPv4); jump != nil && node.PrivateIPv4 != "" {
+		return node.PrivateIPv4
+	}
+	return node.PublicIPv4
+}
+
 // BlockUntilSSHOpen waits until the node with the given IP is accessible via SSH.
-func BlockUntilSSHOpen(host, publicIP, sshUser, sshKey string) {
+func BlockUntilSSHOpen(host, publicIP, sshUser, sshKey string, sshPort int) {
 	for {
-		cmd := exec.Command("ssh")
-		cmd.Args = append(cmd.Args, "-i", sshKey)
-		cmd.Args = append(cmd.Args, "-o", "ConnectTimeout=5")
-		cmd.Args = append(cmd.Args, "-o", "BatchMode=yes")
-		cmd.Args = append(cmd.Args, "-o", "StrictHostKeyChecking=no")
-		cmd.Args = append(cmd.Args, fmt.Sprintf("%s@%s", sshUser, publicIP), "exit") // just call exit if we are able to connect
-		if err := cmd.Run(); err == nil {
-			// command succeeded
-			fmt.Printf("Node %s available on IP %s\n", host, publicIP)
+		if sshAccessible(publicIP, sshUser, sshKey, sshPort) {
+			logger.Infof("Node %s available on IP %s\n", host, publicIP)
 			return
 		}
-		fmt.Printf(".")
+		logger.Infof(".")
 		time.Sleep(3 * time.Second)
 	}
 }
+
+// waitUntilSSHOpen waits until an authenticated SSH session can be opened on the node, or the
+// deadline is reached. It returns the last error when the node did not become accessible.
+func waitUntilSSHOpen(ctx context.Context, node plan.Node, sshKey string, sshPort int, deadline time.Time) error {
+	for {
+		address := nodeAddress(ctx, node)
+		err := checkSSHThrough(jumpFor(ctx, address), address, node.SSHUser, sshKey, sshPort)
+		if err == nil {
+			logger.Debugf("Node %s available on IP %s\n", node.Host, address)
+			return nil
+		}
+		logger.Debugf("SSH to node %s failed: %v\n", node.Host, err)
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+func sshAccessible(publicIP, sshUser, sshKey string, sshPort int) bool {
+	return checkSSH(publicIP, sshUser, sshKey, sshPort) == nil
+}
+
+// sshAuthError is returned when the node accepts SSH connections but rejects the key
+type sshAuthError struct {
+	err error
+}
+
+func (e sshAuthError) Error() string {
+	return fmt.Sprintf("authentication failed: %v", e.err)
+}
+
+func isSSHAuthError(err error) bool {
+	_, ok := err.(sshAuthError)
+	return ok
+}
+
+// checkSSH opens an authenticated SSH session on the node and runs true. Passphrase protected
+// keys cannot be loaded here, so the ssh client is used for them, which can rely on the agent.
+func checkSSH(publicIP, sshUser, sshKey string, sshPort int) error {
+	return checkSSHThrough(nil, publicIP, sshUser, sshKey, sshPort)
+}
+
+// checkSSHThrough is checkSSH connecting through the jump host, if any
+func checkSSHThrough(jump *sshJump, publicIP, sshUser, sshKey string, sshPort int) error {
+	data, err := ioutil.ReadFile(sshKey)
+	if err != nil {
+		return fmt.Errorf("Cannot read private key file %q: %v", sshKey, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return checkSSHCommand(jump, publicIP, sshUser, sshKey, sshPort)
+	}
+	if err != nil {
+		return fmt.Errorf("Cannot parse private key file %q: %v", sshKey, err)
+	}
+	config := &ssh.ClientConfig{
+		User:            sshUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	}
+	client, err := dialSSH(jump, net.JoinHostPort(publicIP, strconv.Itoa(sshPort)), config)
+	if err != nil {
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			return sshAuthError{err}
+		}
+		return err
+	}
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.Run("true")
+}
+
+// dialSSH connects to the address, through the jump host if any. The connection to the jump
+// host is closed with the returned client.
+func dialSSH(jump *sshJump, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if jump == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+	jumpConfig := *config
+	jumpConfig.User = jump.User
+	bastion, err := ssh.Dial("tcp", net.JoinHostPort(jump.Host, strconv.Itoa(jump.Port)), &jumpConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot connect to the jump host %s: %v", jump.Host, err)
+	}
+	conn, err := bastion.Dial("tcp", addr)
+	if err != nil {
+		bastion.Close()
+		return nil, fmt.Errorf("Cannot reach %s from the jump host %s: %v", addr, jump.Host, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		bastion.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	go func() {
+		client.Wait()
+		bastion.Close()
+	}()
+	return client, nil
+}
+
+func checkSSHCommand(jump *sshJump, publicIP, sshUser, sshKey string, sshPort int) error {
+	cmd := exec.Command("ssh")
+	cmd.Args = append(cmd.Args, "-i", sshKey)
+	cmd.Args = append(cmd.Args, "-p", strconv.Itoa(sshPort))
+	cmd.Args = append(cmd.Args, "-o", "ConnectTimeout=5")
+	cmd.Args = append(cmd.Args, "-o", "BatchMode=yes")
+	cmd.Args = append(cmd.Args, "-o", "StrictHostKeyChecking=no")
+	cmd.Args = append(cmd.Args, jump.proxyArgs()...)
+	cmd.Args = append(cmd.Args, fmt.Sprintf("%s@%s", sshUser, publicIP), "true")
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(string(out), "Permission denied") {
+		return sshAuthError{fmt.Errorf("%s", strings.TrimSpace(string(out)))}
+	}
+	return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+}
+
+// publicKeyFingerprint returns the MD5 fingerprint of the public key file, in the
+// format used by Digital Ocean to identify keys.
+func publicKeyFingerprint(publicKeyFile string) (string, error) {
+	data, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read public key file %q: %v", publicKeyFile, err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse public key file %q: %v", publicKeyFile, err)
+	}
+	return ssh.FingerprintLegacyMD5(pub), nil
+}
+
+// checkKeyPair detects the type of the private key from its contents and makes
+// sure it matches the public key. Passphrase protected private keys cannot be
+// inspected, in which case the type of the public key is returned.
+func checkKeyPair(privateKeyFile, publicKeyFile string) (string, error) {
+	pubData, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read public key file %q: %v", publicKeyFile, err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(pubData)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse public key file %q: %v", publicKeyFile, err)
+	}
+	if !supportedKeyType(pub.Type()) {
+		return "", fmt.Errorf("Unsupported SSH key type %s in %q", pub.Type(), publicKeyFile)
+	}
+
+	privData, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read private key file %q: %v", privateKeyFile, err)
+	}
+	signer, err := ssh.ParsePrivateKey(privData)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return pub.Type(), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse private key file %q: %v", privateKeyFile, err)
+	}
+	if !bytes.Equal(signer.PublicKey().Marshal(), pub.Marshal()) {
+		return "", fmt.Errorf("Public key %q does not match private key %q", publicKeyFile, privateKeyFile)
+	}
+	return signer.PublicKey().Type(), nil
+}
+
+func supportedKeyType(keyType string) bool {
+	switch keyType {
+	case ssh.KeyAlgoRSA, ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return true
+	}
+	return false
+}
+
+// authorizedKey reads the public key file and returns it in the authorized_keys
+// format expected by Digital Ocean, without any trailing comment or whitespace.
+func authorizedKey(publicKeyFile string) (string, error) {
+	data, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read public key file %q: %v", publicKeyFile, err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse public key file %q: %v", publicKeyFile, err)
+	}
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(pub))), nil
+}
+
+// sshUserKey returns the public key that is authorized for the SSH user. Without a public key
+// file, as with a key referenced by name, it is derived from the private key.
+func sshUserKey(opts DOOpts) (string, error) {
+	if opts.SSHPublicKey != "" {
+		return authorizedKey(opts.SSHPublicKey)
+	}
+	data, err := ioutil.ReadFile(opts.SSHPrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read private key file %q: %v", opts.SSHPrivateKey, err)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return "", fmt.Errorf("The public key of the passphrase protected key %q is required for SSH user %s. Use --ssh-pubkey", opts.SSHPrivateKey, opts.SSHUser)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Cannot parse private key file %q: %v", opts.SSHPrivateKey, err)
+	}
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
@@ -0,0 +1,111 @@
+package digitalocean
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+
+	"github.com/apprenda/kismatic-provision/provision/plan"
+	"github.com/spf13/cobra"
+)
+
+func DOSSHCmd() *cobra.Command {
+	opts := DOOpts{}
+	var role string
+	var index int
+	var bootstrap bool
+	cmd := &cobra.Command{
+		Use:   "ssh [-- command]",
+		Short: "Opens an SSH session on a node of a cluster",
+		Long: `Looks up the node with the given role and index among the droplets with the given tag, and runs ssh
+with the SSH user, the private key and the public IP of the node. The index starts at 0, in the order of the node names.
+Arguments after -- are run on the node instead of opening an interactive session.`,
+		Example: `# Connect to the first master node of the cluster tagged apprenda
+provision do ssh --tag apprenda --role master --index 0
+
+# Run kismatic on the bootstrap node
+provision do ssh --tag apprenda --bootstrap -- ls /ket`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := applyConfigFile(&opts, cmd.Flags()); err != nil {
+				return err
+			}
+			if bootstrap {
+				if cmd.Flags().Changed("role") && role != "bootstrap" {
+					return fmt.Errorf("--bootstrap cannot be used with --role %s", role)
+				}
+				role = "bootstrap"
+			}
+			return sshToNode(opts, role, index, args)
+		},
+	}
+
+	cmd.Flags().StringVarP(&opts.ClusterTag, "tag", "", "apprenda", "TAG of the cluster the node is looked up in")
+	cmd.Flags().StringVarP(&role, "role", "", "master", "Role of the node: etcd, master, worker, ingress or bootstrap")
+	cmd.Flags().IntVarP(&index, "index", "", 0, "Index of the node among the nodes with the role, starting at 0")
+	cmd.Flags().BoolVarP(&bootstrap, "bootstrap", "", false, "If present, connects to the bootstrap node")
+	cmd.Flags().StringVarP(&opts.SSHUser, "sshuser", "", "root", "SSH User name")
+	cmd.Flags().StringVarP(&opts.SSHPrivateKey, "ssh-key", "", "", "Path to the SSH private key used to access the nodes. Defaults to $DO_SECRET_ACCESS_KEY or ssh/cluster.pem next to the executable.")
+	cmd.Flags().IntVarP(&opts.SSHPort, "ssh-port", "", 22, "Port on which sshd listens on the nodes.")
+	cmd.Flags().StringVarP(&opts.ConfigFile, "config", "", "", "Path to the config file with provisioning defaults. Defaults to ~/.kismatic-provision/do.yaml")
+
+	return cmd
+}
+
+func sshToNode(opts DOOpts, role string, index int, command []string) error {
+	validRole := false
+	for _, r := range ROLES {
+		if r == role {
+			validRole = true
+		}
+	}
+	if !validRole {
+		return fmt.Errorf("%v is not a valid role. Current options: etcd, master, worker, ingress, bootstrap", role)
+	}
+	if index < 0 {
+		return fmt.Errorf("The index cannot be negative")
+	}
+	sshKey := privateKeyPath(opts)
+	if _, err := os.Stat(sshKey); err != nil {
+		return fmt.Errorf("Did not find SSH private key at %q: %v", sshKey, err)
+	}
+	if err := resolveToken(&opts); err != nil {
+		return err
+	}
+
+	provisioner, err := GetProvisioner()
+	if err != nil {
+		return err
+	}
+	nodes, err := provisioner.ExistingNodes(opts)
+	if err != nil {
+		return err
+	}
+	node, err := nodeAtIndex(nodes.byRole(role), role, index)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Connecting to %s (%s) as %s\n", node.Host, node.PublicIPv4, node.SSHUser)
+
+	sshCmd := exec.Command("ssh", "-o", "StrictHostKeyChecking no", "-i", sshKey, "-p", strconv.Itoa(opts.SSHPort), node.SSHUser+"@"+node.PublicIPv4)
+	sshCmd.Args = append(sshCmd.Args, command...)
+	sshCmd.Stdin = os.Stdin
+	sshCmd.Stdout = os.Stdout
+	sshCmd.Stderr = os.Stderr
+	return sshCmd.Run()
+}
+
+// nodeAtIndex returns the node at the index, in the order of the node names
+func nodeAtIndex(nodes []plan.Node, role string, index int) (plan.Node, error) {
+	if index >= len(nodes) {
+		return plan.Node{}, fmt.Errorf("The cluster has %d %s node(s), there is no node at index %d", len(nodes), role, index)
+	}
+	sorted := append([]plan.Node{}, nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		_, a := parseNodeName(sorted[i].Host)
+		_, b := parseNodeName(sorted[j].Host)
+		return a < b
+	})
+	return sorted[index], nil
+}
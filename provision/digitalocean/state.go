@@ -0,0 +1,297 @@
+package digitalocean
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync"
+
+	"github.com/apprenda/kismatic-provision/provision/utils"
+)
+
+const STATE_FILE = "kismatic-provision-state"
+
+// dnsRecordRef identifies a DNS record, whose ID is only unique within its domain
+type dnsRecordRef struct {
+	Domain string `json:"domain"`
+	ID     int    `json:"id"`
+}
+
+// State describes the infrastructure created by a single provisioning run
+type State struct {
+	mu              sync.Mutex
+	ClusterTag      string         `json:"clusterTag"`
+	KeyName         string         `json:"keyName,omitempty"`
+	DropletIDs      []int          `json:"dropletIDs"`
+	VolumeIDs       []string       `json:"volumeIDs"`
+	FloatingIPs     []string       `json:"floatingIPs"`
+	LoadBalancerIDs []string       `json:"loadBalancerIDs"`
+	FirewallIDs     []string       `json:"firewallIDs"`
+	DNSRecords      []dnsRecordRef `json:"dnsRecords,omitempty"`
+	// JoinedFirewallIDs are the existing firewalls the cluster tag was added to. The tag is
+	// removed from them, they are not deleted.
+	JoinedFirewallIDs []string `json:"joinedFirewallIDs,omitempty"`
+	// path is the file the state was loaded from, which is overwritten when a run is resumed
+	path string
+	// key is the key the droplets were created with, even if it is not removed with the cluster
+	key KeyConfig
+	// restored are the resources of the previous run when it is resumed, which are not removed
+	// by a rollback
+	restored *State
+}
+
+func (s *State) addDroplet(id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DropletIDs = append(s.DropletIDs, id)
+}
+
+func (s *State) setKey(key KeyConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.key = key
+}
+
+func (s *State) addVolume(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.VolumeIDs = append(s.VolumeIDs, id)
+}
+
+func (s *State) addFloatingIP(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.FloatingIPs = append(s.FloatingIPs, ip)
+}
+
+func (s *State) addLoadBalancer(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.LoadBalancerIDs = append(s.LoadBalancerIDs, id)
+}
+
+func (s *State) addFirewall(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.FirewallIDs = append(s.FirewallIDs, id)
+}
+
+func (s *State) addJoinedFirewall(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.JoinedFirewallIDs = append(s.JoinedFirewallIDs, id)
+}
+
+func (s *State) addDNSRecord(domain string, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DNSRecords = append(s.DNSRecords, dnsRecordRef{Domain: domain, ID: id})
+}
+
+// restore records the resources of a previous run, to continue it
+func (s *State) restore(from *State) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ClusterTag = from.ClusterTag
+	s.KeyName = from.KeyName
+	s.DropletIDs = from.DropletIDs
+	s.VolumeIDs = from.VolumeIDs
+	s.FloatingIPs = from.FloatingIPs
+	s.LoadBalancerIDs = from.LoadBalancerIDs
+	s.FirewallIDs = from.FirewallIDs
+	s.DNSRecords = from.DNSRecords
+	s.JoinedFirewallIDs = from.JoinedFirewallIDs
+	s.path = from.path
+	s.restored = &State{
+		DropletIDs:        append([]int{}, from.DropletIDs...),
+		VolumeIDs:         append([]string{}, from.VolumeIDs...),
+		FloatingIPs:       append([]string{}, from.FloatingIPs...),
+		LoadBalancerIDs:   append([]string{}, from.LoadBalancerIDs...),
+		FirewallIDs:       append([]string{}, from.FirewallIDs...),
+		DNSRecords:        append([]dnsRecordRef{}, from.DNSRecords...),
+		JoinedFirewallIDs: append([]string{}, from.JoinedFirewallIDs...),
+	}
+}
+
+// created returns the resources created by this run, without those of the resumed run
+func (s *State) created() *State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored := s.restored
+	if restored == nil {
+		restored = &State{}
+	}
+	created := &State{ClusterTag: s.ClusterTag, KeyName: s.KeyName}
+	for _, id := range s.DropletIDs {
+		if !containsInt(restored.DropletIDs, id) {
+			created.DropletIDs = append(created.DropletIDs, id)
+		}
+	}
+	created.VolumeIDs = notIn(s.VolumeIDs, restored.VolumeIDs)
+	created.FloatingIPs = notIn(s.FloatingIPs, restored.FloatingIPs)
+	created.LoadBalancerIDs = notIn(s.LoadBalancerIDs, restored.LoadBalancerIDs)
+	created.FirewallIDs = notIn(s.FirewallIDs, restored.FirewallIDs)
+	created.JoinedFirewallIDs = notIn(s.JoinedFirewallIDs, restored.JoinedFirewallIDs)
+	for _, r := range s.DNSRecords {
+		found := false
+		for _, o := range restored.DNSRecords {
+			found = found || o == r
+		}
+		if !found {
+			created.DNSRecords = append(created.DNSRecords, r)
+		}
+	}
+	return created
+}
+
+func containsInt(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// notIn returns the ids that are not in others
+func notIn(ids, others []string) []string {
+	known := map[string]bool{}
+	for _, id := range others {
+		known[id] = true
+	}
+	var result []string
+	for _, id := range ids {
+		if !known[id] {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// clear forgets the resources created by this run, once they have been removed. Those of the
+// resumed run are kept.
+func (s *State) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restored != nil {
+		s.DropletIDs = s.restored.DropletIDs
+		s.VolumeIDs = s.restored.VolumeIDs
+		s.FloatingIPs = s.restored.FloatingIPs
+		s.LoadBalancerIDs = s.restored.LoadBalancerIDs
+		s.FirewallIDs = s.restored.FirewallIDs
+		s.DNSRecords = s.restored.DNSRecords
+		s.JoinedFirewallIDs = s.restored.JoinedFirewallIDs
+		return
+	}
+	s.DropletIDs = nil
+	s.VolumeIDs = nil
+	s.FloatingIPs = nil
+	s.LoadBalancerIDs = nil
+	s.FirewallIDs = nil
+	s.DNSRecords = nil
+	s.JoinedFirewallIDs = nil
+}
+
+func (s *State) isEmpty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.DropletIDs) == 0 && len(s.VolumeIDs) == 0 && len(s.FloatingIPs) == 0 &&
+		len(s.LoadBalancerIDs) == 0 && len(s.FirewallIDs) == 0 && len(s.DNSRecords) == 0 &&
+		len(s.JoinedFirewallIDs) == 0
+}
+
+// writeState writes the state to a new file in the working directory, or to the file it was
+// loaded from, and returns its name
+func writeState(state *State) (string, error) {
+	state.mu.Lock()
+	data, err := json.MarshalIndent(state, "", "  ")
+	path := state.path
+	state.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	if path != "" {
+		return path, ioutil.WriteFile(path, data, 0644)
+	}
+	f, err := utils.MakeUniqueFile(STATE_FILE, ".json", 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+func loadState(path string) (*State, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read state file %q: %v", path, err)
+	}
+	state := &State{}
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Cannot parse state file %q: %v", path, err)
+	}
+	return state, nil
+}
+
+// resourceReceipt lists the resources created by a run, for cleanup and auditing
+type resourceReceipt struct {
+	ClusterTag      string           `json:"clusterTag"`
+	Droplets        map[string][]int `json:"droplets"`
+	VolumeIDs       []string         `json:"volumeIDs"`
+	KeyName         string           `json:"keyName"`
+	KeyFingerprint  string           `json:"keyFingerprint"`
+	FirewallIDs     []string         `json:"firewallIDs"`
+	LoadBalancerIDs []string         `json:"loadBalancerIDs"`
+	FloatingIPs     []string         `json:"floatingIPs"`
+	DNSRecords      []dnsRecordRef   `json:"dnsRecords"`
+	// JoinedFirewallIDs were not created, the cluster tag was added to their targets
+	JoinedFirewallIDs []string `json:"joinedFirewallIDs,omitempty"`
+}
+
+// newResourceReceipt groups the droplets of the state by role. The droplets that were not
+// created by this run are not listed.
+func newResourceReceipt(state *State, nodes ProvisionedNodes) resourceReceipt {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	created := map[string]bool{}
+	for _, id := range state.DropletIDs {
+		created[strconv.Itoa(id)] = true
+	}
+	receipt := resourceReceipt{
+		ClusterTag:        state.ClusterTag,
+		Droplets:          map[string][]int{},
+		VolumeIDs:         append([]string{}, state.VolumeIDs...),
+		KeyName:           state.key.Name,
+		KeyFingerprint:    state.key.Fingerprint,
+		FirewallIDs:       append([]string{}, state.FirewallIDs...),
+		LoadBalancerIDs:   append([]string{}, state.LoadBalancerIDs...),
+		FloatingIPs:       append([]string{}, state.FloatingIPs...),
+		DNSRecords:        append([]dnsRecordRef{}, state.DNSRecords...),
+		JoinedFirewallIDs: append([]string{}, state.JoinedFirewallIDs...),
+	}
+	for _, role := range ROLES {
+		ids := []int{}
+		for _, n := range nodes.byRole(role) {
+			if id, err := strconv.Atoi(n.ID); err == nil && created[n.ID] {
+				ids = append(ids, id)
+			}
+		}
+		receipt.Droplets[role] = ids
+	}
+	return receipt
+}
+
+// printResourceReceipt writes the receipt as a single line of JSON
+func printResourceReceipt(out io.Writer, state *State, nodes ProvisionedNodes) error {
+	data, err := json.Marshal(newResourceReceipt(state, nodes))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, string(data))
+	return err
+}
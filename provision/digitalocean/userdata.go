@@ -0,0 +1,126 @@
+package digitalocean
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// MAX_USER_DATA_SIZE is the maximum size of the user data accepted by Digital Ocean
+const MAX_USER_DATA_SIZE = 64 * 1024
+
+// validateUserDataFile checks that the user data file exists and is not too large
+func validateUserDataFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Cannot read user data file %q: %v", path, err)
+	}
+	if info.Size() > MAX_USER_DATA_SIZE {
+		return fmt.Errorf("User data file %q is %d bytes, the maximum is %d bytes", path, info.Size(), MAX_USER_DATA_SIZE)
+	}
+	return nil
+}
+
+func loadUserData(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Cannot read user data file %q: %v", path, err)
+	}
+	return string(data), nil
+}
+
+// combineUserData merges several user data scripts into a single multipart document,
+// so that cloud-init runs all of them. Empty scripts are ignored.
+func combineUserData(scripts ...string) (string, error) {
+	parts := []string{}
+	for _, s := range scripts {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return "", nil
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", userDataContentType(part)+"; charset=\"us-ascii\"")
+		pw, err := w.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err = pw.Write([]byte(part)); err != nil {
+			return "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	combined := fmt.Sprintf("Content-Type: multipart/mixed; boundary=\"%s\"\nMIME-Version: 1.0\n\n%s", w.Boundary(), body.String())
+	if len(combined) > MAX_USER_DATA_SIZE {
+		return "", fmt.Errorf("Combined user data is %d bytes, the maximum is %d bytes", len(combined), MAX_USER_DATA_SIZE)
+	}
+	return combined, nil
+}
+
+// sudoUserData returns the cloud-config that creates the SSH user with passwordless sudo and
+// authorizes the provisioning key for it, for images that do not allow root logins
+func sudoUserData(user, authorizedKey string) string {
+	return fmt.Sprintf(`#cloud-config
+users:
+  - default
+  - name: %s
+    shell: /bin/bash
+    sudo: "ALL=(ALL) NOPASSWD:ALL"
+    ssh_authorized_keys:
+      - %s
+`, user, authorizedKey)
+}
+
+// nodeExporterUserData returns the script that installs the Prometheus node exporter as a
+// systemd service listening on NODE_EXPORTER_PORT
+func nodeExporterUserData(version string) string {
+	return fmt.Sprintf(`#!/bin/bash
+set -e
+cd /tmp
+curl -sSL https://github.com/prometheus/node_exporter/releases/download/v%[1]s/node_exporter-%[1]s.linux-amd64.tar.gz | tar -xz
+mv node_exporter-%[1]s.linux-amd64/node_exporter /usr/local/bin/node_exporter
+rm -rf node_exporter-%[1]s.linux-amd64
+id node_exporter >/dev/null 2>&1 || useradd --system --no-create-home --shell /usr/sbin/nologin node_exporter
+cat > /etc/systemd/system/node_exporter.service <<'UNIT'
+[Unit]
+Description=Prometheus node exporter
+After=network-online.target
+
+[Service]
+User=node_exporter
+ExecStart=/usr/local/bin/node_exporter --web.listen-address=:%[2]d
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+UNIT
+systemctl daemon-reload
+systemctl enable --now node_exporter
+`, version, NODE_EXPORTER_PORT)
+}
+
+func userDataContentType(script string) string {
+	if strings.HasPrefix(script, "#cloud-config") {
+		return "text/cloud-config"
+	}
+	return "text/x-shellscript"
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/apprenda/kismatic-provision/provision/aws"
@@ -10,6 +11,9 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// version is the build version of the provisioner, set with -ldflags "-X main.version=..."
+var version = "dev"
+
 var rootCmd = &cobra.Command{
 	Use:   "provision",
 	Short: "Provision is a tool for making Kubernetes capable infrastructure",
@@ -24,6 +28,19 @@ func init() {
 	rootCmd.AddCommand(digitalocean.Cmd())
 	rootCmd.AddCommand(packet.Cmd())
 	rootCmd.AddCommand(vagrant.Cmd())
+	rootCmd.AddCommand(versionCmd())
+}
+
+func versionCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Prints the version of the provisioner and the default versions installed on the bootstrap node",
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("provision: %s\n", version)
+			fmt.Printf("kismatic:  %s\n", digitalocean.DEFAULT_KET_VERSION)
+			fmt.Printf("kubectl:   %s\n", digitalocean.DEFAULT_KUBECTL_VERSION)
+		},
+	}
 }
 
 func main() {
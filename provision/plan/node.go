@@ -1,9 +1,27 @@
 package plan
 
 type Node struct {
-	ID          string
-	Host        string
-	PublicIPv4  string
-	PrivateIPv4 string
-	SSHUser     string
+	ID          string `json:"id"`
+	Host        string `json:"host"`
+	PublicIPv4  string `json:"publicIPv4"`
+	PrivateIPv4 string `json:"privateIPv4"`
+	PublicIPv6  string `json:"publicIPv6,omitempty"`
+	SSHUser     string `json:"sshUser"`
+	// Region and Size describe the machine the node runs on, when the provider has them
+	Region string `json:"region,omitempty"`
+	Size   string `json:"size,omitempty"`
+	// VolumeDevice is the path to the dedicated block device attached to the node, if any
+	VolumeDevice string `json:"volumeDevice,omitempty"`
+	// DataDir is the directory the volume is mounted on, for the data of the node's role
+	DataDir string `json:"dataDir,omitempty"`
+	// Labels and Taints are applied to the Kubernetes node by kismatic
+	Labels map[string]string `json:"labels,omitempty"`
+	Taints []Taint           `json:"taints,omitempty"`
+}
+
+// Taint keeps the pods that do not tolerate it from being scheduled on a node
+type Taint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Effect string `json:"effect"`
 }
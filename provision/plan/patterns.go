@@ -10,15 +10,35 @@ type Plan struct {
 	MasterNodeShortName string
 	SSHUser             string
 	SSHKeyFile          string
+	SSHPort             int
 	AdminPassword       string
+	AdminUsername       string
+	// PodCIDR and ServiceCIDR are the pod and service networks, DefaultPodCIDR and
+	// DefaultServiceCIDR when empty
+	PodCIDR     string
+	ServiceCIDR string
+	// NetworkMode is the calico mode, overlay when empty. Routed avoids the encapsulation
+	// overhead when the nodes can route the pod traffic to each other.
+	NetworkMode string
 }
 
+// The networks of the cluster when none is given
+const (
+	DefaultPodCIDR     = "172.16.0.0/16"
+	DefaultServiceCIDR = "172.20.0.0/16"
+)
+
 const OverlayNetworkPlan = `cluster:
   name: kubernetes
 
   # This password is used to login to the Kubernetes Dashboard and can also be
   # used for administration without a security certificate.
   admin_password: {{.AdminPassword}}
+{{- if .AdminUsername}}
+
+  # The name of the admin user that logs in with the admin password.
+  admin_username: {{.AdminUsername}}
+{{- end}}
 
   # Set to true if the nodes have the required packages installed.
   disable_package_installation: false
@@ -31,11 +51,11 @@ const OverlayNetworkPlan = `cluster:
 
     # Kubernetes will assign pods IPs in this range. Do not use a range that is
     # already in use on your local network!
-    pod_cidr_block: 172.16.0.0/16
+    pod_cidr_block: {{or .PodCIDR "` + DefaultPodCIDR + `"}}
 
     # Kubernetes will assign services IPs in this range. Do not use a range
     # that is already in use by your local network or pod network!
-    service_cidr_block: 172.20.0.0/16
+    service_cidr_block: {{or .ServiceCIDR "` + DefaultServiceCIDR + `"}}
 
     # Set to true if your nodes cannot resolve each others' names using DNS.
     update_hosts_files: true
@@ -67,7 +87,7 @@ const OverlayNetworkPlan = `cluster:
 
     # Absolute path to the ssh private key we should use to manage nodes.
     ssh_key: {{.SSHKeyFile}}
-    ssh_port: 22
+    ssh_port: {{if .SSHPort}}{{.SSHPort}}{{else}}22{{end}}
 
   # Override configuration of Kubernetes components.
   kube_apiserver:
@@ -144,7 +164,7 @@ add_ons:
       calico:
 
         # Options: 'overlay','routed'.
-        mode: overlay
+        mode: {{or .NetworkMode "overlay"}}
 
         # Options: 'warning','info','debug'.
         log_level: info
@@ -197,7 +217,12 @@ etcd:
   - host: {{.Host}}
     ip: {{.PublicIPv4}}
     internalip: {{.PrivateIPv4}}
-    labels: {}{{end}}
+    labels:{{if .Labels}}{{range $key, $value := .Labels}}
+      {{$key}}: "{{$value}}"{{end}}{{else}} {}{{end}}{{if .Taints}}
+    taints:{{range .Taints}}
+    - key: {{.Key}}
+      value: "{{.Value}}"
+      effect: {{.Effect}}{{end}}{{end}}{{end}}
 
 # Master nodes are the ones that run the Kubernetes control plane components.
 master:
@@ -214,7 +239,12 @@ master:
   - host: {{.Host}}
     ip: {{.PublicIPv4}}
     internalip: {{.PrivateIPv4}}
-    labels: {}{{end}}
+    labels:{{if .Labels}}{{range $key, $value := .Labels}}
+      {{$key}}: "{{$value}}"{{end}}{{else}} {}{{end}}{{if .Taints}}
+    taints:{{range .Taints}}
+    - key: {{.Key}}
+      value: "{{.Value}}"
+      effect: {{.Effect}}{{end}}{{end}}{{end}}
 
 # Worker nodes are the ones that will run your workloads on the cluster.
 worker:
@@ -223,7 +253,12 @@ worker:
   - host: {{.Host}}
     ip: {{.PublicIPv4}}
     internalip: {{.PrivateIPv4}}
-    labels: {}{{end}}
+    labels:{{if .Labels}}{{range $key, $value := .Labels}}
+      {{$key}}: "{{$value}}"{{end}}{{else}} {}{{end}}{{if .Taints}}
+    taints:{{range .Taints}}
+    - key: {{.Key}}
+      value: "{{.Value}}"
+      effect: {{.Effect}}{{end}}{{end}}{{end}}
 
 # Ingress nodes will run the ingress controllers.
 ingress:
@@ -232,7 +267,12 @@ ingress:
   - host: {{.Host}}
     ip: {{.PublicIPv4}}
     internalip: {{.PrivateIPv4}}
-    labels: {}{{end}}
+    labels:{{if .Labels}}{{range $key, $value := .Labels}}
+      {{$key}}: "{{$value}}"{{end}}{{else}} {}{{end}}{{if .Taints}}
+    taints:{{range .Taints}}
+    - key: {{.Key}}
+      value: "{{.Value}}"
+      effect: {{.Effect}}{{end}}{{end}}{{end}}
 
 # Storage nodes will be used to create a distributed storage cluster that can
 # be consumed by your workloads.
@@ -242,5 +282,10 @@ storage:
   - host: {{.Host}}
     ip: {{.PublicIPv4}}
     internalip: {{.PrivateIPv4}}
-    labels: {}{{end}}
+    labels:{{if .Labels}}{{range $key, $value := .Labels}}
+      {{$key}}: "{{$value}}"{{end}}{{else}} {}{{end}}{{if .Taints}}
+    taints:{{range .Taints}}
+    - key: {{.Key}}
+      value: "{{.Value}}"
+      effect: {{.Effect}}{{end}}{{end}}{{end}}
 `
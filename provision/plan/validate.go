@@ -0,0 +1,73 @@
+package plan
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// renderedPlan holds the fields of a rendered plan file that are checked by Validate
+type renderedPlan struct {
+	Cluster struct {
+		SSH struct {
+			User string `yaml:"user"`
+			Key  string `yaml:"ssh_key"`
+		} `yaml:"ssh"`
+	} `yaml:"cluster"`
+	Etcd   renderedNodeGroup `yaml:"etcd"`
+	Master struct {
+		renderedNodeGroup `yaml:",inline"`
+		FQDN              string `yaml:"load_balanced_fqdn"`
+	} `yaml:"master"`
+	Worker renderedNodeGroup `yaml:"worker"`
+}
+
+type renderedNodeGroup struct {
+	ExpectedCount int `yaml:"expected_count"`
+	Nodes         []struct {
+		Host string `yaml:"host"`
+		IP   string `yaml:"ip"`
+	} `yaml:"nodes"`
+}
+
+// Validate parses a rendered plan file and checks that the fields required by
+// Kismatic are set, so that a broken plan is caught before running the installer.
+func Validate(data []byte) error {
+	p := renderedPlan{}
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("The plan is not valid YAML: %v", err)
+	}
+	msg := ""
+	if p.Cluster.SSH.User == "" {
+		msg = msg + " - cluster.ssh.user is empty\n"
+	}
+	if p.Cluster.SSH.Key == "" {
+		msg = msg + " - cluster.ssh.ssh_key is empty\n"
+	}
+	if p.Master.FQDN == "" {
+		msg = msg + " - master.load_balanced_fqdn is empty\n"
+	}
+	msg = msg + validateNodeGroup("etcd", p.Etcd, true)
+	msg = msg + validateNodeGroup("master", p.Master.renderedNodeGroup, true)
+	msg = msg + validateNodeGroup("worker", p.Worker, false)
+	if msg != "" {
+		return fmt.Errorf("The plan is not valid:\n%s", msg)
+	}
+	return nil
+}
+
+func validateNodeGroup(name string, group renderedNodeGroup, required bool) string {
+	msg := ""
+	if required && len(group.Nodes) == 0 {
+		msg = msg + fmt.Sprintf(" - %s.nodes is empty\n", name)
+	}
+	if group.ExpectedCount != len(group.Nodes) {
+		msg = msg + fmt.Sprintf(" - %s.expected_count is %d, but %d nodes are listed\n", name, group.ExpectedCount, len(group.Nodes))
+	}
+	for i, n := range group.Nodes {
+		if n.Host == "" || n.IP == "" {
+			msg = msg + fmt.Sprintf(" - %s.nodes[%d] is missing its host or ip\n", name, i)
+		}
+	}
+	return msg
+}
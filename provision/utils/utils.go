@@ -203,3 +203,21 @@ func CreatePublicKey(privateKey *rsa.PrivateKey, publicKeyPath string) error {
 	}
 	return ioutil.WriteFile(publicKeyPath, ssh.MarshalAuthorizedKey(pub), 0655)
 }
+
+// GenerateSSHKeyPair writes a new RSA key pair of the given size. The private key
+// is only readable by the current user.
+func GenerateSSHKeyPair(privateKeyPath, publicKeyPath string, bits int) error {
+	privateKey, err := rsa.GenerateKey(cryptorand.Reader, bits)
+	if err != nil {
+		return err
+	}
+	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	if err = ioutil.WriteFile(privateKeyPath, pem.EncodeToMemory(privateKeyPEM), 0600); err != nil {
+		return err
+	}
+	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(publicKeyPath, ssh.MarshalAuthorizedKey(pub), 0644)
+}